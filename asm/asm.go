@@ -0,0 +1,170 @@
+package asm
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"chrisriddick.net/progfile"
+)
+
+// Error is an assembly error tied to a position in the source
+type Error struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+// ErrorList collects every error found while assembling a program
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	var msgs []string
+	for _, e := range l {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// SymbolKind tells how a symbol was defined
+type SymbolKind int
+
+const (
+	SymAddress  SymbolKind = iota // Defined by "name:" at the current address
+	SymConstant                   // Defined by .equ
+	SymLabel                      // Defined by a LABEL instruction, usable as a GOTO target
+	SymImport                     // Declared by .import, resolved by the linker
+)
+
+func (k SymbolKind) String() string {
+	switch k {
+	case SymAddress:
+		return "address"
+	case SymConstant:
+		return "constant"
+	case SymLabel:
+		return "label"
+	case SymImport:
+		return "import"
+	}
+	return "unknown"
+}
+
+// Symbol is an entry of the symbol table
+type Symbol struct {
+	Name     string
+	Kind     SymbolKind
+	Value    uint16 // Address or constant value. For SymLabel, the address execution continues at
+	Number   int    // LABEL number for SymLabel
+	Exported bool   // Named by .export, visible to other modules when linking
+	File     string
+	Line     int
+}
+
+// Segment is a contiguous run of assembled bytes starting at Addr
+type Segment struct {
+	Addr uint16
+	Data []byte
+}
+
+// Relocation marks a 16-bit big-endian word holding an address. The linker
+// adds the module origin to it, or the address of Symbol when one is named.
+type Relocation struct {
+	Offset uint16
+	Symbol string // Imported symbol, empty for addresses within the program
+}
+
+// Program is the result of assembling a source file
+type Program struct {
+	Segments    []Segment
+	Symbols     map[string]*Symbol
+	Relocations []Relocation
+	LabelRefs   []uint16 // Addresses of LABEL and GOTO instructions, renumbered when linking
+	listing     []listingLine
+}
+
+// Image returns the program as a single byte slice starting at address 0,
+// with gaps between segments filled with zeros, ready for CPU.Load
+func (p *Program) Image() []byte {
+	var end int
+	for _, seg := range p.Segments {
+		if e := int(seg.Addr) + len(seg.Data); e > end {
+			end = e
+		}
+	}
+	image := make([]byte, end)
+	for _, seg := range p.Segments {
+		copy(image[seg.Addr:], seg.Data)
+	}
+	return image
+}
+
+// SortedSymbols returns the symbol table ordered by value, then by name
+func (p *Program) SortedSymbols() []*Symbol {
+	var list []*Symbol
+	for _, sym := range p.Symbols {
+		list = append(list, sym)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Value != list[j].Value {
+			return list[i].Value < list[j].Value
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Options control the preprocessing of source files
+type Options struct {
+	IncludeDirs []string       // Searched by .include after the directory of the including file
+	IncludeRoot string         // When set, .include only reads files inside this directory
+	Defines     map[string]int // Constants predefined for .if, .ifdef and operands
+	Relocatable bool           // Assemble an object file for the linker, allowing .import
+}
+
+// Assemble translates the source text in src into machine code.
+// Filename is used to report error positions and to find included files.
+func Assemble(filename string, src []byte) (*Program, error) {
+	return AssembleWithOptions(filename, src, Options{})
+}
+
+// AssembleWithOptions is Assemble with include directories and predefined constants
+func AssembleWithOptions(filename string, src []byte, opts Options) (*Program, error) {
+	a := newAssembler(opts)
+	for name, v := range opts.Defines {
+		a.symbols[name] = &Symbol{Name: name, Kind: SymConstant, Value: uint16(v), File: "<command line>"}
+	}
+	a.readSource(filename, string(src), opts)
+	return a.assemble()
+}
+
+// AssembleFile reads and assembles the source file at path
+func AssembleFile(path string, opts Options) (*Program, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return AssembleWithOptions(path, src, opts)
+}
+
+// ProgramFile returns the program as a program image with the default
+// machine. Execution starts at the address symbol "start" when there is one,
+// at address 0 otherwise.
+func (p *Program) ProgramFile() *progfile.File {
+	var segs []progfile.Segment
+	for _, seg := range p.Segments {
+		segs = append(segs, progfile.Segment{Addr: seg.Addr, Data: seg.Data})
+	}
+	f := progfile.New(segs)
+	if start, ok := p.Symbols["start"]; ok && start.Kind == SymAddress {
+		f.Entry = start.Value
+	}
+	f.Symbols = p.SymbolMap()
+	return f
+}
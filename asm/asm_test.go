@@ -0,0 +1,511 @@
+package asm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/disasm"
+	"chrisriddick.net/symbols"
+)
+
+func TestAssembleSum1To10(t *testing.T) {
+	fmt.Println("TestAssembleSum1To10")
+	src := `
+; Sum the numbers from 1 to 10
+        set 0
+        push r0
+        pop r1          ; R1 = running total
+        set 10
+        push r0
+        pop r2          ; R2 = counter
+        set 1
+        push r0
+        pop r3          ; R3 = decrement
+        label loop
+        push r1
+        pop r0
+        add r2
+        push r0
+        pop r1
+        push r2
+        pop r0
+        sub r3
+        push r0
+        pop r2
+        goto loop, nz
+        push r1
+        pop r0
+        halt
+`
+	prog, err := Assemble("sum.asm", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := []byte{
+		0x00, 0x81, 0xa0, 0x0a, 0x81, 0xa2, 0x01, 0x81, 0xa4, 0xe0,
+		0x80, 0xa1, 0x22, 0x81, 0xa0, 0x82, 0xa1, 0x44, 0x81, 0xa2,
+		0xc1, 0x80, 0xa1, 0x11,
+	}
+	image := prog.Image()
+	if !bytes.Equal(code, image) {
+		t.Fatalf("Want: %#v Got %#v", code, image)
+	}
+	if sym := prog.Symbols["loop"]; sym.Kind != SymLabel || sym.Number != 0 || sym.Value != 10 {
+		t.Fatalf("Want: label 0 at x000a Got: %s %d at x%04x", sym.Kind, sym.Number, sym.Value)
+	}
+	cpu := cpusimple.CPU{}
+	cpu.InitMemory(100)
+	cpu.InitStack(100 - 1)
+	res := cpu.Run(image, uint16(len(image)))
+	if res != 55 {
+		t.Fatalf("Want: %d Got: %d", 55, res)
+	}
+}
+
+func TestAssembleExtendedAndDirectives(t *testing.T) {
+	fmt.Println("TestAssembleExtendedAndDirectives")
+	src := `
+        .equ RESULT, 0x80
+        .equ STACKTOP, end + 2   ; forward reference
+start:  call sub
+        halt
+        .org 0x10
+sub:    xset 'c'
+        store RESULT
+        load value
+        noop
+        cmp
+        swap r1, r5
+        ret
+value:  .word 5, -1
+text:   .string "Hi\n"
+        .byte $7f, 0b101, "ok", -1
+end:
+`
+	prog, err := Assemble("ext.asm", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prog.Segments) != 2 || prog.Segments[0].Addr != 0 || prog.Segments[1].Addr != 0x10 {
+		t.Fatalf("Want: segments at x0000 and x0010 Got: %v", prog.Segments)
+	}
+	want := []byte{
+		0x18, 0x00, 0x63, // XSET 'c'
+		0x12, 0x00, 0x80, // STORE RESULT
+		0x13, 0x00, 0x1e, // LOAD value
+		0x10, 0x17, // NOOP, CMP
+		0x14, 0x15, // SWAP R1, R5
+		0x16,                   // RET
+		0x00, 0x05, 0xff, 0xff, // .word
+		'H', 'i', '\n', // .string
+		0x7f, 0x05, 'o', 'k', 0xff, // .byte
+	}
+	if !bytes.Equal(want, prog.Segments[1].Data) {
+		t.Fatalf("Want: %#v Got %#v", want, prog.Segments[1].Data)
+	}
+	if !bytes.Equal([]byte{0x15, 0x00, 0x10, 0x11}, prog.Segments[0].Data) {
+		t.Fatalf("Want: CALL x0010, HALT Got %#v", prog.Segments[0].Data)
+	}
+	if prog.Symbols["STACKTOP"].Value != 0x2c {
+		t.Fatalf("Want: x002c Got: x%04x", prog.Symbols["STACKTOP"].Value)
+	}
+	if image := prog.Image(); len(image) != 0x2a || image[4] != 0 {
+		t.Fatalf("Want: 42 byte image with zero gap Got: %d bytes", len(image))
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	fmt.Println("TestAssembleErrors")
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"  jump 5", "bad.asm:1:3: unknown instruction \"jump\""},
+		{"\n  add r9", "bad.asm:2:7: register R9 not allowed for add, use R1-R8"},
+		{"  set 16", "bad.asm:1:7: value 16 out of range 0 to 15"},
+		{"  call nowhere", "bad.asm:1:8: undefined symbol \"nowhere\""},
+		{"x: halt\nx: halt", "bad.asm:2:1: x redefined, previous definition at bad.asm:1"},
+		{"  goto x, nz\nx: halt", "bad.asm:1:8: x is not defined by a LABEL instruction"},
+		{"  goto 0, ne", "bad.asm:1:11: goto condition must be z or nz, not \"ne\""},
+		{"  .byte 300", "bad.asm:1:9: value 300 out of range -128 to 255"},
+		{"  .org 4\n  halt\n  .org 4\n  ret", "bad.asm:4:3: code overlaps previously assembled bytes at x0004"},
+		{"  .string \"abc", "bad.asm:1:11: unterminated string"},
+		{"  swap r1", "bad.asm:1:3: swap expects 2 operand(s), got 1"},
+	}
+	for _, test := range tests {
+		_, err := Assemble("bad.asm", []byte(test.src))
+		var list ErrorList
+		if !errors.As(err, &list) || len(list) == 0 {
+			t.Fatalf("Want: %s Got: %v", test.want, err)
+		}
+		if list[0].Error() != test.want {
+			t.Fatalf("Want: %s Got: %s", test.want, list[0].Error())
+		}
+	}
+}
+
+func TestRoundTripWithDisassembler(t *testing.T) {
+	fmt.Println("TestRoundTripWithDisassembler")
+	code := []byte{
+		0x15, 0x00, 0x10, 0x11, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0x05, 0x81, 0x06, 0xa0, 0x20, 0x18, 0x00, 0x63, 0x12, 0x00, 0x80,
+		0x13, 0x00, 0x40, 0x10, 0x17, 0x14, 0x15, 0xa6, 0xe0, 0xc1, 0xc0, 0x16, 0x1f,
+	}
+	var src []string
+	for _, ins := range disasm.Disassemble(code, 0, uint16(len(code))) {
+		src = append(src, "  "+ins.Text())
+	}
+	prog, err := Assemble("roundtrip.asm", []byte(strings.Join(src, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(code, prog.Image()) {
+		t.Fatalf("Want: %#v Got %#v", code, prog.Image())
+	}
+}
+
+func TestListingAndSymbolMap(t *testing.T) {
+	fmt.Println("TestListingAndSymbolMap")
+	src := `; demo
+        .equ RESULT, 0x80
+start:  call sub
+        halt
+        .org 0x10
+sub:    label again
+        store RESULT
+        goto again, z
+        ret
+msg:    .string "Hello"
+`
+	prog, err := Assemble("demo.asm", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listing strings.Builder
+	if err := prog.WriteListing(&listing); err != nil {
+		t.Fatal(err)
+	}
+	want := `ADDR  CODE         LINE  SOURCE
+                      1  ; demo
+                      2          .equ RESULT, 0x80
+0000  15 00 10        3  start:  call sub
+0003  11              4          halt
+                      5          .org 0x10
+0010  e0              6  sub:    label again
+0011  12 00 80        7          store RESULT
+0014  c0              8          goto again, z
+0015  16              9          ret
+0016  48 65 6c 6c    10  msg:    .string "Hello"
+001a  6f
+
+Symbols:
+0000  address   start
+0010  address   sub
+0011  label     again (label 0)
+0016  address   msg
+0080  constant  RESULT
+`
+	if listing.String() != want {
+		t.Fatalf("Want:\n%s\nGot:\n%s", want, listing.String())
+	}
+
+	// Annotations go in front of every line, sized by the code on it
+	listing.Reset()
+	err = prog.WriteAnnotatedListing(&listing, func(addr uint16, size int) string {
+		return fmt.Sprintf("%04x/%d ", addr, size)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"       ADDR  CODE", "0000/3 0000  15 00 10        3  start:", "0016/4 0016  48 65", "001a/1 001a  6f"} {
+		if !strings.Contains(listing.String(), "\n"+line) && !strings.HasPrefix(listing.String(), line) {
+			t.Fatalf("Want: line %q Got:\n%s", line, listing.String())
+		}
+	}
+
+	// The disassembler uses the symbol map to name addresses and labels
+	var symbolMap strings.Builder
+	if err := prog.WriteSymbolMap(&symbolMap); err != nil {
+		t.Fatal(err)
+	}
+	m, err := symbols.Read(strings.NewReader(symbolMap.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := prog.Image()[:0x16]
+	text := disasm.SymbolListing(code, 0x10, uint16(len(code)), m)
+	if !strings.Contains(text, "sub:\n0010:  e0         label again\n") || !strings.Contains(text, "goto again, z") {
+		t.Fatalf("Want: symbolic listing Got:\n%s", text)
+	}
+	list := append(disasm.Disassemble(code, 0, 3), disasm.Disassemble(code, 0x11, 0x14)...)
+	disasm.Annotate(list, m)
+	if list[0].Text() != "call sub" || list[1].Text() != "store 0x0080" {
+		t.Fatalf("Want: call sub, store 0x0080 Got: %s, %s", list[0].Text(), list[1].Text())
+	}
+}
+
+func TestMacrosAndInclude(t *testing.T) {
+	fmt.Println("TestMacrosAndInclude")
+	prog, err := AssembleFile("../programs/sum.asm", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := []byte{
+		0x00, 0x81, 0xa0, 0x0a, 0x81, 0xa2, 0x01, 0x81, 0xa4, 0xe0,
+		0x80, 0xa1, 0x22, 0x81, 0xa0, 0x82, 0xa1, 0x44, 0x81, 0xa2,
+		0xc1, 0x80, 0xa1, 0x11,
+	}
+	if !bytes.Equal(code, prog.Image()) {
+		t.Fatalf("Want: %#v Got %#v", code, prog.Image())
+	}
+
+	// \@ makes labels local to each expansion, and arguments may hold commas
+	// inside quotes
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "data.inc"), []byte(".macro text s\ntext\\@: .string \\s\n.endm\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src := `.include "data.inc"
+        text "a,b"
+        text "c"
+`
+	prog, err = AssembleWithOptions(filepath.Join(dir, "main.asm"), []byte(src), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte("a,bc"), prog.Image()) || prog.Symbols["text1"].Value != 0 || prog.Symbols["text2"].Value != 3 {
+		t.Fatalf("Want: a,bc with text1 and text2 Got %q", prog.Image())
+	}
+
+	// IncludeRoot keeps .include inside a directory
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{IncludeRoot: sub}
+	for _, name := range []string{"../data.inc", filepath.Join(dir, "data.inc")} {
+		_, err = AssembleWithOptions(filepath.Join(sub, "main.asm"), []byte(".include \""+name+"\"\n"), opts)
+		want := fmt.Sprintf("include file %q is outside %s", name, sub)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("Want: %s Got: %v", want, err)
+		}
+	}
+	if _, err := AssembleWithOptions(filepath.Join(dir, "main.asm"), []byte(src), Options{IncludeRoot: dir}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConditionalAssembly(t *testing.T) {
+	fmt.Println("TestConditionalAssembly")
+	src := `
+        .equ LEVEL, 2
+        .if LEVEL - 2
+        set 1
+        .else
+        set 2
+        .endif
+        .ifdef DEBUG
+        set 3
+        .ifndef LEVEL
+        set 4
+        .endif
+        .else
+        set 5
+        .endif
+        .ifndef missing
+        halt
+        .endif
+`
+	prog, err := Assemble("cond.asm", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte{0x02, 0x05, 0x11}, prog.Image()) {
+		t.Fatalf("Want: set 2, set 5, halt Got %#v", prog.Image())
+	}
+	prog, err = AssembleWithOptions("cond.asm", []byte(src), Options{Defines: map[string]int{"DEBUG": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte{0x02, 0x03, 0x11}, prog.Image()) {
+		t.Fatalf("Want: set 2, set 3, halt Got %#v", prog.Image())
+	}
+}
+
+func TestPreprocessorErrors(t *testing.T) {
+	fmt.Println("TestPreprocessorErrors")
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{".include \"nothere.asm\"", "bad.asm:1:10: cannot find include file \"nothere.asm\""},
+		{".macro m a\n  push \\a\n.endm\n  m", "bad.asm:4:1: macro m expects 1 argument(s), got 0"},
+		{".macro m a\n  push \\a\n.endm\n  m r9", "bad.asm:2:8: register R9 not allowed for push, use R0-R8 (in macro m called at bad.asm:4)"},
+		{".macro m\n  halt", "bad.asm:1:1: .macro m has no .endm"},
+		{".if 1\n  halt", "bad.asm:1:1: .if has no .endif"},
+		{"  .endif", "bad.asm:1:3: .endif without .if"},
+		{".macro m\n  m\n.endm\n  m", "bad.asm:2:1: macro m expanded more than 32 deep (in macro m called at bad.asm:2)"},
+	}
+	for _, test := range tests {
+		_, err := Assemble("bad.asm", []byte(test.src))
+		var list ErrorList
+		if !errors.As(err, &list) || len(list) == 0 {
+			t.Fatalf("Want: %s Got: %v", test.want, err)
+		}
+		if !strings.HasPrefix(list[0].Error(), test.want) {
+			t.Fatalf("Want: %s Got: %s", test.want, list[0].Error())
+		}
+	}
+}
+
+func TestLinkObjects(t *testing.T) {
+	fmt.Println("TestLinkObjects")
+	lib := `
+        .export times
+; times returns R1 * R2 in R0 using repeated addition
+times:  set 0
+        push r0
+        pop r3          ; R3 = total
+        set 1
+        push r0
+        pop r4          ; R4 = decrement
+        label loop
+        push r3
+        pop r0
+        add r1
+        push r0
+        pop r3
+        push r2
+        pop r0
+        sub r4
+        push r0
+        pop r2
+        goto loop, nz
+        push r3
+        pop r0
+        ret
+`
+	main := `
+        .import times
+        set 6
+        push r0
+        pop r1
+        set 7
+        push r0
+        pop r2
+        call times
+        store result
+        goto done, z    ; Label 0 in both modules, renumbered by the linker
+        label done
+        halt
+result: .word 0
+`
+	var objs []*Object
+	for _, m := range []struct{ name, src string }{{"main", main}, {"lib", lib}} {
+		prog, err := AssembleWithOptions(m.name+".asm", []byte(m.src), Options{Relocatable: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Objects survive a round trip through their text form
+		var buf bytes.Buffer
+		if err := prog.Object(m.name).Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		obj, err := ReadObject(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var again bytes.Buffer
+		obj.Write(&again)
+		if again.String() != buf.String() {
+			t.Fatalf("Want:\n%s\nGot:\n%s", buf.String(), again.String())
+		}
+		objs = append(objs, obj)
+	}
+
+	prog, err := Link(objs, []int{-1, 0x40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	times, result := prog.Symbols["times"], prog.Symbols["main.result"]
+	if times == nil || times.Value != 0x40 || result == nil {
+		t.Fatalf("Want: times at x0040 and main.result Got: %v %v", times, result)
+	}
+	if loop := prog.Symbols["lib.loop"]; loop == nil || loop.Number != 1 || loop.Value != 0x47 {
+		t.Fatalf("Want: lib.loop renumbered to label 1 at x0047 Got: %v", loop)
+	}
+	image := prog.Image()
+	cpu := cpusimple.CPU{}
+	cpu.InitMemory(0x100)
+	cpu.InitStack(0x100 - 1)
+	cpu.Reset()
+	cpu.Load(image, len(image))
+	cpu.Preprocess(cpu.Memory, uint16(len(image)))
+	cpu.RunFlag = true
+	for cpu.RunFlag && cpu.PC < uint16(len(image)) {
+		cpu.FetchInstruction(cpu.Memory)
+	}
+	if res := cpu.Registers[0]; res != 42 {
+		t.Fatalf("Want: %d Got: %d", 42, res)
+	}
+	if got := uint16(cpu.Memory[result.Value])<<8 | uint16(cpu.Memory[result.Value+1]); got != 42 {
+		t.Fatalf("Want: result 42 Got: %d", got)
+	}
+
+	// Modules that overlap, clash or leave imports unresolved do not link
+	_, err = Link([]*Object{objs[0], objs[1], objs[1]}, []int{0, 0x10})
+	var linkErr LinkError
+	if !errors.As(err, &linkErr) {
+		t.Fatalf("Want: LinkError Got: %v", err)
+	}
+	want := "lib: overlaps main at x0010\nlib: times already exported by lib"
+	if err.Error() != want {
+		t.Fatalf("Want:\n%s\nGot:\n%s", want, err)
+	}
+	if _, err := Link(objs[:1], nil); err == nil || err.Error() != "main: undefined symbol times" {
+		t.Fatalf("Want: undefined symbol times Got: %v", err)
+	}
+}
+
+func TestMixedLabels(t *testing.T) {
+	fmt.Println("TestMixedLabels")
+	// A numbered label has no symbol, a named one does
+	src := `
+        set 1
+        push r0
+        pop r1
+        set 2
+        label 3
+        sub r1
+        goto 3, nz
+        set 3
+        label again
+        sub r1
+        goto again, nz
+        halt
+`
+	prog, err := Assemble("mixed.asm", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := cpusimple.CPU{}
+	if err := prog.ProgramFile().Configure(&cpu); err != nil {
+		t.Fatal(err)
+	}
+	again := prog.Symbols["again"]
+	if cpu.Labels[3] != 5 || cpu.Labels[again.Number] != 9 {
+		t.Fatalf("Want: label 3 at x0005, again at x0009 Got: x%04x x%04x", cpu.Labels[3], cpu.Labels[again.Number])
+	}
+	for steps := 0; !cpu.Halted && steps < 100; steps++ {
+		cpu.FetchInstruction(cpu.Memory)
+	}
+	if !cpu.Halted {
+		t.Fatalf("Want: halted Got: PC x%04x", cpu.PC)
+	}
+}
@@ -0,0 +1,690 @@
+package asm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"chrisriddick.net/cpusimple"
+)
+
+// maxLabels is the number of LABEL numbers the base instruction set can
+// encode. LLLL values of 8 and above set bit 4, which the CPU decodes as
+// an extended instruction.
+const maxLabels = 8
+
+// Size in bytes of every instruction the assembler knows
+var instructionSizes = map[string]int{
+	"set": 1, "add": 1, "sub": 1, "mul": 1, "push": 1, "pop": 1, "goto": 1, "label": 1,
+	"noop": 1, "halt": 1, "ret": 1, "cmp": 1, "swap": 2,
+	"store": 3, "load": 3, "call": 3, "xset": 3,
+}
+
+// sourceLine is one line of source text together with where it came from
+type sourceLine struct {
+	file      string
+	num       int
+	text      string
+	expansion string // Macro call this line was expanded from, if any
+	listOnly  bool   // Line was consumed by the preprocessor and is only listed
+}
+
+// statement is a parsed source line
+type statement struct {
+	line  sourceLine
+	label *token    // "name:" defined on this line
+	op    *token    // Instruction mnemonic or directive
+	name  string    // Lower case op
+	args  [][]token // Operands, split on commas
+	addr  uint16
+	size  int
+	data  []byte // Assembled bytes, filled in by pass2
+}
+
+type assembler struct {
+	opts     Options
+	lines    []sourceLine
+	stmts    []*statement
+	lineStmt map[int]*statement // Statement parsed from each line, by index in lines
+	symbols  map[string]*Symbol
+	errs     ErrorList
+	used     []bool // Addresses already holding assembled bytes
+	segments []Segment
+	relocs   []Relocation
+	labelRef []uint16 // Addresses of LABEL and GOTO instructions
+}
+
+func newAssembler(opts Options) *assembler {
+	return &assembler{
+		opts:     opts,
+		symbols:  make(map[string]*Symbol),
+		lineStmt: make(map[int]*statement),
+		used:     make([]bool, 0x10000),
+	}
+}
+
+// newError returns an error at the given line and column, naming the macro
+// call the line was expanded from
+func newError(line sourceLine, col int, format string, args ...interface{}) *Error {
+	msg := fmt.Sprintf(format, args...)
+	if line.expansion != "" {
+		msg = msg + " (" + line.expansion + ")"
+	}
+	return &Error{File: line.file, Line: line.num, Column: col, Msg: msg}
+}
+
+func (a *assembler) errorf(line sourceLine, col int, format string, args ...interface{}) {
+	a.errs = append(a.errs, newError(line, col, format, args...))
+}
+
+func (a *assembler) assemble() (*Program, error) {
+	a.parse()
+	if len(a.errs) == 0 {
+		a.pass1()
+	}
+	if len(a.errs) == 0 {
+		a.pass2()
+	}
+	if len(a.errs) > 0 {
+		return nil, a.errs
+	}
+	sort.Slice(a.segments, func(i, j int) bool { return a.segments[i].Addr < a.segments[j].Addr })
+	return &Program{
+		Segments:    a.segments,
+		Symbols:     a.symbols,
+		Relocations: a.relocs,
+		LabelRefs:   a.labelRef,
+		listing:     a.listing(),
+	}, nil
+}
+
+// parse turns every source line into a statement
+func (a *assembler) parse() {
+	for i, line := range a.lines {
+		if line.listOnly {
+			continue
+		}
+		toks, err := tokenize(line.text)
+		if err != nil {
+			a.errorf(line, err.Column, "%s", err.Msg)
+			continue
+		}
+		st := &statement{line: line}
+		if len(toks) >= 2 && toks[0].kind == tokIdent && toks[1].kind == tokColon {
+			st.label = &toks[0]
+			toks = toks[2:]
+		}
+		if len(toks) > 0 {
+			if toks[0].kind != tokIdent {
+				a.errorf(line, toks[0].col, "expected instruction or directive")
+				continue
+			}
+			st.op = &toks[0]
+			st.name = strings.ToLower(toks[0].text)
+			st.args = splitArgs(toks[1:])
+		}
+		if st.label != nil || st.op != nil {
+			a.stmts = append(a.stmts, st)
+			a.lineStmt[i] = st
+		}
+	}
+}
+
+// splitArgs splits operand tokens on commas
+func splitArgs(toks []token) [][]token {
+	if len(toks) == 0 {
+		return nil
+	}
+	args := [][]token{{}}
+	for _, tok := range toks {
+		if tok.kind == tokComma {
+			args = append(args, []token{})
+			continue
+		}
+		args[len(args)-1] = append(args[len(args)-1], tok)
+	}
+	return args
+}
+
+// pass1 assigns an address to every statement and defines all symbols
+func (a *assembler) pass1() {
+	pc := 0
+	var equs, labels, exports []*statement
+	for _, st := range a.stmts {
+		if st.label != nil {
+			a.define(st, st.label, SymAddress, uint16(pc))
+		}
+		st.addr = uint16(pc)
+		switch st.name {
+		case "":
+		case ".org":
+			if !a.expectArgs(st, 1) {
+				continue
+			}
+			o, err := a.eval(st, st.args[0])
+			if err != nil {
+				a.errorf(st.line, st.op.col, ".org address must be defined before use: %s", err.Msg)
+				continue
+			}
+			v := o.value
+			if v < 0 || v > 0xffff {
+				a.errorf(st.line, st.args[0][0].col, ".org address %d out of range", v)
+				continue
+			}
+			pc = v
+			st.addr = uint16(pc)
+			if st.label != nil && a.symbols[st.label.text].Line == st.line.num {
+				a.symbols[st.label.text].Value = st.addr // "name: .org addr" names the new address
+			}
+		case ".equ":
+			if len(st.args) != 2 || len(st.args[0]) != 1 || st.args[0][0].kind != tokIdent {
+				a.errorf(st.line, st.op.col, ".equ expects a name and a value")
+				continue
+			}
+			equs = append(equs, st)
+		case ".export", ".global":
+			if a.expectNames(st) {
+				exports = append(exports, st)
+			}
+		case ".import":
+			if !a.expectNames(st) {
+				continue
+			}
+			if !a.opts.Relocatable {
+				a.errorf(st.line, st.op.col, ".import is only allowed when assembling an object file")
+				continue
+			}
+			for _, arg := range st.args {
+				a.define(st, &arg[0], SymImport, 0)
+			}
+		case ".byte":
+			if !a.expectSomeArgs(st) {
+				continue
+			}
+			for _, arg := range st.args {
+				if len(arg) == 1 && arg[0].kind == tokString {
+					st.size += len(arg[0].text)
+				} else {
+					st.size++
+				}
+			}
+		case ".word":
+			if a.expectSomeArgs(st) {
+				st.size = 2 * len(st.args)
+			}
+		case ".string":
+			if !a.expectSomeArgs(st) {
+				continue
+			}
+			for _, arg := range st.args {
+				if len(arg) != 1 || arg[0].kind != tokString {
+					a.errorf(st.line, argCol(st, arg), ".string expects string literals")
+					continue
+				}
+				st.size += len(arg[0].text)
+			}
+		default:
+			size, ok := instructionSizes[st.name]
+			if !ok {
+				a.errorf(st.line, st.op.col, "unknown instruction %q", st.op.text)
+				continue
+			}
+			st.size = size
+			if st.name == "label" {
+				labels = append(labels, st)
+			}
+		}
+		pc += st.size
+		if pc > 0x10000 {
+			a.errorf(st.line, st.op.col, "program runs past the end of the address space")
+			return
+		}
+	}
+	a.defineEquates(equs)
+	a.numberLabels(labels)
+	for _, st := range exports {
+		for _, arg := range st.args {
+			sym, ok := a.symbols[arg[0].text]
+			switch {
+			case !ok:
+				a.errorf(st.line, arg[0].col, "cannot export undefined symbol %q", arg[0].text)
+			case sym.Kind == SymImport:
+				a.errorf(st.line, arg[0].col, "cannot export imported symbol %q", arg[0].text)
+			default:
+				sym.Exported = true
+			}
+		}
+	}
+}
+
+// expectNames checks that every operand is a single name
+func (a *assembler) expectNames(st *statement) bool {
+	if !a.expectSomeArgs(st) {
+		return false
+	}
+	for _, arg := range st.args {
+		if len(arg) != 1 || arg[0].kind != tokIdent {
+			a.errorf(st.line, argCol(st, arg), "%s expects symbol names", st.op.text)
+			return false
+		}
+	}
+	return true
+}
+
+// define adds a symbol, reporting duplicates
+func (a *assembler) define(st *statement, name *token, kind SymbolKind, value uint16) *Symbol {
+	if prev, ok := a.symbols[name.text]; ok {
+		a.errorf(st.line, name.col, "%s redefined, previous definition at %s:%d", name.text, prev.File, prev.Line)
+		return nil
+	}
+	sym := &Symbol{Name: name.text, Kind: kind, Value: value, File: st.line.file, Line: st.line.num}
+	a.symbols[name.text] = sym
+	return sym
+}
+
+// defineEquates evaluates .equ statements, allowing them to refer to symbols
+// defined further down in the source
+func (a *assembler) defineEquates(equs []*statement) {
+	for len(equs) > 0 {
+		var pending []*statement
+		for _, st := range equs {
+			if o, err := a.eval(st, st.args[1]); err == nil {
+				// An address plus a constant is still an address, so it
+				// moves with the program when linked
+				kind := SymConstant
+				if o.reloc == 1 && o.extern == "" {
+					kind = SymAddress
+				} else if o.reloc != 0 || o.extern != "" {
+					a.errorf(st.line, st.args[1][0].col, ".equ value must be a constant or an address")
+				}
+				a.define(st, &st.args[0][0], kind, uint16(o.value))
+			} else {
+				pending = append(pending, st)
+			}
+		}
+		if len(pending) == len(equs) {
+			for _, st := range pending {
+				_, err := a.eval(st, st.args[1])
+				a.errs = append(a.errs, err)
+			}
+			return
+		}
+		equs = pending
+	}
+}
+
+// numberLabels gives every LABEL statement its label number. Explicit
+// numbers are reserved first, named labels get the lowest free number.
+func (a *assembler) numberLabels(labels []*statement) {
+	var taken [maxLabels]bool
+	for _, st := range labels {
+		if len(st.args) != 1 || len(st.args[0]) != 1 {
+			a.errorf(st.line, st.op.col, "label expects a name or a number")
+			continue
+		}
+		tok := st.args[0][0]
+		if tok.kind != tokNumber {
+			continue
+		}
+		if tok.value < 0 || tok.value >= maxLabels {
+			a.errorf(st.line, tok.col, "label number %d out of range 0-%d", tok.value, maxLabels-1)
+			continue
+		}
+		if taken[tok.value] {
+			a.errorf(st.line, tok.col, "label number %d already used", tok.value)
+			continue
+		}
+		taken[tok.value] = true
+	}
+	next := 0
+	for _, st := range labels {
+		if len(st.args) != 1 || len(st.args[0]) != 1 || st.args[0][0].kind != tokIdent {
+			continue
+		}
+		for next < maxLabels && taken[next] {
+			next++
+		}
+		if next == maxLabels {
+			a.errorf(st.line, st.args[0][0].col, "too many labels, at most %d are available", maxLabels)
+			return
+		}
+		taken[next] = true
+		if sym := a.define(st, &st.args[0][0], SymLabel, st.addr+1); sym != nil {
+			sym.Number = next
+		}
+	}
+}
+
+// pass2 encodes every statement at the address given to it by pass1
+func (a *assembler) pass2() {
+	for _, st := range a.stmts {
+		var b []byte
+		switch st.name {
+		case "", ".org", ".equ":
+			continue
+		case ".byte":
+			for _, arg := range st.args {
+				if len(arg) == 1 && arg[0].kind == tokString {
+					b = append(b, arg[0].text...)
+					continue
+				}
+				if v, ok := a.value(st, arg, -128, 255); ok {
+					b = append(b, byte(v))
+				}
+			}
+		case ".word":
+			for i, arg := range st.args {
+				if v, ok := a.word(st, arg, uint16(2*i)); ok {
+					b = append(b, byte(v>>8), byte(v))
+				}
+			}
+		case ".string":
+			for _, arg := range st.args {
+				b = append(b, arg[0].text...)
+			}
+		default:
+			b = a.encode(st)
+		}
+		if len(b) == st.size {
+			st.data = b
+			a.emit(st, b)
+		}
+	}
+}
+
+// emit places assembled bytes at the statement address
+func (a *assembler) emit(st *statement, b []byte) {
+	for i := range b {
+		addr := int(st.addr) + i
+		if a.used[addr] {
+			a.errorf(st.line, st.op.col, "code overlaps previously assembled bytes at x%04x", addr)
+			return
+		}
+		a.used[addr] = true
+	}
+	n := len(a.segments)
+	if n > 0 && int(a.segments[n-1].Addr)+len(a.segments[n-1].Data) == int(st.addr) {
+		a.segments[n-1].Data = append(a.segments[n-1].Data, b...)
+		return
+	}
+	a.segments = append(a.segments, Segment{Addr: st.addr, Data: append([]byte{}, b...)})
+}
+
+// encode translates one instruction into machine code. On error it returns
+// nil after recording the problem.
+func (a *assembler) encode(st *statement) []byte {
+	switch st.name {
+	case "noop", "halt", "ret", "cmp":
+		if !a.expectArgs(st, 0) {
+			return nil
+		}
+		return []byte{map[string]byte{"noop": cpusimple.NOOP, "halt": cpusimple.HALT, "ret": cpusimple.RET, "cmp": cpusimple.CMP}[st.name]}
+	case "set":
+		if !a.expectArgs(st, 1) {
+			return nil
+		}
+		if v, ok := a.value(st, st.args[0], 0, 15); ok {
+			return []byte{cpusimple.MaskSet | byte(v)}
+		}
+	case "add", "sub", "mul":
+		if !a.expectArgs(st, 1) {
+			return nil
+		}
+		mask := map[string]byte{"add": cpusimple.MaskAdd, "sub": cpusimple.MaskSub, "mul": cpusimple.MaskMul}[st.name]
+		if r, ok := a.register(st, st.args[0], 1, 8); ok {
+			return []byte{mask | byte(r-1)<<1}
+		}
+	case "push", "pop":
+		if !a.expectArgs(st, 1) {
+			return nil
+		}
+		mask := byte(cpusimple.MaskPush)
+		if st.name == "pop" {
+			mask = cpusimple.MaskPop
+		}
+		if r, ok := a.register(st, st.args[0], 0, 8); ok {
+			if r == 0 {
+				return []byte{mask | 0x01}
+			}
+			return []byte{mask | byte(r-1)<<1}
+		}
+	case "label":
+		if n, ok := a.labelNumber(st, st.args[0]); ok {
+			a.labelRef = append(a.labelRef, st.addr)
+			return []byte{cpusimple.MaskLabel | byte(n)<<1}
+		}
+	case "goto":
+		if !a.expectArgs(st, 2) {
+			return nil
+		}
+		n, ok := a.labelNumber(st, st.args[0])
+		if !ok {
+			return nil
+		}
+		a.labelRef = append(a.labelRef, st.addr)
+		arg := st.args[1]
+		if len(arg) != 1 || arg[0].kind != tokIdent {
+			a.errorf(st.line, argCol(st, arg), "goto condition must be z or nz")
+			return nil
+		}
+		switch strings.ToLower(arg[0].text) {
+		case "nz":
+			return []byte{cpusimple.MaskGoto | byte(n)<<1 | 0x01}
+		case "z":
+			return []byte{cpusimple.MaskGoto | byte(n)<<1}
+		}
+		a.errorf(st.line, arg[0].col, "goto condition must be z or nz, not %q", arg[0].text)
+	case "swap":
+		if !a.expectArgs(st, 2) {
+			return nil
+		}
+		rx, okx := a.register(st, st.args[0], 0, 15)
+		ry, oky := a.register(st, st.args[1], 0, 15)
+		if okx && oky {
+			return []byte{cpusimple.SWAP, byte(rx<<4 | ry)}
+		}
+	case "store", "load", "call", "xset":
+		if !a.expectArgs(st, 1) {
+			return nil
+		}
+		op := map[string]byte{"store": cpusimple.STORE, "load": cpusimple.LOAD, "call": cpusimple.CALL, "xset": cpusimple.XSET}[st.name]
+		if v, ok := a.word(st, st.args[0], 1); ok {
+			return []byte{op, byte(v >> 8), byte(v)}
+		}
+	}
+	return nil
+}
+
+func (a *assembler) expectArgs(st *statement, n int) bool {
+	if len(st.args) != n {
+		a.errorf(st.line, st.op.col, "%s expects %d operand(s), got %d", st.op.text, n, len(st.args))
+		return false
+	}
+	for _, arg := range st.args {
+		if len(arg) == 0 {
+			a.errorf(st.line, st.op.col, "%s has an empty operand", st.op.text)
+			return false
+		}
+	}
+	return true
+}
+
+func (a *assembler) expectSomeArgs(st *statement) bool {
+	if len(st.args) == 0 {
+		a.errorf(st.line, st.op.col, "%s expects at least one operand", st.op.text)
+		return false
+	}
+	return a.expectArgs(st, len(st.args))
+}
+
+// argCol returns the column of an operand, or of the op when it is empty
+func argCol(st *statement, arg []token) int {
+	if len(arg) > 0 {
+		return arg[0].col
+	}
+	return st.op.col
+}
+
+// register parses a register operand such as r5 and checks its range
+func (a *assembler) register(st *statement, arg []token, min, max int) (int, bool) {
+	if len(arg) != 1 || arg[0].kind != tokIdent || len(arg[0].text) < 2 || (arg[0].text[0] != 'r' && arg[0].text[0] != 'R') {
+		a.errorf(st.line, argCol(st, arg), "expected a register")
+		return 0, false
+	}
+	r, err := strconv.Atoi(arg[0].text[1:])
+	if err != nil {
+		a.errorf(st.line, arg[0].col, "expected a register, not %q", arg[0].text)
+		return 0, false
+	}
+	if r < min || r > max {
+		a.errorf(st.line, arg[0].col, "register R%d not allowed for %s, use R%d-R%d", r, st.name, min, max)
+		return 0, false
+	}
+	return r, true
+}
+
+// labelNumber resolves the operand of LABEL and GOTO to a label number
+func (a *assembler) labelNumber(st *statement, arg []token) (int, bool) {
+	if len(arg) == 1 && arg[0].kind == tokNumber {
+		if arg[0].value < 0 || arg[0].value >= maxLabels {
+			a.errorf(st.line, arg[0].col, "label number %d out of range 0-%d", arg[0].value, maxLabels-1)
+			return 0, false
+		}
+		return arg[0].value, true
+	}
+	if len(arg) != 1 || arg[0].kind != tokIdent {
+		a.errorf(st.line, argCol(st, arg), "expected a label name or number")
+		return 0, false
+	}
+	sym, ok := a.symbols[arg[0].text]
+	if !ok {
+		a.errorf(st.line, arg[0].col, "undefined label %q", arg[0].text)
+		return 0, false
+	}
+	if sym.Kind != SymLabel {
+		a.errorf(st.line, arg[0].col, "%s is not defined by a LABEL instruction", arg[0].text)
+		return 0, false
+	}
+	return sym.Number, true
+}
+
+// value evaluates a byte sized operand expression and checks it fits in [min, max]
+func (a *assembler) value(st *statement, arg []token, min, max int) (int, bool) {
+	o, err := a.eval(st, arg)
+	if err != nil {
+		a.errs = append(a.errs, err)
+		return 0, false
+	}
+	if o.extern != "" || (a.opts.Relocatable && o.reloc != 0) {
+		a.errorf(st.line, argCol(st, arg), "address cannot be relocated in a byte operand")
+		return 0, false
+	}
+	if o.value < min || o.value > max {
+		a.errorf(st.line, argCol(st, arg), "value %d out of range %d to %d", o.value, min, max)
+		return 0, false
+	}
+	return o.value, true
+}
+
+// word evaluates a 16-bit operand placed offset bytes into the statement and
+// records the relocation needed if the value is an address
+func (a *assembler) word(st *statement, arg []token, offset uint16) (int, bool) {
+	o, err := a.eval(st, arg)
+	if err != nil {
+		a.errs = append(a.errs, err)
+		return 0, false
+	}
+	if o.value < -32768 || o.value > 0xffff {
+		a.errorf(st.line, argCol(st, arg), "value %d out of range %d to %d", o.value, -32768, 0xffff)
+		return 0, false
+	}
+	switch {
+	case o.extern != "" && o.reloc == 0:
+		a.relocs = append(a.relocs, Relocation{Offset: st.addr + offset, Symbol: o.extern})
+	case o.extern == "" && o.reloc == 1:
+		a.relocs = append(a.relocs, Relocation{Offset: st.addr + offset})
+	case o.extern != "" || (a.opts.Relocatable && o.reloc != 0):
+		a.errorf(st.line, argCol(st, arg), "expression cannot be relocated")
+		return 0, false
+	}
+	return o.value, true
+}
+
+// operand is the value of an expression together with what it is relative to
+type operand struct {
+	value  int
+	reloc  int    // Net count of addresses added, 1 for an address that moves with the program
+	extern string // Imported symbol the value is an offset from
+}
+
+// eval computes an operand expression against the symbol table
+func (a *assembler) eval(st *statement, expr []token) (operand, *Error) {
+	return evalExpr(st.line, st.op.col, expr, func(name string) (operand, bool) {
+		sym, ok := a.symbols[name]
+		if !ok {
+			return operand{}, false
+		}
+		switch sym.Kind {
+		case SymAddress, SymLabel:
+			return operand{value: int(sym.Value), reloc: 1}, true
+		case SymImport:
+			return operand{extern: name}, true
+		}
+		return operand{value: int(sym.Value)}, true
+	})
+}
+
+// evalExpr computes an expression made of numbers and symbols joined by + and -.
+// Col is reported when the expression is empty.
+func evalExpr(line sourceLine, col int, expr []token, lookup func(string) (operand, bool)) (operand, *Error) {
+	var total operand
+	if len(expr) == 0 {
+		return total, newError(line, col, "missing operand")
+	}
+	sign := 1
+	expectTerm := true
+	for _, tok := range expr {
+		if expectTerm {
+			switch tok.kind {
+			case tokMinus:
+				sign = -sign
+				continue
+			case tokPlus:
+				continue
+			case tokNumber:
+				total.value += sign * tok.value
+			case tokIdent:
+				o, ok := lookup(tok.text)
+				if !ok {
+					return total, newError(line, tok.col, "undefined symbol %q", tok.text)
+				}
+				if o.extern != "" {
+					if sign < 0 || total.extern != "" {
+						return total, newError(line, tok.col, "imported symbol %s can only have a constant added", tok.text)
+					}
+					total.extern = o.extern
+				}
+				total.value += sign * o.value
+				total.reloc += sign * o.reloc
+			default:
+				return total, newError(line, tok.col, "expected a number or symbol")
+			}
+			expectTerm, sign = false, 1
+			continue
+		}
+		switch tok.kind {
+		case tokPlus:
+			sign = 1
+		case tokMinus:
+			sign = -1
+		default:
+			return total, newError(line, tok.col, "expected + or -")
+		}
+		expectTerm = true
+	}
+	if expectTerm {
+		return total, newError(line, expr[len(expr)-1].col, "incomplete expression")
+	}
+	return total, nil
+}
@@ -0,0 +1,102 @@
+// Command asm assembles a source file into a binary image that loads at
+// address 0, optionally writing a listing and a symbol map next to it.
+// With -c it writes a relocatable object file for the link command instead,
+// and an output name ending in .scp selects a program image holding the
+// symbol table and starting at the "start" symbol.
+//
+//	asm [-c] [-o prog.bin] [-l prog.lst] [-m prog.sym] [-I dir] [-D name=value] prog.asm
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"chrisriddick.net/asm"
+)
+
+func main() {
+	object := flag.Bool("c", false, "write a relocatable object file instead of an image")
+	out := flag.String("o", "", "output file (default: source name with .bin, or .obj with -c)")
+	listing := flag.String("l", "", "write a listing to this file")
+	symbolMap := flag.String("m", "", "write a symbol map to this file")
+	opts := asm.Options{Defines: make(map[string]int)}
+	flag.Func("I", "add a directory searched by .include (repeatable)", func(dir string) error {
+		opts.IncludeDirs = append(opts.IncludeDirs, dir)
+		return nil
+	})
+	flag.Func("D", "predefine a constant as name or name=value (repeatable)", func(def string) error {
+		name, value, found := strings.Cut(def, "=")
+		if !found {
+			opts.Defines[name] = 1
+			return nil
+		}
+		v, err := strconv.ParseInt(value, 0, 32)
+		if err != nil {
+			return err
+		}
+		opts.Defines[name] = int(v)
+		return nil
+	})
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: asm [-c] [-o file] [-l file] [-m file] [-I dir] [-D name=value] source.asm")
+		os.Exit(2)
+	}
+	source := flag.Arg(0)
+	base := strings.TrimSuffix(source, ".asm")
+	opts.Relocatable = *object
+	if *out == "" {
+		if *object {
+			*out = base + ".obj"
+		} else {
+			*out = base + ".bin"
+		}
+	}
+
+	prog, err := asm.AssembleFile(source, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *object {
+		err = writeFile(*out, prog.Object(filepath.Base(base)).Write)
+	} else if strings.HasSuffix(*out, ".scp") {
+		err = writeFile(*out, prog.ProgramFile().Write)
+	} else {
+		err = os.WriteFile(*out, prog.Image(), 0644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *listing != "" {
+		if err := writeFile(*listing, prog.WriteListing); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *symbolMap != "" {
+		if err := writeFile(*symbolMap, prog.WriteSymbolMap); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// writeFile creates path and fills it using write
+func writeFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
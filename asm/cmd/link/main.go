@@ -0,0 +1,84 @@
+// Command link combines object files written by "asm -c" into a binary image
+// that loads at address 0. Each object may be given an origin with @address,
+// otherwise it is placed right after the previous one. An output name ending
+// in .scp selects a program image rather than a raw binary.
+//
+//	link [-o prog.bin] [-m prog.sym] main.obj lib.obj@0x0100
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"chrisriddick.net/asm"
+)
+
+func main() {
+	out := flag.String("o", "a.bin", "output binary image")
+	symbolMap := flag.String("m", "", "write a symbol map to this file")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: link [-o file] [-m file] object[@origin]...")
+		os.Exit(2)
+	}
+
+	var objs []*asm.Object
+	var origins []int
+	for _, arg := range flag.Args() {
+		path, at, found := strings.Cut(arg, "@")
+		origin := -1
+		if found {
+			v, err := strconv.ParseUint(at, 0, 16)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: invalid origin %q\n", path, at)
+				os.Exit(2)
+			}
+			origin = int(v)
+		}
+		obj, err := asm.LoadObject(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+		objs = append(objs, obj)
+		origins = append(origins, origin)
+	}
+
+	prog, err := asm.Link(objs, origins)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if strings.HasSuffix(*out, ".scp") {
+		err = writeFile(*out, prog.ProgramFile().Write)
+	} else {
+		err = os.WriteFile(*out, prog.Image(), 0644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *symbolMap != "" {
+		if err := writeFile(*symbolMap, prog.WriteSymbolMap); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// writeFile creates path and fills it using write
+func writeFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
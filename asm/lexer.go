@@ -0,0 +1,136 @@
+package asm
+
+import (
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokNumber
+	tokString
+	tokComma
+	tokColon
+	tokPlus
+	tokMinus
+)
+
+// token is a lexical element of a single source line
+type token struct {
+	kind  tokenKind
+	text  string // Identifier name or unquoted string contents
+	value int    // Value of number and character literals
+	col   int    // 1-based column of the first character
+}
+
+func isIdentStart(ch byte) bool {
+	return ch == '_' || ch == '.' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isIdentChar(ch byte) bool {
+	return isIdentStart(ch) || (ch >= '0' && ch <= '9')
+}
+
+// tokenize splits one source line into tokens, stopping at a ';' comment
+func tokenize(s string) ([]token, *Error) {
+	var toks []token
+	i := 0
+	for i < len(s) {
+		ch := s[i]
+		col := i + 1
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			i++
+		case ch == ';':
+			return toks, nil
+		case ch == ',':
+			toks = append(toks, token{kind: tokComma, col: col})
+			i++
+		case ch == ':':
+			toks = append(toks, token{kind: tokColon, col: col})
+			i++
+		case ch == '+':
+			toks = append(toks, token{kind: tokPlus, col: col})
+			i++
+		case ch == '-':
+			toks = append(toks, token{kind: tokMinus, col: col})
+			i++
+		case isIdentStart(ch):
+			j := i + 1
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			toks = append(toks, token{kind: tokIdent, text: s[i:j], col: col})
+			i = j
+		case ch >= '0' && ch <= '9' || ch == '$':
+			j := i + 1
+			for j < len(s) && isIdentChar(s[j]) {
+				j++
+			}
+			v, err := parseNumber(s[i:j])
+			if err != nil {
+				return nil, &Error{Column: col, Msg: "invalid number " + strconv.Quote(s[i:j])}
+			}
+			toks = append(toks, token{kind: tokNumber, value: v, col: col})
+			i = j
+		case ch == '\'':
+			v, rest, err := unquoteChar(s[i+1:])
+			if err != nil {
+				return nil, &Error{Column: col, Msg: "invalid character literal"}
+			}
+			toks = append(toks, token{kind: tokNumber, value: v, col: col})
+			i = len(s) - len(rest)
+		case ch == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, &Error{Column: col, Msg: "unterminated string"}
+			}
+			text, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, &Error{Column: col, Msg: "invalid string literal"}
+			}
+			toks = append(toks, token{kind: tokString, text: text, col: col})
+			i = j + 1
+		default:
+			return nil, &Error{Column: col, Msg: "unexpected character " + strconv.QuoteRune(rune(ch))}
+		}
+	}
+	return toks, nil
+}
+
+// parseNumber accepts decimal, 0x/$ hexadecimal and 0b binary literals
+func parseNumber(s string) (int, error) {
+	base := 10
+	lower := strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(lower, "0x"):
+		base, lower = 16, lower[2:]
+	case strings.HasPrefix(lower, "$"):
+		base, lower = 16, lower[1:]
+	case strings.HasPrefix(lower, "0b"):
+		base, lower = 2, lower[2:]
+	}
+	v, err := strconv.ParseInt(lower, base, 32)
+	return int(v), err
+}
+
+// unquoteChar decodes the body of a character literal such as 'A' or '\n'
+// and returns the text following the closing quote
+func unquoteChar(s string) (int, string, error) {
+	v, _, tail, err := strconv.UnquoteChar(s, '\'')
+	if err != nil {
+		return 0, "", err
+	}
+	if len(tail) == 0 || tail[0] != '\'' {
+		return 0, "", strconv.ErrSyntax
+	}
+	return int(v), tail[1:], nil
+}
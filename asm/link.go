@@ -0,0 +1,144 @@
+package asm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Bits of a LABEL or GOTO instruction holding the label number
+const labelBits = 0x0e
+
+// LinkError lists every problem found while linking
+type LinkError []string
+
+func (e LinkError) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// Link combines objects into one program. Each object is placed at the
+// matching entry of origins; an origin below zero, or a missing entry, places
+// the object right after the previous one. Imports are resolved against the
+// symbols exported by all objects, and LABEL numbers are renumbered so that
+// each module keeps its own labels.
+func Link(objs []*Object, origins []int) (*Program, error) {
+	var errs LinkError
+	prog := &Program{Symbols: make(map[string]*Symbol)}
+	bases := make([]uint16, len(objs))
+
+	// Place the modules and check they fit without overlapping
+	next := 0
+	for i, obj := range objs {
+		origin := next
+		if i < len(origins) && origins[i] >= 0 {
+			origin = origins[i]
+		}
+		if origin+len(obj.Code) > 0x10000 {
+			errs = append(errs, fmt.Sprintf("%s: does not fit in memory at x%04x", obj.Name, origin))
+			continue
+		}
+		bases[i] = uint16(origin)
+		next = origin + len(obj.Code)
+		for j := 0; j < i; j++ {
+			start, end := int(bases[j]), int(bases[j])+len(objs[j].Code)
+			if len(obj.Code) > 0 && origin < end && start < next {
+				errs = append(errs, fmt.Sprintf("%s: overlaps %s at x%04x", obj.Name, objs[j].Name, max(origin, start)))
+			}
+		}
+	}
+
+	// Renumber labels so that modules do not share LABEL numbers
+	used := 0
+	renumber := make([]map[int]int, len(objs))
+	for i, obj := range objs {
+		renumber[i] = make(map[int]int)
+		var locals []int
+		for _, addr := range obj.LabelRefs {
+			n := int(obj.Code[addr]&labelBits) >> 1
+			if _, ok := renumber[i][n]; !ok {
+				renumber[i][n] = -1
+				locals = append(locals, n)
+			}
+		}
+		sort.Ints(locals)
+		for _, n := range locals {
+			if used >= maxLabels {
+				errs = append(errs, fmt.Sprintf("%s: more than %d labels in the linked program", obj.Name, maxLabels))
+				break
+			}
+			renumber[i][n] = used
+			used++
+		}
+	}
+
+	// Build the symbol table, exported names are global and the rest are
+	// prefixed with their module name
+	exports := make(map[string]*Symbol)
+	owner := make(map[string]string)
+	for i, obj := range objs {
+		for _, sym := range obj.Symbols {
+			s := *sym
+			s.File = obj.Name
+			switch s.Kind {
+			case SymAddress:
+				s.Value += bases[i]
+			case SymLabel:
+				s.Value += bases[i]
+				if n, ok := renumber[i][s.Number]; ok && n >= 0 {
+					s.Number = n
+				}
+			}
+			if s.Exported {
+				if other, ok := owner[s.Name]; ok {
+					errs = append(errs, fmt.Sprintf("%s: %s already exported by %s", obj.Name, s.Name, other))
+					continue
+				}
+				owner[s.Name] = obj.Name
+				exports[s.Name] = &s
+				prog.Symbols[s.Name] = &s
+			} else {
+				s.Name = obj.Name + "." + s.Name
+				prog.Symbols[s.Name] = &s
+			}
+		}
+	}
+
+	// Copy the code and patch labels and relocations
+	for i, obj := range objs {
+		code := append([]byte{}, obj.Code...)
+		for _, addr := range obj.LabelRefs {
+			if n := renumber[i][int(code[addr]&labelBits)>>1]; n >= 0 {
+				code[addr] = code[addr]&^labelBits | byte(n)<<1
+			}
+			prog.LabelRefs = append(prog.LabelRefs, bases[i]+addr)
+		}
+		for _, r := range obj.Relocations {
+			word := uint16(code[r.Offset])<<8 | uint16(code[r.Offset+1])
+			if r.Symbol == "" {
+				word += bases[i]
+			} else {
+				sym, ok := exports[r.Symbol]
+				switch {
+				case !ok:
+					errs = append(errs, fmt.Sprintf("%s: undefined symbol %s", obj.Name, r.Symbol))
+					continue
+				case sym.Kind == SymLabel:
+					errs = append(errs, fmt.Sprintf("%s: %s is a LABEL and cannot be imported", obj.Name, r.Symbol))
+					continue
+				}
+				word += sym.Value
+			}
+			code[r.Offset] = byte(word >> 8)
+			code[r.Offset+1] = byte(word)
+		}
+		if len(code) > 0 {
+			prog.Segments = append(prog.Segments, Segment{Addr: bases[i], Data: code})
+		}
+	}
+	sort.Slice(prog.Segments, func(i, j int) bool { return prog.Segments[i].Addr < prog.Segments[j].Addr })
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return prog, nil
+}
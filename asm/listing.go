@@ -0,0 +1,128 @@
+package asm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"chrisriddick.net/symbols"
+)
+
+// Number of code bytes shown on each listing line
+const listingBytes = 4
+
+// listingLine is a source line together with the code assembled from it
+type listingLine struct {
+	line    sourceLine
+	addr    uint16
+	data    []byte
+	hasAddr bool // Line defines a label or holds code, so its address is shown
+}
+
+// listing pairs every source line with its statement after pass2
+func (a *assembler) listing() []listingLine {
+	var list []listingLine
+	for i, line := range a.lines {
+		l := listingLine{line: line}
+		if st, ok := a.lineStmt[i]; ok && (st.label != nil || len(st.data) > 0) {
+			l.addr, l.data, l.hasAddr = st.addr, st.data, true
+		}
+		list = append(list, l)
+	}
+	return list
+}
+
+// WriteListing writes the address, code bytes and source text of every
+// line, followed by the symbol table
+func (p *Program) WriteListing(w io.Writer) error {
+	return p.WriteAnnotatedListing(w, func(uint16, int) string { return "" })
+}
+
+// WriteAnnotatedListing is WriteListing with a column in front of every
+// line, returned by annotate for the size bytes of code at addr. Lines
+// without code get the column for a size of 0, which also sets its width.
+func (p *Program) WriteAnnotatedListing(w io.Writer, annotate func(addr uint16, size int) string) error {
+	pad := strings.Repeat(" ", len(annotate(0, 0)))
+	if _, err := fmt.Fprintf(w, "%sADDR  CODE         LINE  SOURCE\n", pad); err != nil {
+		return err
+	}
+	file := ""
+	for i, l := range p.listing {
+		// Name the file whenever an include switches to another one.
+		// Lines expanded from a macro are marked with + instead.
+		mark := " "
+		if l.line.expansion != "" {
+			mark = "+"
+		} else {
+			if l.line.file != file && i > 0 {
+				if _, err := fmt.Fprintf(w, "%s%25s; %s\n", pad, "", l.line.file); err != nil {
+					return err
+				}
+			}
+			file = l.line.file
+		}
+		addr := "    "
+		if l.hasAddr {
+			addr = fmt.Sprintf("%04x", l.addr)
+		}
+		if _, err := fmt.Fprintf(w, "%s%s  %-12s %4d%s %s\n", annotate(l.addr, min(len(l.data), listingBytes)), addr, hexBytes(l.data, listingBytes), l.line.num, mark, l.line.text); err != nil {
+			return err
+		}
+		// Long data directives continue on following lines
+		for i := listingBytes; i < len(l.data); i += listingBytes {
+			end := i + listingBytes
+			if end > len(l.data) {
+				end = len(l.data)
+			}
+			if _, err := fmt.Fprintf(w, "%s%04x  %s\n", annotate(l.addr+uint16(i), end-i), int(l.addr)+i, hexBytes(l.data[i:end], listingBytes)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := fmt.Fprintf(w, "\nSymbols:\n"); err != nil {
+		return err
+	}
+	for _, sym := range p.SortedSymbols() {
+		line := fmt.Sprintf("%04x  %-8s  %s", sym.Value, sym.Kind, sym.Name)
+		if sym.Kind == SymLabel {
+			line = line + fmt.Sprintf(" (label %d)", sym.Number)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hexBytes formats at most n bytes of data as space separated hex
+func hexBytes(data []byte, n int) string {
+	var s string
+	for i, b := range data {
+		if i == n {
+			break
+		}
+		if i > 0 {
+			s = s + " "
+		}
+		s = s + fmt.Sprintf("%02x", b)
+	}
+	return s
+}
+
+// SymbolMap returns the symbol table in the form loaded by the dashboard and
+// the disassembler
+func (p *Program) SymbolMap() *symbols.Map {
+	var syms []symbols.Symbol
+	for _, sym := range p.Symbols {
+		if sym.Kind == SymImport {
+			continue
+		}
+		syms = append(syms, symbols.Symbol{Name: sym.Name, Kind: sym.Kind.String(), Value: sym.Value, Number: sym.Number})
+	}
+	return symbols.New(syms)
+}
+
+// WriteSymbolMap writes the symbol table as a symbol map file
+func (p *Program) WriteSymbolMap(w io.Writer) error {
+	return p.SymbolMap().Write(w)
+}
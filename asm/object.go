@@ -0,0 +1,217 @@
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Number of code bytes written on each line of an object file
+const objectLineBytes = 16
+
+// Object is a relocatable module produced by the assembler and combined
+// with others by Link. Code is assembled as if loaded at address 0.
+type Object struct {
+	Name        string
+	Code        []byte
+	Symbols     []*Symbol // All symbols defined by the module, imports excluded
+	Imports     []string
+	Relocations []Relocation
+	LabelRefs   []uint16
+}
+
+// Object returns the program as a relocatable module called name
+func (p *Program) Object(name string) *Object {
+	obj := &Object{
+		Name:        name,
+		Code:        p.Image(),
+		Relocations: p.Relocations,
+		LabelRefs:   p.LabelRefs,
+	}
+	for _, sym := range p.SortedSymbols() {
+		if sym.Kind == SymImport {
+			obj.Imports = append(obj.Imports, sym.Name)
+		} else {
+			obj.Symbols = append(obj.Symbols, sym)
+		}
+	}
+	sort.Strings(obj.Imports)
+	return obj
+}
+
+// Write saves the object in text form:
+//
+//	object sum
+//	size 0018
+//	code 0000 00 81 a0 ...
+//	symbol 000a label loop 0
+//	symbol 0000 address start export
+//	import print
+//	reloc 0001
+//	reloc 0004 print
+//	labelref 0009
+func (obj *Object) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "object %s\n", obj.Name)
+	fmt.Fprintf(bw, "size %04x\n", len(obj.Code))
+	for i := 0; i < len(obj.Code); i += objectLineBytes {
+		end := i + objectLineBytes
+		if end > len(obj.Code) {
+			end = len(obj.Code)
+		}
+		fmt.Fprintf(bw, "code %04x", i)
+		for _, b := range obj.Code[i:end] {
+			fmt.Fprintf(bw, " %02x", b)
+		}
+		fmt.Fprintln(bw)
+	}
+	for _, sym := range obj.Symbols {
+		fmt.Fprintf(bw, "symbol %04x %s %s", sym.Value, sym.Kind, sym.Name)
+		if sym.Kind == SymLabel {
+			fmt.Fprintf(bw, " %d", sym.Number)
+		}
+		if sym.Exported {
+			fmt.Fprint(bw, " export")
+		}
+		fmt.Fprintln(bw)
+	}
+	for _, name := range obj.Imports {
+		fmt.Fprintf(bw, "import %s\n", name)
+	}
+	for _, r := range obj.Relocations {
+		if r.Symbol == "" {
+			fmt.Fprintf(bw, "reloc %04x\n", r.Offset)
+		} else {
+			fmt.Fprintf(bw, "reloc %04x %s\n", r.Offset, r.Symbol)
+		}
+	}
+	for _, addr := range obj.LabelRefs {
+		fmt.Fprintf(bw, "labelref %04x\n", addr)
+	}
+	return bw.Flush()
+}
+
+// ReadObject parses an object written by Object.Write
+func ReadObject(r io.Reader) (*Object, error) {
+	obj := &Object{}
+	scanner := bufio.NewScanner(r)
+	num := 0
+	fail := func(format string, args ...interface{}) (*Object, error) {
+		return nil, fmt.Errorf("object line %d: %s", num, fmt.Sprintf(format, args...))
+	}
+	hex16 := func(s string) (uint16, error) {
+		v, err := strconv.ParseUint(s, 16, 16)
+		return uint16(v), err
+	}
+	for scanner.Scan() {
+		num++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "object":
+			if len(fields) != 2 {
+				return fail("expected a module name")
+			}
+			obj.Name = fields[1]
+		case "size":
+			size, err := strconv.ParseUint(fields[len(fields)-1], 16, 17)
+			if len(fields) != 2 || err != nil || size > 0x10000 {
+				return fail("invalid size")
+			}
+			obj.Code = make([]byte, size)
+		case "code":
+			if len(fields) < 2 {
+				return fail("expected an offset")
+			}
+			offset, err := hex16(fields[1])
+			if err != nil {
+				return fail("invalid offset %q", fields[1])
+			}
+			for i, f := range fields[2:] {
+				b, err := strconv.ParseUint(f, 16, 8)
+				if err != nil || int(offset)+i >= len(obj.Code) {
+					return fail("invalid code byte %q", f)
+				}
+				obj.Code[int(offset)+i] = byte(b)
+			}
+		case "symbol":
+			if len(fields) < 4 {
+				return fail("expected value, kind and name")
+			}
+			value, err := hex16(fields[1])
+			if err != nil {
+				return fail("invalid value %q", fields[1])
+			}
+			sym := &Symbol{Name: fields[3], Value: value, File: obj.Name}
+			rest := fields[4:]
+			switch fields[2] {
+			case "address":
+				sym.Kind = SymAddress
+			case "constant":
+				sym.Kind = SymConstant
+			case "label":
+				sym.Kind = SymLabel
+				if len(rest) == 0 {
+					return fail("label %s has no number", sym.Name)
+				}
+				if sym.Number, err = strconv.Atoi(rest[0]); err != nil {
+					return fail("invalid label number %q", rest[0])
+				}
+				rest = rest[1:]
+			default:
+				return fail("unknown symbol kind %q", fields[2])
+			}
+			sym.Exported = len(rest) == 1 && rest[0] == "export"
+			obj.Symbols = append(obj.Symbols, sym)
+		case "import":
+			if len(fields) != 2 {
+				return fail("expected a symbol name")
+			}
+			obj.Imports = append(obj.Imports, fields[1])
+		case "reloc":
+			if len(fields) < 2 || len(fields) > 3 {
+				return fail("expected an offset and optional symbol")
+			}
+			offset, err := hex16(fields[1])
+			if err != nil || int(offset)+2 > len(obj.Code) {
+				return fail("invalid relocation offset %q", fields[1])
+			}
+			r := Relocation{Offset: offset}
+			if len(fields) == 3 {
+				r.Symbol = fields[2]
+			}
+			obj.Relocations = append(obj.Relocations, r)
+		case "labelref":
+			offset, err := hex16(fields[len(fields)-1])
+			if len(fields) != 2 || err != nil || int(offset) >= len(obj.Code) {
+				return fail("invalid label reference")
+			}
+			obj.LabelRefs = append(obj.LabelRefs, offset)
+		default:
+			return fail("unknown record %q", fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if obj.Name == "" {
+		return nil, fmt.Errorf("not an object file, missing object record")
+	}
+	return obj, nil
+}
+
+// LoadObject reads the object file at path
+func LoadObject(path string) (*Object, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadObject(f)
+}
@@ -0,0 +1,418 @@
+package asm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Limits guarding against runaway recursion in source files
+const (
+	maxIncludeDepth = 16
+	maxMacroDepth   = 32
+)
+
+// macro is a parameterized block of source lines defined by .macro/.endm
+type macro struct {
+	name   string
+	params []string
+	body   []sourceLine
+	file   string
+	line   int
+}
+
+// condition tracks one level of .if/.else/.endif nesting
+type condition struct {
+	active   bool // Lines in the current branch are assembled
+	taken    bool // One branch of this conditional has been assembled
+	elseSeen bool
+	parent   bool // The enclosing block is active
+	line     sourceLine
+}
+
+// preprocessor expands includes, macros and conditional blocks into the
+// plain lines read by the assembler passes
+type preprocessor struct {
+	a            *assembler
+	opts         Options
+	macros       map[string]*macro
+	defs         map[string]int  // Constants known so far, for .if
+	names        map[string]bool // Every name defined so far, for .ifdef
+	conds        []condition
+	defining     *macro // Macro whose body is being collected
+	depth        int    // Macro expansion depth
+	expansions   int    // Counter substituted for \@
+	includeDepth int
+}
+
+// readSource preprocesses src and appends the resulting lines to a.lines
+func (a *assembler) readSource(filename, src string, opts Options) {
+	p := &preprocessor{
+		a:      a,
+		opts:   opts,
+		macros: make(map[string]*macro),
+		defs:   make(map[string]int),
+		names:  make(map[string]bool),
+	}
+	for name, v := range opts.Defines {
+		p.defs[name] = v
+		p.names[name] = true
+	}
+	p.file(filename, src)
+	if p.defining != nil {
+		a.errorf(sourceLine{file: p.defining.file, num: p.defining.line}, 1, ".macro %s has no .endm", p.defining.name)
+	}
+	for _, c := range p.conds {
+		a.errorf(c.line, 1, ".if has no .endif")
+	}
+}
+
+// active tells whether lines at the current nesting level are assembled
+func (p *preprocessor) active() bool {
+	return len(p.conds) == 0 || p.conds[len(p.conds)-1].active
+}
+
+// file preprocesses every line of one source file
+func (p *preprocessor) file(filename, src string) {
+	for i, text := range strings.Split(strings.TrimSuffix(src, "\n"), "\n") {
+		p.line(sourceLine{file: filename, num: i + 1, text: text})
+	}
+}
+
+// list keeps a consumed line in the listing without assembling it
+func (p *preprocessor) list(line sourceLine) {
+	line.listOnly = true
+	p.a.lines = append(p.a.lines, line)
+}
+
+// line handles one source line, emitting it or acting on it
+func (p *preprocessor) line(line sourceLine) {
+	if p.defining != nil {
+		if line.expansion == "" {
+			defer p.list(line)
+		}
+		// Macro bodies are stored as text, since parameters like \n are
+		// only valid once substituted
+		switch firstWord(line.text) {
+		case ".endm":
+			p.macros[p.defining.name] = p.defining
+			p.defining = nil
+		case ".macro":
+			p.a.errorf(line, 1, "nested .macro definitions are not supported")
+		default:
+			p.defining.body = append(p.defining.body, line)
+		}
+		return
+	}
+	toks, err := tokenize(line.text)
+	if err != nil {
+		// Leave the report to the parser unless the line is skipped anyway
+		if p.active() {
+			p.a.lines = append(p.a.lines, line)
+		}
+		return
+	}
+	label, op, rest := splitLine(toks, line.text)
+
+	switch op {
+	case ".if", ".ifdef", ".ifndef":
+		p.list(line)
+		p.openCondition(line, op, toks)
+		return
+	case ".else":
+		p.list(line)
+		p.elseCondition(line, toks)
+		return
+	case ".endif":
+		p.list(line)
+		if len(p.conds) == 0 {
+			p.a.errorf(line, toks[0].col, ".endif without .if")
+			return
+		}
+		p.conds = p.conds[:len(p.conds)-1]
+		return
+	}
+	if !p.active() {
+		p.list(line)
+		return
+	}
+
+	if label != "" {
+		p.names[label] = true
+	}
+	switch op {
+	case ".include":
+		p.list(line)
+		p.include(line, toks)
+		return
+	case ".macro":
+		p.list(line)
+		p.defineMacro(line, toks)
+		return
+	case ".endm":
+		p.a.errorf(line, toks[0].col, ".endm without .macro")
+		return
+	case ".equ":
+		args := splitArgs(toks[1:])
+		if len(args) == 2 && len(args[0]) == 1 && args[0][0].kind == tokIdent {
+			p.names[args[0][0].text] = true
+			if o, err := evalExpr(line, toks[0].col, args[1], p.lookup); err == nil {
+				p.defs[args[0][0].text] = o.value
+			}
+		}
+	}
+	if m, ok := p.macros[op]; ok {
+		if label != "" {
+			p.a.lines = append(p.a.lines, sourceLine{file: line.file, num: line.num, text: label + ":", expansion: line.expansion})
+		} else {
+			p.list(line)
+		}
+		p.expand(line, m, rest)
+		return
+	}
+	p.a.lines = append(p.a.lines, line)
+}
+
+// splitLine returns the label, the lower case op and the operand text of a line
+func splitLine(toks []token, text string) (string, string, string) {
+	var label string
+	if len(toks) >= 2 && toks[0].kind == tokIdent && toks[1].kind == tokColon {
+		label = toks[0].text
+		toks = toks[2:]
+	}
+	if len(toks) == 0 || toks[0].kind != tokIdent {
+		return label, "", ""
+	}
+	op := strings.ToLower(toks[0].text)
+	rest := text[toks[0].col-1+len(toks[0].text):]
+	if i := commentStart(rest); i >= 0 {
+		rest = rest[:i]
+	}
+	return label, op, strings.TrimSpace(rest)
+}
+
+// firstWord returns the lower case op of a line without tokenizing it
+func firstWord(text string) string {
+	if i := commentStart(text); i >= 0 {
+		text = text[:i]
+	}
+	fields := strings.Fields(text)
+	if len(fields) > 0 && strings.HasSuffix(fields[0], ":") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToLower(fields[0])
+}
+
+// commentStart returns the index of the ';' starting a comment in s, or -1
+func commentStart(s string) int {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0 && s[i] == '\\':
+			i++
+		case quote != 0 && s[i] == quote:
+			quote = 0
+		case quote == 0 && (s[i] == '"' || s[i] == '\''):
+			quote = s[i]
+		case quote == 0 && s[i] == ';':
+			return i
+		}
+	}
+	return -1
+}
+
+// splitOperands splits macro arguments on commas outside of quotes
+func splitOperands(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var args []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0 && s[i] == '\\':
+			i++
+		case quote != 0 && s[i] == quote:
+			quote = 0
+		case quote == 0 && (s[i] == '"' || s[i] == '\''):
+			quote = s[i]
+		case quote == 0 && s[i] == ',':
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(args, strings.TrimSpace(s[start:]))
+}
+
+func (p *preprocessor) lookup(name string) (operand, bool) {
+	v, ok := p.defs[name]
+	return operand{value: v}, ok
+}
+
+func (p *preprocessor) openCondition(line sourceLine, op string, toks []token) {
+	c := condition{parent: p.active(), line: line}
+	if c.parent {
+		args := splitArgs(toks[1:])
+		switch op {
+		case ".if":
+			if len(args) != 1 {
+				p.a.errorf(line, toks[0].col, ".if expects one expression")
+				break
+			}
+			o, err := evalExpr(line, toks[0].col, args[0], p.lookup)
+			if err != nil {
+				p.a.errs = append(p.a.errs, err)
+				break
+			}
+			c.active = o.value != 0
+		default:
+			if len(args) != 1 || len(args[0]) != 1 || args[0][0].kind != tokIdent {
+				p.a.errorf(line, toks[0].col, "%s expects a name", op)
+				break
+			}
+			defined := p.names[args[0][0].text] || p.macros[args[0][0].text] != nil
+			c.active = defined == (op == ".ifdef")
+		}
+	}
+	c.taken = c.active
+	p.conds = append(p.conds, c)
+}
+
+func (p *preprocessor) elseCondition(line sourceLine, toks []token) {
+	if len(p.conds) == 0 {
+		p.a.errorf(line, toks[0].col, ".else without .if")
+		return
+	}
+	c := &p.conds[len(p.conds)-1]
+	if c.elseSeen {
+		p.a.errorf(line, toks[0].col, ".else already seen for this .if")
+		return
+	}
+	c.elseSeen = true
+	c.active = c.parent && !c.taken
+	c.taken = true
+}
+
+// include reads the named file, relative to the including file first and
+// then to each include directory
+func (p *preprocessor) include(line sourceLine, toks []token) {
+	if len(toks) != 2 || toks[1].kind != tokString {
+		p.a.errorf(line, toks[0].col, ".include expects a file name in quotes")
+		return
+	}
+	if p.includeDepth >= maxIncludeDepth {
+		p.a.errorf(line, toks[0].col, ".include nested more than %d deep", maxIncludeDepth)
+		return
+	}
+	name := toks[1].text
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		candidates = []string{filepath.Join(filepath.Dir(line.file), name)}
+		for _, dir := range p.opts.IncludeDirs {
+			candidates = append(candidates, filepath.Join(dir, name))
+		}
+	}
+	outside := false
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if p.opts.IncludeRoot != "" && !insideDir(p.opts.IncludeRoot, path) {
+			outside = true
+			continue
+		}
+		src, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		p.includeDepth++
+		p.file(path, string(src))
+		p.includeDepth--
+		return
+	}
+	if outside {
+		p.a.errorf(line, toks[1].col, "include file %q is outside %s", name, p.opts.IncludeRoot)
+		return
+	}
+	p.a.errorf(line, toks[1].col, "cannot find include file %q", name)
+}
+
+// insideDir tells whether the file at path is inside dir once symbolic
+// links are followed
+func insideDir(dir, path string) bool {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		return false
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return false
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (p *preprocessor) defineMacro(line sourceLine, toks []token) {
+	if len(toks) < 2 || toks[1].kind != tokIdent {
+		p.a.errorf(line, toks[0].col, ".macro expects a name")
+		return
+	}
+	m := &macro{name: strings.ToLower(toks[1].text), file: line.file, line: line.num}
+	if _, ok := instructionSizes[m.name]; ok {
+		p.a.errorf(line, toks[1].col, "macro %s hides an instruction", toks[1].text)
+		return
+	}
+	for _, arg := range splitArgs(toks[2:]) {
+		if len(arg) != 1 || arg[0].kind != tokIdent {
+			p.a.errorf(line, toks[1].col, ".macro parameters must be names")
+			return
+		}
+		m.params = append(m.params, arg[0].text)
+	}
+	p.defining = m
+}
+
+// expand emits the body of m with parameters replaced by the call arguments.
+// \name is replaced by the argument for parameter name and \@ by a number
+// unique to this expansion, for making local labels.
+func (p *preprocessor) expand(line sourceLine, m *macro, rest string) {
+	args := splitOperands(rest)
+	if len(args) != len(m.params) {
+		p.a.errorf(line, 1, "macro %s expects %d argument(s), got %d", m.name, len(m.params), len(args))
+		return
+	}
+	if p.depth >= maxMacroDepth {
+		p.a.errorf(line, 1, "macro %s expanded more than %d deep", m.name, maxMacroDepth)
+		return
+	}
+	p.expansions++
+	pairs := []string{`\@`, fmt.Sprintf("%d", p.expansions)}
+	// Replace longer names first so \ab is not matched by \a
+	order := make([]int, len(m.params))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return len(m.params[order[i]]) > len(m.params[order[j]]) })
+	for _, i := range order {
+		pairs = append(pairs, `\`+m.params[i], args[i])
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	expansion := fmt.Sprintf("in macro %s called at %s:%d", m.name, line.file, line.num)
+	p.depth++
+	for _, body := range m.body {
+		p.line(sourceLine{file: body.file, num: body.num, text: replacer.Replace(body.text), expansion: expansion})
+	}
+	p.depth--
+}
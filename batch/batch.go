@@ -0,0 +1,219 @@
+// Package batch runs a loaded program without any user interface and reports
+// the final state of the CPU, for use from shell scripts.
+package batch
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"chrisriddick.net/cpusimple"
+)
+
+// Reasons a run stops
+const (
+	ReasonHalt        = "halt"          // HALT instruction
+	ReasonFault       = "fault"         // Undefined instruction, stack overflow or bad memory access
+	ReasonStepLimit   = "step-limit"    // Options.MaxSteps instructions executed
+	ReasonEndOfMemory = "end-of-memory" // PC moved past the last byte of memory
+	ReasonTimeout     = "timeout"       // Deadline of the context passed
+	ReasonCanceled    = "canceled"      // Context canceled
+	ReasonLoop        = "loop"          // Endless loop found by CPU.DetectLoops
+)
+
+// Process exit codes for each reason. A halted program exits with 0, or with
+// the low byte of R0 when Options.ExitR0 is set.
+const (
+	ExitHalt        = 0
+	ExitFault       = 3
+	ExitStepLimit   = 4
+	ExitEndOfMemory = 5
+	ExitTimeout     = 6
+	ExitCanceled    = 7
+	ExitLoop        = 8
+)
+
+// Range is an inclusive range of memory addresses to report
+type Range struct {
+	Start, End uint16
+}
+
+// ParseRange reads "start:end" with both ends included, or a single address
+// standing for the 16 bytes starting there. Numbers are decimal or 0x hex.
+func ParseRange(s string) (Range, error) {
+	first, last, found := strings.Cut(s, ":")
+	start, err := strconv.ParseUint(first, 0, 16)
+	if err != nil {
+		return Range{}, fmt.Errorf("invalid memory range %q", s)
+	}
+	end := start + 15
+	if found {
+		if end, err = strconv.ParseUint(last, 0, 16); err != nil || end < start {
+			return Range{}, fmt.Errorf("invalid memory range %q", s)
+		}
+	}
+	if end > 0xffff {
+		end = 0xffff
+	}
+	return Range{Start: uint16(start), End: uint16(end)}, nil
+}
+
+// Options control a batch run
+type Options struct {
+	MaxSteps uint64  // Stop after this many instructions, 0 for no limit
+	Ranges   []Range // Memory to include in the result
+	ExitR0   bool    // Derive the exit code of a halted program from R0
+}
+
+// Memory is the content of one reported memory range
+type Memory struct {
+	Start uint16 `json:"start"`
+	End   uint16 `json:"end"`
+	Bytes string `json:"bytes"` // Hex digits, two per byte
+}
+
+// Result is the state of the CPU at the end of a run
+type Result struct {
+	Reason    string     `json:"reason"`
+	Fault     string     `json:"fault,omitempty"`
+	Loop      string     `json:"loop,omitempty"`     // First and last address of an endless loop
+	Warnings  []string   `json:"warnings,omitempty"` // Such as a RET without a matching CALL
+	Steps     uint64     `json:"steps"`
+	PC        uint16     `json:"pc"`
+	SP        uint16     `json:"sp"`
+	Flag      bool       `json:"flag"`
+	Registers [17]uint16 `json:"registers"`
+	Memory    []Memory   `json:"memory,omitempty"`
+	exitR0    bool
+}
+
+// Run executes the program loaded in cpu from the current PC until it
+// stops. A memory access outside of memory is reported as a fault instead of
+// a panic.
+func Run(cpu *cpusimple.CPU, opts Options) *Result {
+	return RunContext(context.Background(), cpu, opts)
+}
+
+// RunContext is Run stopping early when ctx is canceled or its deadline
+// passes. The result then holds the state reached so far, with the reason
+// telling which of the two happened.
+func RunContext(ctx context.Context, cpu *cpusimple.CPU, opts Options) *Result {
+	r := &Result{exitR0: opts.ExitR0}
+	cpu.RunFlag = true
+	r.Reason, r.Fault = execute(ctx, cpu, opts.MaxSteps, &r.Steps)
+	cpu.RunFlag = false
+
+	r.PC, r.SP, r.Flag, r.Registers, r.Loop, r.Warnings = cpu.PC, cpu.SP, cpu.Flag, cpu.Registers, cpu.Loop, cpu.Warnings
+	for _, rg := range opts.Ranges {
+		end := int(rg.End) + 1
+		if end > len(cpu.Memory) {
+			end = len(cpu.Memory)
+		}
+		if int(rg.Start) >= end {
+			continue
+		}
+		r.Memory = append(r.Memory, Memory{Start: rg.Start, End: uint16(end - 1), Bytes: hex.EncodeToString(cpu.Memory[rg.Start:end])})
+	}
+	return r
+}
+
+// execute steps the CPU and returns why it stopped
+func execute(ctx context.Context, cpu *cpusimple.CPU, maxSteps uint64, steps *uint64) (reason, fault string) {
+	var pc uint16 // Address of the instruction being executed
+	defer func() {
+		if err := recover(); err != nil {
+			reason, fault = ReasonFault, fmt.Sprintf("bad memory access at x%04x: %v", pc, err)
+		}
+	}()
+	for cpu.RunFlag {
+		if int(cpu.PC) >= len(cpu.Memory) {
+			return ReasonEndOfMemory, ""
+		}
+		if maxSteps > 0 && *steps >= maxSteps {
+			return ReasonStepLimit, ""
+		}
+		// Checking the context on every instruction would slow the run down
+		if *steps%1024 == 0 {
+			select {
+			case <-ctx.Done():
+				if ctx.Err() == context.DeadlineExceeded {
+					return ReasonTimeout, ""
+				}
+				return ReasonCanceled, ""
+			default:
+			}
+		}
+		pc = cpu.PC
+		cpu.FetchInstruction(cpu.Memory)
+		*steps++
+	}
+	if cpu.Loop != "" {
+		return ReasonLoop, cpu.Fault
+	}
+	if cpu.Fault != "" {
+		return ReasonFault, cpu.Fault
+	}
+	return ReasonHalt, ""
+}
+
+// ExitCode returns the process exit code for the result
+func (r *Result) ExitCode() int {
+	switch r.Reason {
+	case ReasonHalt:
+		if r.exitR0 {
+			return int(r.Registers[0] & 0xff)
+		}
+		return ExitHalt
+	case ReasonStepLimit:
+		return ExitStepLimit
+	case ReasonEndOfMemory:
+		return ExitEndOfMemory
+	case ReasonTimeout:
+		return ExitTimeout
+	case ReasonCanceled:
+		return ExitCanceled
+	case ReasonLoop:
+		return ExitLoop
+	}
+	return ExitFault
+}
+
+// WriteText prints the result for people to read
+func (r *Result) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Stopped: %s after %d steps\n", r.Reason, r.Steps)
+	if r.Fault != "" {
+		fmt.Fprintf(&b, "Fault: %s\n", r.Fault)
+	}
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(&b, "Warning: %s\n", warning)
+	}
+	fmt.Fprintf(&b, "PC: x%04x  SP: x%04x  Flag: %t\n", r.PC, r.SP, r.Flag)
+	for i, v := range r.Registers {
+		fmt.Fprintf(&b, "R%02d: x%04x\n", i, v)
+	}
+	for _, m := range r.Memory {
+		fmt.Fprintf(&b, "Memory x%04x-x%04x:\n", m.Start, m.End)
+		data, _ := hex.DecodeString(m.Bytes)
+		for i := 0; i < len(data); i += 16 {
+			fmt.Fprintf(&b, "%04x:", int(m.Start)+i)
+			for _, v := range data[i:min(i+16, len(data))] {
+				fmt.Fprintf(&b, " %02x", v)
+			}
+			b.WriteString("\n")
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteJSON prints the result as one JSON object
+func (r *Result) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
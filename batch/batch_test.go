@@ -0,0 +1,119 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"chrisriddick.net/cpusimple"
+)
+
+// newCPU returns a CPU with code loaded at address 0
+func newCPU(code []byte) *cpusimple.CPU {
+	cpu := &cpusimple.CPU{}
+	cpu.InitMemory(64)
+	cpu.InitStack(64 - 3)
+	cpu.Reset()
+	cpu.Load(code, len(code))
+	cpu.Preprocess(cpu.Memory, uint16(len(code)))
+	return cpu
+}
+
+func TestRunToHalt(t *testing.T) {
+	fmt.Println("TestRunToHalt")
+	// XSET R0 <-- x0137, STORE R0 at M[x0020], HALT
+	cpu := newCPU([]byte{0x18, 0x01, 0x37, 0x12, 0x00, 0x20, 0x11})
+	r := Run(cpu, Options{Ranges: []Range{{Start: 0x20, End: 0x21}}, ExitR0: true})
+	if r.Reason != ReasonHalt || r.Steps != 3 || r.ExitCode() != 0x37 {
+		t.Fatalf("Want: halt after 3 steps, exit x37 Got: %s after %d, exit x%02x", r.Reason, r.Steps, r.ExitCode())
+	}
+	var buf bytes.Buffer
+	r.WriteText(&buf)
+	if !strings.HasPrefix(buf.String(), "Stopped: halt after 3 steps\nPC: x0007") || !strings.HasSuffix(buf.String(), "Memory x0020-x0021:\n0020: 01 37\n") {
+		t.Fatalf("Unexpected text:\n%s", buf.String())
+	}
+	buf.Reset()
+	r.WriteJSON(&buf)
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["reason"] != "halt" || decoded["memory"].([]interface{})[0].(map[string]interface{})["bytes"] != "0137" {
+		t.Fatalf("Unexpected JSON:\n%s", buf.String())
+	}
+}
+
+func TestRunStops(t *testing.T) {
+	fmt.Println("TestRunStops")
+	tests := []struct {
+		code  []byte
+		opts  Options
+		want  string
+		fault string
+		exit  int
+	}{
+		{[]byte{0x1f}, Options{}, ReasonFault, "undefined instruction x1f at x0000", ExitFault},
+		{[]byte{0x13, 0xff, 0xff}, Options{}, ReasonFault, "bad memory access at x0000: runtime error: slice bounds out of range [65535:64]", ExitFault},
+		{[]byte{0xe0, 0xc0}, Options{MaxSteps: 10}, ReasonStepLimit, "", ExitStepLimit},
+		{[]byte{0x01}, Options{}, ReasonEndOfMemory, "", ExitEndOfMemory},
+	}
+	for _, test := range tests {
+		r := Run(newCPU(test.code), test.opts)
+		if r.Reason != test.want || r.Fault != test.fault || r.ExitCode() != test.exit {
+			t.Fatalf("Want: %s %q exit %d Got: %s %q exit %d", test.want, test.fault, test.exit, r.Reason, r.Fault, r.ExitCode())
+		}
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	fmt.Println("TestRunContext")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := RunContext(ctx, newCPU([]byte{0xe0, 0xc0}), Options{})
+	if r.Reason != ReasonTimeout || r.ExitCode() != ExitTimeout || r.PC != 1 || r.Steps == 0 {
+		t.Fatalf("Want: timeout at x0001 Got: %s at x%04x after %d steps", r.Reason, r.PC, r.Steps)
+	}
+	cpu := newCPU([]byte{0xe0, 0xc0})
+	cpu.DetectLoops = true
+	if r := Run(cpu, Options{}); r.Reason != ReasonLoop || r.Loop != "x0001-x0001" || r.ExitCode() != ExitLoop {
+		t.Fatalf("Want: loop x0001-x0001 Got: %s %q", r.Reason, r.Loop)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if r := RunContext(ctx, newCPU([]byte{0xe0, 0xc0}), Options{}); r.Reason != ReasonCanceled || r.ExitCode() != ExitCanceled {
+		t.Fatalf("Want: canceled Got: %s", r.Reason)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	fmt.Println("TestWarnings")
+	// SET 4, PUSH R0, RET returns to x0004 without a CALL
+	r := Run(newCPU([]byte{0x04, 0x81, cpusimple.RET, cpusimple.NOOP, cpusimple.HALT}), Options{})
+	want := "RET without a matching CALL at x0002"
+	if r.Reason != ReasonHalt || len(r.Warnings) != 1 || r.Warnings[0] != want {
+		t.Fatalf("Want: halt with warning %q Got: %s %q", want, r.Reason, r.Warnings)
+	}
+	var text strings.Builder
+	r.WriteText(&text)
+	if !strings.Contains(text.String(), "\nWarning: "+want+"\n") {
+		t.Fatalf("Want: warning line Got: %s", text.String())
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	fmt.Println("TestParseRange")
+	for s, want := range map[string]Range{"0x80:0x8f": {0x80, 0x8f}, "16": {16, 31}, "0xfffa": {0xfffa, 0xffff}} {
+		if got, err := ParseRange(s); err != nil || got != want {
+			t.Fatalf("Want: %v Got: %v %v", want, got, err)
+		}
+	}
+	for _, s := range []string{"", "x", "0x10:0x08", "0x10:"} {
+		if _, err := ParseRange(s); err == nil {
+			t.Fatalf("Want: error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+module chrisriddick.net/batch
+
+go 1.21.6
+
+require chrisriddick.net/cpusimple v0.0.0
+
+replace chrisriddick.net/cpusimple v0.0.0 => ../cpusimple
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"chrisriddick.net/asm"
+	"chrisriddick.net/batch"
+	"chrisriddick.net/controller"
+	"chrisriddick.net/coverage"
+	"chrisriddick.net/gdbstub"
+	"chrisriddick.net/hexfile"
+	"chrisriddick.net/httpapi"
+	"chrisriddick.net/monitor"
+	"chrisriddick.net/profile"
+	"chrisriddick.net/progfile"
+	"chrisriddick.net/webui"
+)
+
+// Settings given on the command line. Addresses and sizes are -1 when not
+// set, leaving the choice to the program image.
+var (
+	memSize     = -1
+	stackHead   = -1
+	entry       = -1
+	stackSize   = flag.Uint("stacksize", 0, "stack size in bytes, a push past it stops the CPU (0 for no limit)")
+	clockRate   = flag.Float64("clock", 0, "clock delay in milliseconds, 0 for full speed")
+	speed       = flag.Float64("hz", 0, "target speed in instructions per second, overrides -clock when set")
+	format      = flag.String("format", "auto", "program file format: auto, raw, hex, asm or image")
+	headless    = flag.Bool("headless", false, "run the program without the GUI and print the final state")
+	terminal    = flag.Bool("tui", false, "use the full-screen terminal UI instead of the GUI")
+	monitorMode = flag.Bool("monitor", false, "debug the program with monitor commands on standard input")
+	httpAddr    = flag.String("http", "", "serve the HTTP/JSON API on this TCP `address` next to the GUI or terminal UI")
+	webAddr     = flag.String("web", "", "serve the web dashboard on this TCP `address` instead of opening the GUI")
+	gdbAddr     = flag.String("gdb", "", "serve the GDB remote protocol on this TCP `address`, for example localhost:1234")
+	jsonOut     = flag.Bool("json", false, "print the final state as JSON in headless mode")
+	maxSteps    = flag.Uint64("maxsteps", 0, "stop a headless run after this many instructions (0 for no limit)")
+	exitR0      = flag.Bool("exitr0", false, "exit with the low byte of R0 when a headless run halts")
+	loops       = flag.Bool("detectloops", false, "stop with a fault when a loop iteration changes nothing")
+	profiling   = flag.Bool("profile", false, "count executed instructions and print a profile report after a headless run")
+	pprofFile   = flag.String("pprof", "", "write the profile in pprof format to this `file` after a headless run or on exit (implies -profile)")
+	covering    = flag.Bool("coverage", false, "print a summary of the instructions executed after a headless run")
+	coverList   = flag.String("coverlisting", "", "write a listing marking the code executed, read and written to this `file` after a headless run (implies -coverage)")
+	timeout     = flag.Duration("timeout", 0, "stop a headless run after this long, for example 2s (0 for no limit)")
+	dumps       []batch.Range
+)
+
+func init() {
+	flag.Func("mem", "memory size in bytes (default: what the program asks for, or 256)", addressFlag(&memSize))
+	flag.Func("stack", "stack head address (default: top of memory)", addressFlag(&stackHead))
+	flag.Func("entry", "entry point address (default: from the program, or 0)", addressFlag(&entry))
+	flag.Func("dump", "print memory `start:end` after a headless run (repeatable)", func(s string) error {
+		r, err := batch.ParseRange(s)
+		dumps = append(dumps, r)
+		return err
+	})
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: simplesimulator [flags] [program]\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "The program may be a raw binary, an Intel HEX or S-record file, assembly\nsource or a program image. Without one the built-in demo program is loaded.\n\n")
+		flag.PrintDefaults()
+	}
+}
+
+// addressFlag parses a 16-bit value in decimal or 0x hex into v
+func addressFlag(v *int) func(string) error {
+	return func(s string) error {
+		n, err := strconv.ParseUint(s, 0, 16)
+		if err != nil {
+			return fmt.Errorf("want a number from 0 to 0xffff")
+		}
+		*v = int(n)
+		return nil
+	}
+}
+
+// readProgram loads the program file at path in the given format
+func readProgram(path, format string) (*progfile.File, *asm.Program, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseProgram(path, data, format, asm.Options{})
+}
+
+// parseProgram turns the contents of a program file into a program image.
+// The auto format tells files apart by their contents and extension. Source
+// is assembled with opts, and the assembled program is returned too, for
+// coverage listings. It is nil for other formats.
+func parseProgram(name string, data []byte, format string, opts asm.Options) (*progfile.File, *asm.Program, error) {
+	if format == "auto" {
+		ext := strings.ToLower(filepath.Ext(name))
+		switch {
+		case progfile.IsImage(data):
+			format = "image"
+		case ext == ".asm" || ext == ".s":
+			format = "asm"
+		case ext == ".hex" || ext == ".ihex" || hexfile.IsSRecordName(name):
+			format = "hex"
+		default:
+			format = "raw"
+		}
+	}
+	switch format {
+	case "image":
+		f, err := progfile.Read(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return f, nil, nil
+	case "asm":
+		prog, err := asm.AssembleWithOptions(name, data, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return prog.ProgramFile(), prog, nil
+	case "hex":
+		img, err := hexfile.Read(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		var segs []progfile.Segment
+		for _, seg := range img.Segments {
+			segs = append(segs, progfile.Segment{Addr: seg.Addr, Data: seg.Data})
+		}
+		f := progfile.New(segs)
+		f.Entry = img.Entry
+		return f, nil, nil
+	case "raw":
+		if len(data) > 0xffff {
+			return nil, nil, fmt.Errorf("%s: program is larger than 64K", name)
+		}
+		return progfile.New([]progfile.Segment{{Addr: 0, Data: data}}), nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown program format %q", format)
+}
+
+// applyFlags overrides the machine asked for by the program with the
+// command line settings. The stack follows the top of memory unless it is
+// placed explicitly.
+func applyFlags(f *progfile.File) error {
+	if memSize >= 0 {
+		f.MemorySize = uint16(memSize)
+		if stackHead < 0 && f.MemorySize >= 3 {
+			f.StackHead = f.MemorySize - 3
+		}
+	}
+	if stackHead >= 0 {
+		f.StackHead = uint16(stackHead)
+	}
+	if entry >= 0 {
+		f.Entry = uint16(entry)
+	}
+	return f.Check()
+}
+
+// runMonitor debugs the program with the commands of the monitor read from
+// standard input, without the GUI. Status messages go to standard error so
+// the output stays easy to parse, and Ctrl-C pauses a running program.
+func runMonitor() {
+	ctl = controller.New(&cpu, func(e controller.Event) {
+		if e.Status != "" {
+			fmt.Fprintln(os.Stderr, e.Status)
+		}
+	})
+	f, _ := currentProgram()
+	if err := ctl.Load(f); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	mon = monitor.New(ctl, os.Stdout)
+	mon.SetSymbols(f.Symbols)
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		for range interrupts {
+			ctl.Pause()
+		}
+	}()
+	// Only prompt people, not scripts
+	prompt := ""
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		prompt = "> "
+	}
+	if err := mon.Run(context.Background(), os.Stdin, prompt); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// newAPI returns the HTTP/JSON API to serve on addr, loading the programs
+// posted to it with postProgram. The host of addr, unless it is all
+// interfaces, is accepted in requests besides loopback ones.
+func newAPI(addr string) *httpapi.Server {
+	api := httpapi.New(ctl)
+	api.Load = postProgram
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			api.Hosts = []string{host}
+		}
+	}
+	return api
+}
+
+// postProgram loads a program posted to the HTTP API. Its name is taken as a
+// file in the directory of the program given on the command line, or the
+// working directory, and its source may only include files from there, so
+// that a request cannot read files elsewhere.
+func postProgram(name string, r io.Reader) error {
+	dir := "."
+	if flag.NArg() == 1 {
+		dir = filepath.Dir(flag.Arg(0))
+	}
+	return loadProgram(filepath.Join(dir, filepath.Base(name)), r, asm.Options{IncludeRoot: dir})
+}
+
+// serveHTTP starts the HTTP/JSON API for the frontend in use when -http is
+// set. Programs posted to it are loaded like those opened in the dashboard.
+func serveHTTP() {
+	if *httpAddr == "" {
+		return
+	}
+	api := newAPI(*httpAddr)
+	l, err := net.Listen("tcp", *httpAddr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ui.SetStatus(fmt.Sprintf("HTTP API on http://%s/api/", l.Addr()))
+	go http.Serve(l, api)
+}
+
+// runWeb serves the web dashboard in place of the GUI, for machines without
+// a display. The program is loaded at once, since the page has no Load
+// button for it.
+func runWeb() {
+	ctl = controller.New(&cpu, show)
+	api := newAPI(*webAddr)
+	ui = web{api}
+	l, err := net.Listen("tcp", *webAddr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	load()
+	ui.SetStatus(fmt.Sprintf("Web dashboard on http://%s/", l.Addr()))
+	if err := http.Serve(l, webui.Handler(api)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runGDB serves the program to debuggers speaking the GDB remote protocol,
+// without the GUI. Status messages go to standard error.
+func runGDB() {
+	ctl = controller.New(&cpu, func(e controller.Event) {
+		if e.Status != "" {
+			fmt.Fprintln(os.Stderr, e.Status)
+		}
+	})
+	f, _ := currentProgram()
+	if err := ctl.Load(f); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	l, err := net.Listen("tcp", *gdbAddr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Waiting for gdb on %s\n", l.Addr())
+	if err := gdbstub.New(ctl).Serve(l); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runHeadless executes the loaded program at full speed until it stops,
+// prints the final state and exits with a code telling why it stopped.
+// Ctrl-C and -timeout stop the run early, still printing the state reached.
+func runHeadless() {
+	f, _ := currentProgram()
+	if err := f.Configure(&cpu); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	if *covering || *coverList != "" {
+		coverage.Enable(&cpu)
+	}
+	result := batch.RunContext(ctx, &cpu, batch.Options{MaxSteps: *maxSteps, Ranges: dumps, ExitR0: *exitR0})
+	var err error
+	if *jsonOut {
+		err = result.WriteJSON(os.Stdout)
+	} else {
+		err = result.WriteText(os.Stdout)
+	}
+	if err == nil && prof != nil {
+		err = prof.Report(cpu.Memory, f.Symbols).WriteText(os.Stderr, 20)
+	}
+	if err == nil && *pprofFile != "" {
+		err = writePprof(prof)
+	}
+	if err == nil && cpu.Coverage != nil {
+		err = coverage.Summarize(cpu.Memory, cpu.Coverage, f.Segments).WriteText(os.Stderr)
+	}
+	if err == nil && *coverList != "" {
+		err = writeCoverListing()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(result.ExitCode())
+}
+
+// Write p in pprof format to the file named by -pprof
+func writePprof(p *profile.Profile) error {
+	prog, _ := currentProgram()
+	f, err := os.Create(*pprofFile)
+	if err != nil {
+		return err
+	}
+	if err := p.WritePprof(f, prog.Symbols); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Write the listing of the program marked with its coverage to the file
+// named by -coverlisting. Programs assembled from source get the source
+// listing, others a disassembly.
+func writeCoverListing() error {
+	prog, src := currentProgram()
+	f, err := os.Create(*coverList)
+	if err != nil {
+		return err
+	}
+	if src != nil {
+		err = src.WriteAnnotatedListing(f, func(addr uint16, size int) string {
+			return coverage.Flags(cpu.Coverage, addr, size)
+		})
+	} else {
+		err = coverage.WriteListing(f, cpu.Memory, cpu.Coverage, prog.Segments, prog.Symbols)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
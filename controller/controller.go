@@ -0,0 +1,539 @@
+// Package controller owns the execution of a CPU. A single goroutine runs
+// the program and carries out the commands of the frontends, so the GUI, the
+// terminal UI and any other frontend drive the CPU the same way.
+package controller
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/progfile"
+)
+
+// State is the run state of the CPU
+type State int
+
+const (
+	Idle    State = iota // No program loaded
+	Running              // Executing at the target speed
+	Paused               // Program loaded, waiting for Start or Step
+	Halted               // Stopped by a HALT instruction
+	Faulted              // Stopped by an error
+)
+
+func (s State) String() string {
+	switch s {
+	case Idle:
+		return "idle"
+	case Running:
+		return "running"
+	case Paused:
+		return "paused"
+	case Halted:
+		return "halted"
+	case Faulted:
+		return "faulted"
+	}
+	return "unknown"
+}
+
+// Event tells the frontends that the CPU changed. Status is a message for
+// the status console, empty when only the displayed state changed. Snapshot
+// is the CPU state after the change, for the frontends to display. Speed is
+// the measured number of instructions per second since the program was
+// last started.
+type Event struct {
+	State    State
+	Status   string
+	Snapshot *cpusimple.Snapshot
+	Speed    float64
+}
+
+// slice is the host time given to each batch of instructions. Commands and
+// the display are handled between batches.
+const slice = 10 * time.Millisecond
+
+// frame is the time between events while running. State changes are sent
+// at once, so the frontends redraw at a fixed rate however fast the CPU is.
+const frame = time.Second / 30
+
+// Kinds of commands handled by the execution goroutine
+const (
+	cmdLoad = iota
+	cmdReset
+	cmdStart
+	cmdPause
+	cmdStep
+	cmdClock
+	cmdSpeed
+	cmdStepOver
+	cmdStepOut
+	cmdStepN
+	cmdRunTo
+	cmdBreak
+	cmdEdit
+	cmdWait
+	cmdListen
+	cmdClose
+)
+
+type command struct {
+	kind    int
+	file    *progfile.File
+	clock   float64                        // Milliseconds for cmdClock, Hz for cmdSpeed
+	steps   uint64                         // Instructions for cmdStepN
+	addr    uint16                         // Address for cmdRunTo and cmdBreak
+	on      bool                           // Set or clear the breakpoint for cmdBreak
+	edit    func(cpu *cpusimple.CPU) error // Change made by cmdEdit
+	stopped chan struct{}                  // Closed by cmdWait when the CPU is not running
+	listen  func(Event)                    // Listener added by cmdListen
+	reply   chan error
+}
+
+// Controller runs a CPU in its own goroutine. Only that goroutine touches
+// the CPU; everything else changes it through commands and reads it through
+// snapshots.
+type Controller struct {
+	cpu       *cpusimple.CPU
+	cmds      chan command
+	listeners []func(Event)
+	state     State
+	program   *progfile.File
+	ticker    *time.Ticker
+	runStart  time.Time       // When the scheduler started counting instructions
+	executed  uint64          // Instructions executed since runStart
+	lastFrame time.Time       // When the last event was sent while running
+	shown     uint64          // Value of executed at lastFrame
+	waiters   []chan struct{} // Closed when the CPU stops running
+	until     *until          // Ends the current run when met, nil for a free run
+	breaks    map[uint16]bool // Breakpoint addresses
+	resumed   bool            // The run has not executed its first instruction yet
+	breakList atomic.Pointer[[]uint16]
+	done      chan struct{}
+	published atomic.Pointer[cpusimple.Snapshot]
+	current   atomic.Int32  // State, readable from any goroutine
+	speed     atomic.Uint64 // Bits of the measured speed, readable from any goroutine
+}
+
+// New returns a controller for cpu and starts its execution goroutine. From
+// then on the CPU must only be changed through the controller. Listeners are
+// called from that goroutine on every change, so they must not wait for
+// commands to the controller.
+func New(cpu *cpusimple.CPU, listeners ...func(Event)) *Controller {
+	if cpu.CPUStatus == nil {
+		cpu.CPUStatus = make(chan string, 10)
+	}
+	if cpu.Clock < 0 {
+		cpu.Clock = 0
+	}
+	c := &Controller{
+		cpu:       cpu,
+		cmds:      make(chan command),
+		listeners: listeners,
+		breaks:    make(map[uint16]bool),
+		done:      make(chan struct{}),
+	}
+	c.published.Store(cpu.Snapshot())
+	go c.loop()
+	return c
+}
+
+// Load configures the CPU for f and loads it, leaving the CPU paused at the
+// entry point
+func (c *Controller) Load(f *progfile.File) error {
+	return c.send(command{kind: cmdLoad, file: f})
+}
+
+// Reset reloads the current program, or clears memory when there is none
+func (c *Controller) Reset() { c.send(command{kind: cmdReset}) }
+
+// Start runs the program at the target speed
+func (c *Controller) Start() { c.send(command{kind: cmdStart}) }
+
+// RunContext runs the program like Start and waits until it stops or ctx is
+// done. When ctx stops it, the program is paused and ctx.Err() tells whether
+// it was canceled or ran out of time. The returned event holds the state the
+// CPU stopped in.
+func (c *Controller) RunContext(ctx context.Context) (Event, error) {
+	if err := ctx.Err(); err != nil {
+		return c.lastEvent(), err
+	}
+	if err := c.send(command{kind: cmdStart}); err != nil {
+		return c.lastEvent(), err
+	}
+	return c.Wait(ctx)
+}
+
+// Wait waits until the CPU stops running, after a Start or one of the
+// stepping commands, and returns the state it stopped in. When ctx is done
+// first, the program is paused and ctx.Err() is returned.
+func (c *Controller) Wait(ctx context.Context) (Event, error) {
+	stopped := make(chan struct{})
+	if err := c.send(command{kind: cmdWait, stopped: stopped}); err != nil {
+		return c.lastEvent(), err
+	}
+	select {
+	case <-stopped:
+		return c.lastEvent(), nil
+	case <-ctx.Done():
+		c.Pause()
+		<-stopped
+		return c.lastEvent(), ctx.Err()
+	}
+}
+
+// Return the state as of the last event
+func (c *Controller) lastEvent() Event {
+	return Event{State: c.State(), Snapshot: c.Snapshot(), Speed: c.Speed()}
+}
+
+// Pause stops a running program before its next instruction
+func (c *Controller) Pause() { c.send(command{kind: cmdPause}) }
+
+// Step executes one instruction of a paused program
+func (c *Controller) Step() { c.send(command{kind: cmdStep}) }
+
+// SetClock sets the delay between instructions in milliseconds. Fractions
+// of a millisecond are kept. 0 runs as fast as possible.
+func (c *Controller) SetClock(ms float64) { c.send(command{kind: cmdClock, clock: ms}) }
+
+// SetSpeed sets the target speed in instructions per second. 0 runs as fast
+// as possible.
+func (c *Controller) SetSpeed(hz float64) { c.send(command{kind: cmdSpeed, clock: hz}) }
+
+// Speed returns the measured number of instructions per second since the
+// program was last started
+func (c *Controller) Speed() float64 {
+	return math.Float64frombits(c.speed.Load())
+}
+
+// SetBreakpoint makes a run pause before executing the instruction at addr.
+// A run starting there executes it first.
+func (c *Controller) SetBreakpoint(addr uint16) {
+	c.send(command{kind: cmdBreak, addr: addr, on: true})
+}
+
+// ClearBreakpoint removes the breakpoint at addr
+func (c *Controller) ClearBreakpoint(addr uint16) {
+	c.send(command{kind: cmdBreak, addr: addr})
+}
+
+// Breakpoints returns the breakpoint addresses in ascending order
+func (c *Controller) Breakpoints() []uint16 {
+	if list := c.breakList.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+// Edit calls f with the CPU from the execution goroutine, between two
+// instructions, then publishes the changed state. It is how frontends
+// deposit memory and set registers. Its error is returned by Edit.
+func (c *Controller) Edit(f func(cpu *cpusimple.CPU) error) error {
+	return c.send(command{kind: cmdEdit, edit: f})
+}
+
+// Listen adds a listener after New, such as a server started later. It is
+// called like the listeners given to New, starting with the next event.
+func (c *Controller) Listen(f func(Event)) {
+	c.send(command{kind: cmdListen, listen: f})
+}
+
+// Snapshot returns the CPU state as of the last event
+func (c *Controller) Snapshot() *cpusimple.Snapshot {
+	return c.published.Load()
+}
+
+// State returns the current run state
+func (c *Controller) State() State {
+	return State(c.current.Load())
+}
+
+// Close stops the execution goroutine
+func (c *Controller) Close() {
+	c.send(command{kind: cmdClose})
+	<-c.done
+}
+
+// Send a command to the execution goroutine and wait for it to be carried out
+func (c *Controller) send(cmd command) error {
+	cmd.reply = make(chan error, 1)
+	select {
+	case c.cmds <- cmd:
+		return <-cmd.reply
+	case <-c.done:
+		return fmt.Errorf("controller closed")
+	}
+}
+
+// loop is the execution goroutine, the only one touching the CPU
+func (c *Controller) loop() {
+	defer close(c.done)
+	for {
+		var tick <-chan time.Time
+		if c.ticker != nil {
+			tick = c.ticker.C
+		}
+		select {
+		case cmd := <-c.cmds:
+			err := c.handle(cmd)
+			cmd.reply <- err
+			if cmd.kind == cmdClose {
+				c.stopClock()
+				for _, w := range c.waiters {
+					close(w)
+				}
+				return
+			}
+		case <-tick:
+			c.runSlice()
+			if c.state == Running && c.executed != c.shown && time.Since(c.lastFrame) >= frame {
+				c.notify("")
+			}
+		}
+	}
+}
+
+func (c *Controller) handle(cmd command) error {
+	switch cmd.kind {
+	case cmdLoad:
+		if err := cmd.file.Configure(c.cpu); err != nil {
+			c.notify("ERROR: " + err.Error())
+			return err
+		}
+		c.program = cmd.file
+		c.setState(Paused, "Program loaded.")
+	case cmdReset:
+		if c.program != nil {
+			c.program.Configure(c.cpu)
+			c.setState(Paused, "CPU reset, program reloaded.")
+		} else {
+			c.cpu.Reset()
+			c.setState(Idle, "CPU and memory reset.")
+		}
+	case cmdStart:
+		if !c.ready() {
+			return fmt.Errorf("cannot run: CPU %s", c.state)
+		}
+		c.setState(Running, "Running loaded program ...")
+		c.until = nil
+	case cmdPause:
+		if c.state == Running {
+			c.setState(Paused, "CPU paused. Press Run or Step to continue current program.")
+		}
+	case cmdStep:
+		if c.ready() {
+			c.setState(Paused, "")
+			c.execute()
+			c.notify(fmt.Sprintf("Single step. PC = x%04x, SP = x%04x, Flag = %t", c.cpu.PC, c.cpu.SP, c.cpu.Flag))
+		}
+	case cmdStepOver, cmdStepOut, cmdStepN, cmdRunTo:
+		if c.ready() && (cmd.kind != cmdStepN || cmd.steps > 0) {
+			c.runUntil(c.newUntil(cmd))
+		}
+	case cmdClock:
+		c.setClock(cmd.clock)
+		c.notify(fmt.Sprintf("Clock set to %f milliseconds", c.cpu.Clock))
+	case cmdBreak:
+		if cmd.on {
+			c.breaks[cmd.addr] = true
+		} else {
+			delete(c.breaks, cmd.addr)
+		}
+		list := make([]uint16, 0, len(c.breaks))
+		for addr := range c.breaks {
+			list = append(list, addr)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+		c.breakList.Store(&list)
+	case cmdWait:
+		if c.state == Running {
+			c.waiters = append(c.waiters, cmd.stopped)
+		} else {
+			close(cmd.stopped)
+		}
+	case cmdListen:
+		c.listeners = append(c.listeners, cmd.listen)
+	case cmdEdit:
+		err := cmd.edit(c.cpu)
+		c.notify("")
+		return err
+	case cmdSpeed:
+		if cmd.clock > 0 {
+			c.setClock(1000 / cmd.clock)
+		} else {
+			c.setClock(0)
+		}
+		c.notify("Speed set to " + FormatSpeed(c.hz()))
+	}
+	return nil
+}
+
+// ready tells whether the program can execute, reporting why not otherwise
+func (c *Controller) ready() bool {
+	switch c.state {
+	case Idle:
+		c.notify("ERROR: No program loaded.")
+		return false
+	case Halted, Faulted:
+		c.notify(fmt.Sprintf("CPU %s. Press Reset or Load to run the program again.", c.state))
+		return false
+	}
+	return true
+}
+
+// Set the clock delay in milliseconds, restarting the speed measurement
+func (c *Controller) setClock(ms float64) {
+	if ms < 0 {
+		ms = 0
+	}
+	c.cpu.Clock = ms
+	if c.state == Running {
+		c.startClock()
+	}
+}
+
+// hz returns the target speed in instructions per second, 0 for as fast as
+// possible
+func (c *Controller) hz() float64 {
+	if c.cpu.Clock <= 0 {
+		return 0
+	}
+	return 1000 / c.cpu.Clock
+}
+
+// runSlice executes the instructions due since the program was started, or
+// as many as fit in one slice when running as fast as possible. A host too
+// slow for the target speed catches up in later slices.
+func (c *Controller) runSlice() {
+	deadline := time.Now().Add(slice)
+	due := uint64(math.MaxUint64)
+	if hz := c.hz(); hz > 0 && c.until == nil {
+		due = uint64(hz * time.Since(c.runStart).Seconds())
+	}
+	for n := 0; c.state == Running && c.executed < due; n++ {
+		// Reading the time costs more than an instruction
+		if n%256 == 255 && time.Now().After(deadline) {
+			break
+		}
+		if c.breaks[c.cpu.PC] && !c.resumed {
+			c.setState(Paused, fmt.Sprintf("Breakpoint. PC = x%04x, SP = x%04x, Flag = %t", c.cpu.PC, c.cpu.SP, c.cpu.Flag))
+			break
+		}
+		c.resumed = false
+		op := c.opcode()
+		c.execute()
+		c.executed++
+		if c.until != nil && c.state == Running && c.until.reached(c.cpu, op) {
+			c.setState(Paused, fmt.Sprintf("%s. PC = x%04x, SP = x%04x, Flag = %t", c.until.what, c.cpu.PC, c.cpu.SP, c.cpu.Flag))
+		}
+	}
+	if elapsed := time.Since(c.runStart).Seconds(); elapsed > 0 {
+		c.speed.Store(math.Float64bits(float64(c.executed) / elapsed))
+	}
+}
+
+// execute runs one instruction and moves to Halted or Faulted when the CPU
+// stops. Memory accesses outside of memory fault instead of panicking.
+func (c *Controller) execute() {
+	cpu := c.cpu
+	pc := cpu.PC
+	if int(pc) >= len(cpu.Memory) {
+		c.setState(Faulted, fmt.Sprintf("PC x%04x is past the end of memory.", pc))
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			cpu.Fault = fmt.Sprintf("bad memory access at x%04x: %v", pc, err)
+			c.setState(Faulted, "Fault: "+cpu.Fault)
+		}
+	}()
+	cpu.RunFlag = true
+	cpu.FetchInstruction(cpu.Memory)
+	stopped := !cpu.RunFlag
+	cpu.RunFlag = false
+	c.forwardStatus()
+	switch {
+	case cpu.Fault != "":
+		c.setState(Faulted, "Fault: "+cpu.Fault)
+	case stopped && cpu.Halted:
+		c.setState(Halted, "")
+	}
+}
+
+// Pass on the messages the CPU sent while executing
+func (c *Controller) forwardStatus() {
+	for {
+		select {
+		case s := <-c.cpu.CPUStatus:
+			c.notify(s)
+		default:
+			return
+		}
+	}
+}
+
+// Move to state s, running the scheduler only while Running
+func (c *Controller) setState(s State, status string) {
+	c.resumed = s == Running
+	c.state = s
+	c.current.Store(int32(s))
+	if s == Running {
+		c.startClock()
+	} else {
+		c.stopClock()
+	}
+	c.notify(status)
+	if s != Running {
+		c.until = nil
+		for _, w := range c.waiters {
+			close(w)
+		}
+		c.waiters = nil
+	}
+}
+
+func (c *Controller) startClock() {
+	c.stopClock()
+	c.ticker = time.NewTicker(slice)
+	c.runStart = time.Now()
+	c.executed = 0
+	c.speed.Store(0)
+}
+
+func (c *Controller) stopClock() {
+	if c.ticker != nil {
+		c.ticker.Stop()
+		c.ticker = nil
+	}
+}
+
+// Publish a snapshot and tell the listeners about it
+func (c *Controller) notify(status string) {
+	snap := c.cpu.Snapshot()
+	c.published.Store(snap)
+	c.lastFrame = time.Now()
+	c.shown = c.executed
+	e := Event{State: c.state, Status: status, Snapshot: snap, Speed: c.Speed()}
+	for _, l := range c.listeners {
+		l(e)
+	}
+}
+
+// FormatSpeed returns hz in Hz, kHz or MHz, or "full speed" for 0
+func FormatSpeed(hz float64) string {
+	switch {
+	case hz <= 0:
+		return "full speed"
+	case hz >= 1e6:
+		return fmt.Sprintf("%.2f MHz", hz/1e6)
+	case hz >= 1e3:
+		return fmt.Sprintf("%.2f kHz", hz/1e3)
+	}
+	return fmt.Sprintf("%.2f Hz", hz)
+}
@@ -0,0 +1,271 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/progfile"
+)
+
+// Sums the numbers from 1 to 10
+var sum = []byte{
+	0x00, 0x81, 0xa0, 0x0a, 0x81, 0xa2, 0x01, 0x81, 0xa4, 0xe0,
+	0x80, 0xa1, 0x22, 0x81, 0xa0, 0x82, 0xa1, 0x44, 0x81, 0xa2,
+	0xc1, 0x80, 0xa1, 0x11,
+}
+
+// newController returns a controller whose events are sent to the channel
+func newController(t *testing.T) (*Controller, chan Event) {
+	events := make(chan Event, 1000)
+	c := New(&cpusimple.CPU{}, func(e Event) { events <- e })
+	t.Cleanup(c.Close)
+	return c, events
+}
+
+// waitFor returns the first event in state s
+func waitFor(t *testing.T, events chan Event, s State) Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.State == s {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("Want: %s Got: timeout", s)
+		}
+	}
+}
+
+func TestRunToHalt(t *testing.T) {
+	fmt.Println("TestRunToHalt")
+	c, events := newController(t)
+	c.Start()
+	if e := <-events; e.State != Idle || e.Status != "ERROR: No program loaded." {
+		t.Fatalf("Want: no program error Got: %v", e)
+	}
+	if err := c.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: sum}})); err != nil {
+		t.Fatal(err)
+	}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		c.Start() // Repeated starts must not add clock goroutines
+	}
+	waitFor(t, events, Halted)
+	if runtime.NumGoroutine() > before {
+		t.Fatalf("Want: at most %d goroutines Got: %d", before, runtime.NumGoroutine())
+	}
+	c.Pause() // Nothing to pause once halted
+	c.Step()
+	if r0 := c.Snapshot().Registers[0]; r0 != 55 || c.State() != Halted {
+		t.Fatalf("Want: %d halted Got: %d %s", 55, r0, c.State())
+	}
+	c.Reset()
+	if e := waitFor(t, events, Paused); e.Status != "CPU reset, program reloaded." || e.Snapshot.PC != 0 {
+		t.Fatalf("Want: program reloaded at x0000 Got: %q at x%04x", e.Status, e.Snapshot.PC)
+	}
+}
+
+func TestStepAndPause(t *testing.T) {
+	fmt.Println("TestStepAndPause")
+	c, events := newController(t)
+	c.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: sum}}))
+	for i := 0; i < 3; i++ {
+		c.Step()
+	}
+	if pc := c.Snapshot().PC; pc != 3 {
+		t.Fatalf("Want: PC x0003 Got: x%04x", pc)
+	}
+	c.SetClock(50)
+	c.Start()
+	c.Pause()
+	waitFor(t, events, Paused)
+	if pc := c.Snapshot().PC; pc > 4 {
+		t.Fatalf("Want: paused within one instruction Got: PC x%04x", pc)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	fmt.Println("TestFaults")
+	for code, want := range map[string]string{
+		"\x1f":         "Fault: undefined instruction x1f at x0000",
+		"\x13\xff\xff": "Fault: bad memory access at x0000: runtime error: slice bounds out of range [65535:256]",
+	} {
+		c, events := newController(t)
+		c.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: []byte(code)}}))
+		c.Start()
+		if e := waitFor(t, events, Faulted); e.Status != want {
+			t.Fatalf("Want: %s Got: %s", want, e.Status)
+		}
+		c.Step()
+		if e := <-events; e.Status != "CPU faulted. Press Reset or Load to run the program again." {
+			t.Fatalf("Want: step refused Got: %s", e.Status)
+		}
+	}
+}
+
+// Counts R0 down from n to 0, two instructions per iteration, then halts
+func countdown(n uint16) []byte {
+	return []byte{
+		0x01, 0x81, 0xa0, // R1 = 1
+		cpusimple.XSET, byte(n >> 8), byte(n),
+		0xe0, 0x40, 0xc1, // Loop: R0 -= R1 until R0 == 0
+		cpusimple.HALT,
+	}
+}
+
+func TestSpeed(t *testing.T) {
+	fmt.Println("TestSpeed")
+	c, events := newController(t)
+	c.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: countdown(60000)}}))
+	c.SetSpeed(0)
+	start := time.Now()
+	c.Start()
+	waitFor(t, events, Halted)
+	// 120000 instructions would take two minutes at one per millisecond
+	if r0 := c.Snapshot().Registers[0]; r0 != 0 || time.Since(start) > 2*time.Second {
+		t.Fatalf("Want: R0 0 in under 2s Got: %d in %s", r0, time.Since(start))
+	}
+
+	// 1.5 ms is no longer truncated to 1 ms
+	c.Reset()
+	c.SetClock(1.5)
+	c.Start()
+	time.Sleep(500 * time.Millisecond)
+	c.Pause()
+	if speed := c.Speed(); speed < 600 || speed > 733 {
+		t.Fatalf("Want: about 667 Hz Got: %.0f Hz", speed)
+	}
+	if got := FormatSpeed(2.5e6); got != "2.50 MHz" {
+		t.Fatalf("Want: 2.50 MHz Got: %s", got)
+	}
+}
+
+func TestFrameRate(t *testing.T) {
+	fmt.Println("TestFrameRate")
+	c, events := newController(t)
+	c.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: countdown(60000)}}))
+	c.SetSpeed(1000)
+	for len(events) > 0 {
+		<-events
+	}
+	c.Start()
+	time.Sleep(500 * time.Millisecond)
+	c.Pause()
+	// One event per 10 ms slice would be 50
+	frames := 0
+	for e := <-events; e.State != Paused; e = <-events {
+		if e.State == Running && e.Status == "" {
+			frames++
+		}
+	}
+	if frames < 5 || frames > 20 {
+		t.Fatalf("Want: about 15 frames Got: %d", frames)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	fmt.Println("TestRunContext")
+	c, _ := newController(t)
+	if _, err := c.RunContext(context.Background()); err == nil || err.Error() != "cannot run: CPU idle" {
+		t.Fatalf("Want: cannot run: CPU idle Got: %v", err)
+	}
+	c.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: sum}}))
+	if e, err := c.RunContext(context.Background()); err != nil || e.State != Halted || e.Snapshot.Registers[0] != 55 {
+		t.Fatalf("Want: halted with R0 55 Got: %v %s %d", err, e.State, e.Snapshot.Registers[0])
+	}
+
+	// An endless loop is paused when the deadline passes
+	c.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: []byte{0x00, 0xe0, 0xc0}}}))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	e, err := c.RunContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || e.State != Paused || e.Snapshot.PC != 2 {
+		t.Fatalf("Want: paused at x0002 by the deadline Got: %v %s at x%04x", err, e.State, e.Snapshot.PC)
+	}
+}
+
+// Calls a subroutine at x0008, which calls another at x0010
+var calls = []byte{
+	cpusimple.CALL, 0x00, 0x08, 0x01, cpusimple.HALT, 0x10, 0x10, 0x10,
+	0x81, 0x02, cpusimple.CALL, 0x00, 0x10, 0xa1, cpusimple.RET, 0x10,
+	0x03, cpusimple.RET,
+}
+
+func TestStepping(t *testing.T) {
+	fmt.Println("TestStepping")
+	c, events := newController(t)
+	c.SetClock(1000) // Stepping commands ignore the clock
+	c.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: calls}}))
+	c.StepOver()
+	if s := c.Snapshot(); s.PC != 3 || c.State() != Paused {
+		t.Fatalf("Want: paused at x0003 Got: %s at x%04x", c.State(), s.PC)
+	}
+	c.StepOver()
+	if pc := c.Snapshot().PC; pc != 4 {
+		t.Fatalf("Want: x0004 Got: x%04x", pc)
+	}
+
+	c.Reset()
+	c.Step()
+	c.Step()
+	c.StepOut()
+	if pc := c.Snapshot().PC; pc != 3 {
+		t.Fatalf("Want: stepped out to x0003 Got: x%04x", pc)
+	}
+
+	c.Reset()
+	c.RunTo(0x10)
+	if s := c.Snapshot(); s.PC != 0x10 || s.Registers[0] != 2 {
+		t.Fatalf("Want: x0010 with R0 2 Got: x%04x with R0 %d", s.PC, s.Registers[0])
+	}
+	for len(events) > 0 {
+		<-events
+	}
+	c.StepN(3)
+	e := waitFor(t, events, Paused)
+	if want := "Stepped 3 instructions. PC = x000e, SP = x00fc, Flag = false"; e.Status != want {
+		t.Fatalf("Want: %s Got: %s", want, e.Status)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	fmt.Println("TestBreakpoints")
+	c, events := newController(t)
+	c.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: sum}}))
+	c.SetBreakpoint(0x0c)
+	c.SetBreakpoint(0x03)
+	c.ClearBreakpoint(0x03)
+	if got := fmt.Sprint(c.Breakpoints()); got != "[12]" {
+		t.Fatalf("Want: [12] Got: %s", got)
+	}
+	for len(events) > 0 {
+		<-events
+	}
+	// The loop passes the breakpoint once per iteration
+	for i := 0; i < 3; i++ {
+		c.Start()
+		if e := waitFor(t, events, Paused); e.Snapshot.PC != 0x0c || e.Status != "Breakpoint. PC = x000c, SP = x00fe, Flag = false" {
+			t.Fatalf("Want: breakpoint at x000c Got: %q", e.Status)
+		}
+	}
+	c.ClearBreakpoint(0x0c)
+	err := c.Edit(func(cpu *cpusimple.CPU) error {
+		cpu.Registers[2] = 1 // Last iteration
+		return nil
+	})
+	if err != nil || c.Snapshot().Registers[2] != 1 {
+		t.Fatalf("Want: R2 1 Got: %v %d", err, c.Snapshot().Registers[2])
+	}
+	late := make(chan Event, 1000)
+	c.Listen(func(e Event) { late <- e })
+	c.Start()
+	waitFor(t, events, Halted)
+	// A listener added after New gets the events too
+	waitFor(t, late, Halted)
+}
@@ -0,0 +1,21 @@
+module chrisriddick.net/controller
+
+go 1.21.6
+
+require (
+	chrisriddick.net/cpusimple v0.0.0
+	chrisriddick.net/progfile v0.0.0
+)
+
+require (
+	chrisriddick.net/disasm v0.0.0 // indirect
+	chrisriddick.net/symbols v0.0.0 // indirect
+)
+
+replace chrisriddick.net/cpusimple v0.0.0 => ../cpusimple
+
+replace chrisriddick.net/disasm v0.0.0 => ../disasm
+
+replace chrisriddick.net/progfile v0.0.0 => ../progfile
+
+replace chrisriddick.net/symbols v0.0.0 => ../symbols
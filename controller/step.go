@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"fmt"
+
+	"chrisriddick.net/cpusimple"
+)
+
+// until is the condition ending a step over, step out, step N or run to
+// address. Until it is met the program runs at full speed, like a debugger.
+type until struct {
+	what  string // Status message when the condition is met
+	steps uint64 // Instructions left to execute, 0 when not counting
+	addr  int    // Stop when the PC gets here, -1 for any address
+	sp    int    // ... with SP at this value, -1 for any SP
+	outOf int    // Stop once a RET sets SP above this, -1 when not stepping out
+}
+
+// StepOver executes one instruction, running a called subroutine to its
+// return as a single step
+func (c *Controller) StepOver() { c.send(command{kind: cmdStepOver}) }
+
+// StepOut runs until the current subroutine returns
+func (c *Controller) StepOut() { c.send(command{kind: cmdStepOut}) }
+
+// StepN executes n instructions
+func (c *Controller) StepN(n uint64) { c.send(command{kind: cmdStepN, steps: n}) }
+
+// RunTo runs until the PC reaches addr
+func (c *Controller) RunTo(addr uint16) { c.send(command{kind: cmdRunTo, addr: addr}) }
+
+// newUntil returns the stop condition of a stepping command
+func (c *Controller) newUntil(cmd command) *until {
+	cpu := c.cpu
+	u := &until{addr: -1, sp: -1, outOf: -1}
+	switch cmd.kind {
+	case cmdStepOver:
+		u.what = "Stepped over"
+		if c.opcode() == cpusimple.CALL {
+			// Stop at the return address with the stack as it was, so a
+			// recursive call returning there does not count
+			u.addr, u.sp = int(cpu.PC)+3, int(cpu.SP)
+		} else {
+			u.steps = 1
+		}
+	case cmdStepOut:
+		u.what = "Stepped out"
+		u.outOf = int(cpu.SP)
+	case cmdStepN:
+		u.what = fmt.Sprintf("Stepped %d instructions", cmd.steps)
+		u.steps = cmd.steps
+	case cmdRunTo:
+		u.what = fmt.Sprintf("Reached x%04x", cmd.addr)
+		u.addr = int(cmd.addr)
+	}
+	return u
+}
+
+// reached tells whether the condition is met after executing op
+func (u *until) reached(cpu *cpusimple.CPU, op byte) bool {
+	if u.steps > 0 {
+		u.steps--
+		if u.steps == 0 {
+			return true
+		}
+	}
+	if u.addr >= 0 && int(cpu.PC) == u.addr && (u.sp < 0 || int(cpu.SP) == u.sp) {
+		return true
+	}
+	return u.outOf >= 0 && op == cpusimple.RET && int(cpu.SP) > u.outOf
+}
+
+// runUntil runs the program until u is met. The first slice is run at once,
+// so short steps are done when the command returns.
+func (c *Controller) runUntil(u *until) {
+	c.setState(Running, "")
+	c.until = u
+	c.runSlice()
+	if c.state == Running {
+		c.notify("")
+	}
+}
+
+// opcode returns the instruction at the PC, 0 when the PC is outside of
+// memory
+func (c *Controller) opcode() byte {
+	if int(c.cpu.PC) < len(c.cpu.Memory) {
+		return c.cpu.Memory[c.cpu.PC]
+	}
+	return 0
+}
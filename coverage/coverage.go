@@ -0,0 +1,180 @@
+// Package coverage reports which bytes of a program were executed, read and
+// written, from the Coverage flags a CPU records for each byte of memory.
+// Recording costs a few instructions per memory access, so it can be left on
+// during normal runs.
+package coverage
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/disasm"
+	"chrisriddick.net/progfile"
+	"chrisriddick.net/symbols"
+)
+
+// Enable makes cpu record coverage from now on. The flags are cleared by
+// CPU.Reset and follow the size of memory when a program is loaded.
+func Enable(cpu *cpusimple.CPU) {
+	cpu.Coverage = make([]byte, len(cpu.Memory))
+}
+
+// Range is a run of addresses, End included
+type Range struct {
+	Start, End uint16
+}
+
+func (r Range) String() string {
+	if r.Start == r.End {
+		return fmt.Sprintf("x%04x", r.Start)
+	}
+	return fmt.Sprintf("x%04x-x%04x", r.Start, r.End)
+}
+
+// Summary counts the instructions of a program that were executed and the
+// bytes of memory read and written. Missed lists the code never executed.
+type Summary struct {
+	Instructions int
+	Executed     int
+	Read         int
+	Written      int
+	Missed       []Range
+}
+
+// Summarize decodes the segments of the program in memory as instructions
+// and counts those whose first byte was executed according to cov. Data
+// placed in a segment counts as instructions never executed.
+func Summarize(memory, cov []byte, segments []progfile.Segment) *Summary {
+	s := &Summary{}
+	for _, seg := range segments {
+		for _, ins := range disasm.Disassemble(memory, seg.Addr, uint16(int(seg.Addr)+len(seg.Data))) {
+			s.Instructions++
+			if flags(cov, ins.Address)&cpusimple.CoverExecuted != 0 {
+				s.Executed++
+				continue
+			}
+			end := ins.Address + uint16(len(ins.Bytes)) - 1
+			if n := len(s.Missed); n > 0 && s.Missed[n-1].End+1 == ins.Address {
+				s.Missed[n-1].End = end
+			} else {
+				s.Missed = append(s.Missed, Range{ins.Address, end})
+			}
+		}
+	}
+	for _, f := range cov {
+		if f&cpusimple.CoverRead != 0 {
+			s.Read++
+		}
+		if f&cpusimple.CoverWritten != 0 {
+			s.Written++
+		}
+	}
+	return s
+}
+
+// Percent returns the share of the instructions that were executed
+func (s *Summary) Percent() float64 {
+	if s.Instructions == 0 {
+		return 0
+	}
+	return float64(s.Executed) * 100 / float64(s.Instructions)
+}
+
+// WriteText prints the summary in three lines
+func (s *Summary) WriteText(w io.Writer) error {
+	missed := "none"
+	if len(s.Missed) > 0 {
+		var list []string
+		for _, r := range s.Missed {
+			list = append(list, r.String())
+		}
+		missed = strings.Join(list, ", ")
+	}
+	_, err := fmt.Fprintf(w, "Coverage: %d of %d instructions executed (%.1f%%)\nBytes read: %d, written: %d\nNever executed: %s\n",
+		s.Executed, s.Instructions, s.Percent(), s.Read, s.Written, missed)
+	return err
+}
+
+// Return the flags of addr, 0 past the end of cov
+func flags(cov []byte, addr uint16) byte {
+	if int(addr) >= len(cov) {
+		return 0
+	}
+	return cov[addr]
+}
+
+// Flags returns the column marking size bytes from addr in a listing, as
+// "xrw" when one of them was executed, read and written, with a - for each
+// use none of them had. It is blank for a size of 0.
+func Flags(cov []byte, addr uint16, size int) string {
+	if size == 0 {
+		return "    "
+	}
+	var f byte
+	for i := 0; i < size; i++ {
+		f |= flags(cov, addr+uint16(i))
+	}
+	mark := []byte("--- ")
+	for i, c := range []byte("xrw") {
+		if f&(1<<i) != 0 {
+			mark[i] = c
+		}
+	}
+	return string(mark)
+}
+
+// WriteListing writes the disassembly of the segments of the program in
+// memory with the Flags of each instruction in front. Operands and
+// addresses are named from the symbol map, which may be nil.
+func WriteListing(w io.Writer, memory, cov []byte, segments []progfile.Segment, m *symbols.Map) error {
+	for _, seg := range segments {
+		list := disasm.Disassemble(memory, seg.Addr, uint16(int(seg.Addr)+len(seg.Data)))
+		disasm.Annotate(list, m)
+		for _, ins := range list {
+			if name, ok := m.Lookup(ins.Address); ok {
+				if _, err := fmt.Fprintf(w, "%s%s:\n", Flags(cov, 0, 0), name); err != nil {
+					return err
+				}
+			}
+			if _, err := fmt.Fprintf(w, "%s%s\n", Flags(cov, ins.Address, len(ins.Bytes)), ins); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Grid formats the flags like the memory grid of CPU.GetAllMemory, to be
+// shown in its place, with the Mark of each byte
+func Grid(cov []byte) string {
+	var b strings.Builder
+	b.WriteString("       00 01 02 03 04 05 06 07 08 09 0a 0b 0c 0d 0e 0f\n")
+	for k := 0; k < len(cov); k += 16 {
+		fmt.Fprintf(&b, "%04x:  ", k)
+		for i := k; i < k+16 && i < len(cov); i++ {
+			b.WriteString(Mark(cov[i]))
+			b.WriteByte(' ')
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Mark returns the flags of one byte in two characters: x when executed, r
+// when read, . when neither, followed by w when written and . otherwise. An
+// executed byte that was also read shows as executed.
+func Mark(f byte) string {
+	use, write := byte('.'), byte('.')
+	switch {
+	case f&cpusimple.CoverExecuted != 0:
+		use = 'x'
+	case f&cpusimple.CoverRead != 0:
+		use = 'r'
+	}
+	if f&cpusimple.CoverWritten != 0 {
+		write = 'w'
+	}
+	return string([]byte{use, write})
+}
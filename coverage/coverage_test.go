@@ -0,0 +1,79 @@
+package coverage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/progfile"
+	"chrisriddick.net/symbols"
+)
+
+// SET 1, STORE x0010, HALT, then SET 2 and SET 3 never reached
+var program = []byte{0x01, cpusimple.STORE, 0x00, 0x10, cpusimple.HALT, 0x02, 0x03}
+
+// Run program to the end with coverage recorded
+func run(t *testing.T) (*cpusimple.CPU, []progfile.Segment) {
+	cpu := &cpusimple.CPU{}
+	Enable(cpu)
+	segs := []progfile.Segment{{Addr: 0, Data: program}}
+	f := progfile.New(segs)
+	f.MemorySize = 32
+	f.StackHead = 29
+	if err := f.Configure(cpu); err != nil {
+		t.Fatal(err)
+	}
+	cpu.RunContext(context.Background())
+	if !cpu.Halted {
+		t.Fatalf("Want: halted Got: %q", cpu.Fault)
+	}
+	return cpu, segs
+}
+
+func TestSummary(t *testing.T) {
+	fmt.Println("TestSummary")
+	cpu, segs := run(t)
+	if len(cpu.Coverage) != 32 {
+		t.Fatalf("Want: coverage of 32 bytes Got: %d", len(cpu.Coverage))
+	}
+	s := Summarize(cpu.Memory, cpu.Coverage, segs)
+	var text strings.Builder
+	s.WriteText(&text)
+	want := `Coverage: 3 of 5 instructions executed (60.0%)
+Bytes read: 0, written: 2
+Never executed: x0005-x0006
+`
+	if text.String() != want {
+		t.Fatalf("Want: %s Got: %s", want, text.String())
+	}
+}
+
+func TestListing(t *testing.T) {
+	fmt.Println("TestListing")
+	cpu, segs := run(t)
+	var text strings.Builder
+	m := symbols.New([]symbols.Symbol{{Name: "result", Kind: symbols.KindAddress, Value: 0x10}, {Name: "dead", Kind: symbols.KindAddress, Value: 5}})
+	if err := WriteListing(&text, cpu.Memory, cpu.Coverage, segs, m); err != nil {
+		t.Fatal(err)
+	}
+	want := `x-- 0000:  01         set 1
+x-- 0001:  12 00 10   store result
+x-- 0004:  11         halt
+    dead:
+--- 0005:  02         set 2
+--- 0006:  03         set 3
+`
+	if text.String() != want {
+		t.Fatalf("Want:\n%s\nGot:\n%s", want, text.String())
+	}
+	if got := Flags(cpu.Coverage, 0x0f, 2); got != "--w " {
+		t.Fatalf("Want: --w Got: %q", got)
+	}
+
+	grid := strings.Split(Grid(cpu.Coverage), "\n")
+	if grid[1] != "0000:  x. x. x. x. x. .. .. .. .. .. .. .. .. .. .. .. " || !strings.HasPrefix(grid[2], "0010:  .w .w .. ") {
+		t.Fatalf("Want: executed code and written result Got:\n%s\n%s", grid[1], grid[2])
+	}
+}
@@ -0,0 +1,18 @@
+module chrisriddick.net/coverage
+
+go 1.21.6
+
+require (
+	chrisriddick.net/cpusimple v0.0.0
+	chrisriddick.net/disasm v0.0.0
+	chrisriddick.net/progfile v0.0.0
+	chrisriddick.net/symbols v0.0.0
+)
+
+replace chrisriddick.net/cpusimple v0.0.0 => ../cpusimple
+
+replace chrisriddick.net/disasm v0.0.0 => ../disasm
+
+replace chrisriddick.net/progfile v0.0.0 => ../progfile
+
+replace chrisriddick.net/symbols v0.0.0 => ../symbols
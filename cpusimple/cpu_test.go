@@ -2,10 +2,13 @@ package cpusimple
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestSum1To10(t *testing.T) {
@@ -144,6 +147,55 @@ func TestSum1To100(t *testing.T) {
 	}
 }
 
+func TestGotoAndLabel(t *testing.T) {
+	fmt.Println("TestGotoAndLabel")
+	// LABEL 0, SET 1, GOTO 0 if R0 == 0, SET 2
+	code := []byte{0xe0, 0x01, 0xc0, 0x02}
+	cpu := CPU{}
+	cpu.InitMemory(100)
+	cpu.InitStack(100 - 1)
+	cpu.Reset()
+	cpu.Preprocess(code, uint16(len(code)))
+	// LABEL executes as nothing, where the CPU used to stay on it forever
+	cpu.FetchInstruction(code)
+	if cpu.PC != 1 {
+		t.Fatalf("Want: PC x0001 after LABEL Got: x%04x", cpu.PC)
+	}
+	// A GOTO not taken goes on with the next instruction, as it always did
+	cpu.FetchInstruction(code)
+	cpu.FetchInstruction(code)
+	if cpu.PC != 3 {
+		t.Fatalf("Want: PC x0003 after GOTO not taken Got: x%04x", cpu.PC)
+	}
+	// A taken GOTO goes on with the instruction after the LABEL, which used
+	// to be skipped
+	cpu.Registers[0] = 0
+	cpu.PC = 2
+	cpu.FetchInstruction(code)
+	if cpu.PC != 1 {
+		t.Fatalf("Want: PC x0001 after GOTO taken Got: x%04x", cpu.PC)
+	}
+}
+
+func TestStopWithoutStatusReader(t *testing.T) {
+	fmt.Println("TestStopWithoutStatusReader")
+	// HALT and an undefined instruction stop the CPU, and no longer block
+	// when nobody reads the status channel
+	cpu := CPU{CPUStatus: make(chan string)}
+	for _, op := range []byte{HALT, 0x1f} {
+		cpu.RunFlag = true
+		cpu.PC = 0
+		cpu.FetchInstruction([]byte{op})
+		if cpu.RunFlag {
+			t.Fatalf("Want: CPU stopped by x%02x Got: running", op)
+		}
+	}
+	// Run executes code until the PC leaves it
+	if res := cpu.Run([]byte{0x05}, 1); res != 5 {
+		t.Fatalf("Want: %d Got: %d", 5, res)
+	}
+}
+
 func TestSequence1To15(t *testing.T) {
 	fmt.Println("TestSequence1To15")
 	asmCode := []string{
@@ -311,6 +363,51 @@ func TestSequence1To15(t *testing.T) {
 	}
 }
 
+func TestSnapshot(t *testing.T) {
+	fmt.Println("TestSnapshot")
+	cpu := CPU{}
+	cpu.InitMemory(32)
+	cpu.InitStack(32 - 3)
+	cpu.Reset()
+	cpu.Load([]byte{0x05, 0x81, 0x11}, 3) // SET R0=5, PUSH R0, HALT
+	before := cpu.Snapshot()
+	cpu.RunFlag = true
+	for cpu.RunFlag {
+		cpu.FetchInstruction(cpu.Memory)
+	}
+	after := cpu.Snapshot()
+	if before.PC != 0 || before.Registers[0] != 0 || before.Memory[28] != 0 || before.GetStack() != "" {
+		t.Fatalf("Want: snapshot unchanged by execution Got: PC x%04x R0 %d", before.PC, before.Registers[0])
+	}
+	if !after.Halted || after.GetStack() != "001c: x0500\n" || after.GetRegisters() != cpu.GetRegisters() {
+		t.Fatalf("Want: halted with x0500 on the stack Got: %t %q", after.Halted, after.GetStack())
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	fmt.Println("TestStackOverflow")
+	// Pushes forever: LABEL 0, PUSH R0, GOTO 0 if R0 == 0
+	code := []byte{0xe0, 0x81, 0xc0}
+	cpu := CPU{}
+	cpu.InitMemory(100)
+	cpu.InitStack(100 - 1)
+	cpu.StackSize = 8
+	cpu.Run(code, uint16(len(code)))
+	if used := cpu.StackHead + 2 - cpu.SP; used != 8 || cpu.RunFlag {
+		t.Fatalf("Want: CPU stopped with 8 bytes of stack Got: %d bytes", used)
+	}
+	if cpu.Fault != "stack overflow at x0001" || cpu.PC != 1 {
+		t.Fatalf("Want: stack overflow at x0001 Got: %q at x%04x", cpu.Fault, cpu.PC)
+	}
+
+	// Calls itself forever: CALL x0002 at x0002
+	code = []byte{0x10, 0x10, CALL, 0x00, 0x02}
+	cpu.Run(code, uint16(len(code)))
+	if cpu.Fault != "stack overflow at x0002" || cpu.PC != 2 || len(cpu.Calls) != 4 {
+		t.Fatalf("Want: stack overflow at x0002 after 4 calls Got: %q at x%04x after %d", cpu.Fault, cpu.PC, len(cpu.Calls))
+	}
+}
+
 // TODO: Needs debugging and tuning
 /*********
 func TestSequence1To10000(t *testing.T) {
@@ -567,3 +664,136 @@ func TestSequence1To10000(t *testing.T) {
 	}
 }
 *******/
+
+func TestRunContext(t *testing.T) {
+	fmt.Println("TestRunContext")
+	cpu := CPU{}
+	cpu.InitMemory(64)
+	cpu.InitStack(64 - 3)
+	cpu.Reset()
+	forever := AsmCodeToBytes([]string{"set_0", "label_0", "goto_0_0"})
+	cpu.Load(forever, len(forever))
+	cpu.Preprocess(cpu.Memory, uint16(len(forever)))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cpu.RunContext(ctx); !errors.Is(err, context.DeadlineExceeded) || cpu.RunFlag || cpu.PC != 2 {
+		t.Fatalf("Want: deadline exceeded at x0002 Got: %v at x%04x", err, cpu.PC)
+	}
+
+	cpu.Reset()
+	cpu.Load([]byte{0x05, HALT}, 2)
+	if err := cpu.RunContext(context.Background()); err != nil || !cpu.Halted || cpu.Registers[0] != 5 {
+		t.Fatalf("Want: halted with R0 5 Got: %v %t %d", err, cpu.Halted, cpu.Registers[0])
+	}
+}
+
+func TestDetectLoops(t *testing.T) {
+	fmt.Println("TestDetectLoops")
+	tests := []struct {
+		code []string
+		loop string
+	}{
+		{[]string{"set_0", "label_0", "goto_0_0"}, "x0002-x0002"},
+		// Pushing and popping the same value leaves memory as it was
+		{[]string{"set_5", "label_0", "push_0", "pop_0", "goto_0_1"}, "x0002-x0004"},
+		// Counting down changes R0, so this loop ends by itself
+		{[]string{"set_1", "push_0", "pop_1", "set_20", "label_0", "sub_1", "goto_0_1"}, ""},
+	}
+	for _, test := range tests {
+		cpu := CPU{DetectLoops: true}
+		cpu.InitMemory(64)
+		cpu.InitStack(64 - 3)
+		cpu.Reset()
+		code := AsmCodeToBytes(test.code)
+		cpu.Load(code, len(code))
+		cpu.Preprocess(cpu.Memory, uint16(len(code)))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := cpu.RunContext(ctx)
+		cancel()
+		if err != nil || cpu.Loop != test.loop {
+			t.Fatalf("Want: loop %q Got: %q %v", test.loop, cpu.Loop, err)
+		}
+		if test.loop != "" && cpu.Fault != "endless loop at "+test.loop+": an iteration changes nothing" {
+			t.Fatalf("Want: endless loop fault Got: %q", cpu.Fault)
+		}
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	fmt.Println("TestCoverage")
+	cpu := CPU{Coverage: []byte{}}
+	cpu.InitMemory(32)
+	cpu.InitStack(32 - 3)
+	cpu.Reset()
+	// XSET x1234, STORE x0010, LOAD x0010, PUSH R0, HALT, then SET 1 never reached
+	code := []byte{XSET, 0x12, 0x34, STORE, 0x00, 0x10, LOAD, 0x00, 0x10, 0x81, HALT, 0x01}
+	cpu.Load(code, len(code))
+	if len(cpu.Coverage) != 32 {
+		t.Fatalf("Want: coverage of 32 bytes Got: %d", len(cpu.Coverage))
+	}
+	cpu.RunContext(context.Background())
+	for addr, want := range map[int]byte{
+		0: CoverExecuted, 2: CoverExecuted, 10: CoverExecuted, 11: 0,
+		0x10: CoverRead | CoverWritten, 0x11: CoverRead | CoverWritten,
+		0x1c: CoverWritten, 0x1d: CoverWritten, 0x1e: 0,
+	} {
+		if cpu.Coverage[addr] != want {
+			t.Fatalf("Want: x%04x flags %03b Got: %03b", addr, want, cpu.Coverage[addr])
+		}
+	}
+	if s := cpu.Snapshot(); !bytes.Equal(s.Coverage, cpu.Coverage) {
+		t.Fatalf("Want: coverage in the snapshot Got: %v", s.Coverage)
+	}
+	cpu.Reset()
+	if !bytes.Equal(cpu.Coverage, make([]byte, 32)) {
+		t.Fatalf("Want: coverage cleared by Reset Got: %v", cpu.Coverage)
+	}
+}
+
+func TestCallStack(t *testing.T) {
+	fmt.Println("TestCallStack")
+	cpu := CPU{}
+	cpu.InitMemory(32)
+	cpu.InitStack(32 - 3)
+	cpu.Reset()
+	// CALL x0008, HALT; at x0008 CALL x0010, RET; at x0010 RET
+	code := []byte{CALL, 0x00, 0x08, HALT, 0, 0, 0, 0, CALL, 0x00, 0x10, RET, 0, 0, 0, 0, RET}
+	cpu.Load(code, len(code))
+	cpu.FetchInstruction(cpu.Memory)
+	cpu.FetchInstruction(cpu.Memory)
+	want := []Frame{{Site: 0, Target: 8, SP: 28}, {Site: 8, Target: 0x10, SP: 26}}
+	if fmt.Sprint(cpu.Calls) != fmt.Sprint(want) {
+		t.Fatalf("Want: %v Got: %v", want, cpu.Calls)
+	}
+	if stack := cpu.Snapshot().GetStack(); stack != "001a: x0b00  return\n001c: x0300  return\n" {
+		t.Fatalf("Want: two return addresses Got: %q", stack)
+	}
+	cpu.RunContext(context.Background())
+	if !cpu.Halted || len(cpu.Calls) != 0 || len(cpu.Warnings) != 0 {
+		t.Fatalf("Want: halted with no calls or warnings Got: %t %v %v", cpu.Halted, cpu.Calls, cpu.Warnings)
+	}
+
+	// Returning with data on the stack pops R0 as the return address, x0001,
+	// and the same code then returns with no call left
+	status := make(chan string, 10)
+	cpu = CPU{CPUStatus: status}
+	cpu.InitMemory(32)
+	cpu.InitStack(32 - 3)
+	cpu.Reset()
+	code = []byte{CALL, 0x00, 0x04, 0x81, 0x01, 0x81, RET}
+	cpu.Load(code, len(code))
+	for i := 0; i < 11; i++ {
+		cpu.FetchInstruction(cpu.Memory)
+	}
+	want2 := []string{"RET at x0006 does not pop the return address of the CALL at x0000", "RET without a matching CALL at x0006"}
+	if fmt.Sprint(cpu.Warnings) != fmt.Sprint(want2) {
+		t.Fatalf("Want: %q Got: %q", want2, cpu.Warnings)
+	}
+	if s := <-status; s != "Warning: "+want2[0]+"." {
+		t.Fatalf("Want: warning status Got: %q", s)
+	}
+	cpu.Reset()
+	if cpu.Calls != nil || cpu.Warnings != nil {
+		t.Fatalf("Want: no calls or warnings after Reset Got: %v %v", cpu.Calls, cpu.Warnings)
+	}
+}
@@ -1,6 +1,7 @@
 package cpusimple
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"log"
@@ -33,6 +34,13 @@ const (
 	XSET         = 0x18 // R0 <-- Set R0 to value in next two bytes (big endian)
 )
 
+// Flags of Coverage, telling how a memory byte was used
+const (
+	CoverExecuted = 1 << iota // Fetched as an instruction or its operand
+	CoverRead                 // Read as data by LOAD, POP or RET
+	CoverWritten              // Written by STORE, PUSH or CALL
+)
+
 var logger *log.Logger
 
 // var errorLogger *log.Logger
@@ -45,11 +53,42 @@ type CPU struct {
 	SP        uint16 // Stack pointer
 	Flag      bool   // Processor flag
 	RunFlag   bool   // Tells cpuclock that it is active
+	Halted    bool   // Set when a HALT instruction stopped the CPU
+	Fault     string // Why the CPU stopped on an error, empty otherwise
 	Memory    []byte
-	StackHead uint16 // Starting index of stack in Memory array
-	StackSize uint16
-	Clock     float64     // clock delay in seconds. If = 0, full speed
+	StackHead uint16      // Starting index of stack in Memory array
+	StackSize uint16      // Bytes the stack may grow to, 0 for no limit
+	Clock     float64     // clock delay in milliseconds. If = 0, full speed
 	CPUStatus chan string // Channel for passing status to monitor goroutines
+
+	DetectLoops bool                     // Stop with a fault when an iteration of a loop changes nothing
+	Trace       func(pc uint16, op byte) // Called before each instruction, for profilers; nil by default
+	Coverage    []byte                   // Cover flags of each memory byte, recorded when not nil
+	Calls       []Frame                  // Shadow call stack kept by CALL and RET, innermost call last
+	Warnings    []string                 // Suspicious events such as a RET without a matching CALL, the first maxWarnings kept
+	Loop        string                   // Addresses of the endless loop that stopped the CPU, empty otherwise
+	loops       map[uint16]loopState
+	changes     uint64 // Number of memory writes that changed a byte
+}
+
+// Frame is a subroutine call on the shadow call stack
+type Frame struct {
+	Site   uint16 // Address of the CALL instruction
+	Target uint16 // Address of the subroutine
+	SP     uint16 // Stack pointer to the return address pushed by the CALL
+}
+
+// Number of warnings kept in CPU.Warnings, so a program returning without
+// calls in a loop cannot use up memory
+const maxWarnings = 10
+
+// loopState is the machine state when a backward GOTO was last taken to an
+// address. Finding it unchanged the next time means the loop never ends.
+type loopState struct {
+	registers [17]uint16
+	flag      bool
+	sp        uint16
+	changes   uint64
 }
 
 // FetchInstruction is a dispatcher function, which takes care of properly
@@ -59,6 +98,10 @@ type CPU struct {
 // when it is done. Fetch aslways assumes it is pointing at the next instruction.
 func (c *CPU) FetchInstruction(code []byte) {
 	instruction := code[c.PC]
+	if c.Trace != nil {
+		c.Trace(c.PC, instruction)
+	}
+	c.cover(c.PC, 1, CoverExecuted)
 	// c.PC++
 	opt := instruction & MaskExtended
 	if opt == 0x10 {
@@ -94,7 +137,9 @@ func (c *CPU) FetchInstruction(code []byte) {
 		} else {
 			reg = (instruction&0x1e)>>1 + 1
 		}
-		c.pushRegOnStack(reg)
+		if !c.pushRegOnStack(reg) {
+			return // Stay at the PUSH that overflowed the stack
+		}
 		c.PC++
 	case MaskPop: // POP
 		opt := instruction & 0x01
@@ -110,16 +155,18 @@ func (c *CPU) FetchInstruction(code []byte) {
 		opt := instruction & 0x01
 		if opt == 1 { // R0 != 0
 			if c.Registers[0] != 0 {
-				c.PC = c.Labels[(instruction&0x1e)>>1]
+				c.jump(c.Labels[(instruction&0x1e)>>1])
+				return
 			}
 		} else { // R0 == 0
 			if c.Registers[0] == 0 {
-				c.PC = c.Labels[(instruction&0x1e)>>1]
+				c.jump(c.Labels[(instruction&0x1e)>>1])
+				return
 			}
 		}
 		c.PC++
 	case MaskLabel: // LABEL
-		break
+		c.PC++ // Labels are resolved by Preprocess, nothing to execute
 	}
 }
 
@@ -130,8 +177,9 @@ func (c *CPU) ProcessExtendedOpCode(instruction byte) {
 	switch op {
 	case HALT:
 		//logger.Println("HALT instruction")
-		c.CPUStatus <- "HALT instruction encountered."
+		c.sendStatus("HALT instruction encountered.")
 		c.RunFlag = false
+		c.Halted = true
 		c.PC++
 	case NOOP:
 		//logger.Println("NOOP instruction")
@@ -140,13 +188,14 @@ func (c *CPU) ProcessExtendedOpCode(instruction byte) {
 		// Stores the two bytes of R0 at the location specified by the next two bytes from the PC
 		// Use Big-Endian for storing.
 		c.PC++ // First get the destination address
+		c.cover(c.PC, 2, CoverExecuted)
 		addr := binary.BigEndian.Uint16(c.Memory[c.PC:])
 		b := make([]byte, 2)
 		binary.BigEndian.PutUint16(b[0:], c.Registers[0])
 		// Push Hi byte
-		c.Memory[addr] = b[0]   // Hi byte
-		c.Memory[addr+1] = b[1] // Lo byte
-		c.PC = c.PC + 2         // Point to next instruction
+		c.write(addr, b[0])   // Hi byte
+		c.write(addr+1, b[1]) // Lo byte
+		c.PC = c.PC + 2       // Point to next instruction
 		// PC now points to next instruction
 		//logger.Println("STORE instruction")
 	case LOAD:
@@ -154,8 +203,10 @@ func (c *CPU) ProcessExtendedOpCode(instruction byte) {
 		// Loads the two bytes starting at location addressed by next two bytes into R0
 		// PC currently points to next byte in memory
 		c.PC++ // Point to the operand
+		c.cover(c.PC, 2, CoverExecuted)
 		loc := binary.BigEndian.Uint16(c.Memory[c.PC:])
 		c.Registers[0] = binary.BigEndian.Uint16(c.Memory[loc:])
+		c.cover(loc, 2, CoverRead)
 		//logger.Printf("R0 = x%04x", c.Registers[0])
 		c.PC = c.PC + 2 // Point to next instruction
 		//logger.Printf("LOAD Memory address retrieved: x%04x, PC = x%04x", loc, c.PC)
@@ -165,6 +216,7 @@ func (c *CPU) ProcessExtendedOpCode(instruction byte) {
 		// Rx specified by hi nibble, Ry by lo nibble of next byte
 		//logger.Printf("SWAP: PC = x%04x", c.PC)
 		c.PC++
+		c.cover(c.PC, 1, CoverExecuted)
 		regs := c.Memory[c.PC]
 		//logger.Printf("SWAP: regs = x%02x", regs)
 		rx := regs >> 4
@@ -177,15 +229,19 @@ func (c *CPU) ProcessExtendedOpCode(instruction byte) {
 	case CALL:
 		//logger.Println("CALL instruction")
 		// Jump to subroutine at address pointed to by PC,PC++, pushing PC+2 onto stack
-		c.PC++                                                 // Point to the CALL operand
-		subroutine := binary.BigEndian.Uint16(c.Memory[c.PC:]) // Address of subroutine
-		c.PC = c.PC + 2                                        // Skip past operand
-		c.pushPCOnStack()                                      // Push the return address on the stack
-		c.PC = subroutine                                      // Jump to subroutine
+		c.cover(c.PC+1, 2, CoverExecuted)
+		subroutine := binary.BigEndian.Uint16(c.Memory[c.PC+1:]) // Address of subroutine
+		if !c.pushPCOnStack(c.PC + 3) {                          // Push the return address, past the operand
+			return // Stay at the CALL that overflowed the stack
+		}
+		c.Calls = append(c.Calls, Frame{Site: c.PC, Target: subroutine, SP: c.SP})
+		c.PC = subroutine // Jump to subroutine
 	case RET:
 		//logger.Println("RET instruction")
 		// Return from subroutine by popping the return address off the stack and setting PC to that value
+		site, sp := c.PC, c.SP
 		c.popPCFromStack() // PC now points to the next instruction after returning
+		c.returnFrom(site, sp)
 	case CMP:
 		//logger.Println("CMP instruction")
 		// Compare contents of R0 with contents of R1 and set CPU Flag to true if matched or false if not
@@ -199,13 +255,16 @@ func (c *CPU) ProcessExtendedOpCode(instruction byte) {
 		//logger.Println("XSET instruction")
 		// Get next two bytes following this instruction in big endian and store in R0
 		c.PC++
+		c.cover(c.PC, 2, CoverExecuted)
 		rval := binary.BigEndian.Uint16(c.Memory[c.PC:])
 		c.Registers[0] = rval
 		// logger.Printf("Value retrieved at PC = x%04x", rval)
 		c.PC = c.PC + 2 // Point to next instruction
 	default:
 		//logger.Println("Undefined extended instruction, skipped.")
-		c.CPUStatus <- "Undefined extended instruction, execution halted."
+		c.sendStatus("Undefined extended instruction, execution halted.")
+		c.Fault = fmt.Sprintf("undefined instruction x%02x at x%04x", instruction, c.PC)
+		c.RunFlag = false
 	}
 }
 
@@ -225,9 +284,18 @@ func (c *CPU) Reset() {
 	c.PC = 0
 	c.SP = c.StackHead + 2
 	c.Flag = false
+	c.Halted = false
+	c.Fault = ""
+	c.Loop = ""
+	c.loops = nil
 	for i := 0; i < len(c.Memory); i++ {
 		c.Memory[i] = 0
 	}
+	for i := range c.Coverage {
+		c.Coverage[i] = 0
+	}
+	c.Calls = nil
+	c.Warnings = nil
 	for i := 0; i < 16; i++ {
 		c.Labels[i] = 0
 	}
@@ -236,13 +304,51 @@ func (c *CPU) Reset() {
 	}
 }
 
+// Run resolves the labels in code and executes it directly from the code
+// slice until the PC moves past the end of the code or the CPU stops.
+// Memory is only used for the stack. It returns R0.
+func (c *CPU) Run(code []byte, codeLength uint16) uint16 {
+	c.Reset()
+	c.Preprocess(code, codeLength)
+	c.RunFlag = true
+	for c.RunFlag && c.PC < codeLength {
+		c.FetchInstruction(code)
+	}
+	c.RunFlag = false
+	return c.Registers[0]
+}
+
+// RunContext executes the program in memory from the current PC until the
+// CPU stops, the PC moves past the end of memory or ctx is done. It returns
+// ctx.Err() when the context stopped it, leaving the CPU as it was so the
+// partial state can be examined.
+func (c *CPU) RunContext(ctx context.Context) error {
+	done := ctx.Done()
+	c.RunFlag = true
+	defer func() { c.RunFlag = false }()
+	for n := 0; c.RunFlag && int(c.PC) < len(c.Memory); n++ {
+		// Checking the context on every instruction would slow the CPU down
+		if n%1024 == 0 {
+			select {
+			case <-done:
+				return ctx.Err()
+			default:
+			}
+		}
+		c.FetchInstruction(c.Memory)
+	}
+	return nil
+}
+
 // Be sure there is a program in memory
 func (c *CPU) VerifyProgramInMemory() bool {
-	// Be sure that a program has been loaded by testing  the first two bytes
-	if (c.Memory[0] == 0) && (c.Memory[1] == 0) {
-		return false
+	// Programs may be loaded anywhere, so look for any non-zero byte
+	for _, b := range c.Memory {
+		if b != 0 {
+			return true
+		}
 	}
-	return true
+	return false
 }
 
 // Load Memory with preprocessed program
@@ -252,6 +358,15 @@ func (c *CPU) Load(program []byte, programLength int) {
 	}
 }
 
+// LoadSegment copies data into memory starting at addr
+func (c *CPU) LoadSegment(addr uint16, data []byte) error {
+	if int(addr)+len(data) > len(c.Memory) {
+		return fmt.Errorf("segment x%04x-x%04x does not fit in %d bytes of memory", addr, int(addr)+len(data)-1, len(c.Memory))
+	}
+	copy(c.Memory[addr:], data) // Loading is not a write of the program
+	return nil
+}
+
 // Translate a symbolic instruction mnemonic into a byte
 func asmToByte(s string) byte {
 	//logger.Println("Asm: " + s)
@@ -314,58 +429,82 @@ func AsmCodeToBytes(code []string) []byte {
 
 // GetMemory returns a 16 byte formatted string starting at provided index
 func (c *CPU) GetMemory(index uint16) string {
-	var line string
-	var i uint16
-	for i = index; i < index+16; i++ {
-		line = line + fmt.Sprintf("%02x ", c.Memory[i])
-	}
-	return line
+	return formatMemoryLine(c.Memory, index)
 }
 
 // GetAllMemory returns a 16 byte formatted string starting at 0000
 func (c *CPU) GetAllMemory() string {
-	var line string
-	blocks := len(c.Memory) / 16
-	remainder := len(c.Memory) % 16
-	// Send header line with memory locations
-	line = "       00 01 02 03 04 05 06 07 08 09 0a 0b 0c 0d 0e 0f\n"
-	k := 0
-	for j := 0; j < blocks; j++ {
-		line = line + fmt.Sprintf("%04x:  ", k)
-		for i := k; i < k+16; i++ {
-			line = line + fmt.Sprintf("%02x ", c.Memory[i])
-		}
-		line = line + "\n"
-		k = k + 16
-	}
-	if k >= len(c.Memory) {
-		return line
-	}
-	endBlock := blocks * 16
-	line = line + fmt.Sprintf("%04x:  ", k)
-	for i := endBlock; i < endBlock+remainder; i++ {
-		line = line + fmt.Sprintf("%02x ", c.Memory[i])
-	}
-	line = line + "\n"
-	return line
+	return formatMemory(c.Memory)
 }
 
 // GetStack returns a formatted string of 16 words (big-endian) beginning at SP down to Head
 func (c *CPU) GetStack() string {
-	var s string
-	for i := c.SP; i <= c.StackHead; i = i + 2 {
-		s = s + fmt.Sprintf("%04x: x%04x\n", i, binary.BigEndian.Uint16(c.Memory[i:]))
-	}
-	return s
+	return formatStack(c.Memory, c.SP, c.StackHead, c.Calls)
 }
 
 // GetRegisters returns a formatted string of register values
 func (c *CPU) GetRegisters() string {
-	var s string
-	for i := 0; i < len(c.Registers); i++ {
-		s = s + fmt.Sprintf("R%02d: x%04x\n", i, c.Registers[i])
+	return formatRegisters(c.Registers)
+}
+
+// Snapshot is a copy of the CPU state taken between instructions. It is
+// never modified, so any goroutine may read it while the CPU keeps running.
+type Snapshot struct {
+	Registers [17]uint16
+	Labels    [16]uint16
+	PC        uint16
+	SP        uint16
+	Flag      bool
+	Halted    bool
+	Fault     string
+	Memory    []byte
+	StackHead uint16
+	StackSize uint16
+	Clock     float64
+	Coverage  []byte // Nil when coverage is not recorded
+	Calls     []Frame
+	Warnings  []string
+}
+
+// Snapshot copies the CPU state. It must be called by the goroutine
+// executing instructions, or while the CPU is stopped.
+func (c *CPU) Snapshot() *Snapshot {
+	return &Snapshot{
+		Registers: c.Registers,
+		Labels:    c.Labels,
+		PC:        c.PC,
+		SP:        c.SP,
+		Flag:      c.Flag,
+		Halted:    c.Halted,
+		Fault:     c.Fault,
+		Memory:    append([]byte(nil), c.Memory...),
+		StackHead: c.StackHead,
+		StackSize: c.StackSize,
+		Clock:     c.Clock,
+		Coverage:  append([]byte(nil), c.Coverage...),
+		Calls:     append([]Frame(nil), c.Calls...),
+		Warnings:  append([]string(nil), c.Warnings...),
 	}
-	return s
+}
+
+// GetMemory is CPU.GetMemory for the snapshot
+func (s *Snapshot) GetMemory(index uint16) string {
+	return formatMemoryLine(s.Memory, index)
+}
+
+// GetAllMemory is CPU.GetAllMemory for the snapshot
+func (s *Snapshot) GetAllMemory() string {
+	return formatMemory(s.Memory)
+}
+
+// GetStack is CPU.GetStack for the snapshot
+func (s *Snapshot) GetStack() string {
+	return formatStack(s.Memory, s.SP, s.StackHead, s.Calls)
+}
+
+// GetRegisters is CPU.GetRegisters for the snapshot
+func (s *Snapshot) GetRegisters() string {
+	return formatRegisters(s.Registers)
 }
 
 // InitMemory expands Memory slice to specified size and initializes to all zeros
@@ -376,6 +515,9 @@ func (c *CPU) InitMemory(size uint16) {
 		tempSlice[i] = 0
 	}
 	c.Memory = append(c.Memory, tempSlice...)
+	if c.Coverage != nil {
+		c.Coverage = make([]byte, len(c.Memory))
+	}
 }
 
 // InitStack initializes the SP to the specified address
@@ -404,32 +546,134 @@ func NewCPU() *CPU {
 *
 ***********************/
 
-// Pushes the two bytes from specified register onto stack in Big Endian format
-func (c *CPU) pushRegOnStack(reg byte) {
+// Sends a status message to the monitor without blocking execution.
+// Messages are dropped when nobody is listening.
+func (c *CPU) sendStatus(s string) {
+	if c.CPUStatus == nil {
+		return
+	}
+	select {
+	case c.CPUStatus <- s:
+	default:
+	}
+}
+
+// Reports a stack overflow and stops the CPU when a push would grow the
+// stack past StackSize bytes. The pushing instruction is at PC, where the
+// CPU stays.
+func (c *CPU) stackFull() bool {
+	used := int(c.StackHead) + 2 - int(c.SP)
+	if c.StackSize == 0 || used+2 <= int(c.StackSize) {
+		return false
+	}
+	c.sendStatus(fmt.Sprintf("Stack overflow at PC x%04x.", c.PC))
+	c.Fault = fmt.Sprintf("stack overflow at x%04x", c.PC)
+	c.RunFlag = false
+	return true
+}
+
+// Pushes the two bytes from specified register onto stack in Big Endian format.
+// Returns false when the stack is full.
+func (c *CPU) pushRegOnStack(reg byte) bool {
+	if c.stackFull() {
+		return false
+	}
 	b := make([]byte, 2)
 	binary.BigEndian.PutUint16(b[0:], c.Registers[reg])
-	c.SP--                // Move SP to first available position
-	c.Memory[c.SP] = b[0] // Lo byte
+	c.SP--              // Move SP to first available position
+	c.write(c.SP, b[0]) // Lo byte
 	c.SP--
-	c.Memory[c.SP] = b[1] // Hi byte
+	c.write(c.SP, b[1]) // Hi byte
 	// SP now points to MSB of value
+	return true
 }
 
-// Pushes the two bytes from specified register onto stack in Big Endian format
-func (c *CPU) pushPCOnStack() {
+// Pushes the return address ret onto stack in Big Endian format.
+// Returns false when the stack is full.
+func (c *CPU) pushPCOnStack(ret uint16) bool {
+	if c.stackFull() {
+		return false
+	}
 	b := make([]byte, 2)
-	binary.BigEndian.PutUint16(b[0:], c.PC)
-	c.SP--                // Move SP to first available position
-	c.Memory[c.SP] = b[0] // Lo byte, Hi Addr
+	binary.BigEndian.PutUint16(b[0:], ret)
+	c.SP--              // Move SP to first available position
+	c.write(c.SP, b[0]) // Lo byte, Hi Addr
 	c.SP--
-	c.Memory[c.SP] = b[1] // Hi byte, Lo Addr
+	c.write(c.SP, b[1]) // Hi byte, Lo Addr
 	// SP now points to MSB of value
+	return true
+}
+
+// Removes the innermost call from the shadow call stack for the RET at pc,
+// which popped its return address at sp. Warns when there is no call to
+// return from, or when the RET does not pop the return address of the call.
+func (c *CPU) returnFrom(pc, sp uint16) {
+	n := len(c.Calls)
+	if n == 0 {
+		c.warn(fmt.Sprintf("RET without a matching CALL at x%04x", pc))
+		return
+	}
+	f := c.Calls[n-1]
+	c.Calls = c.Calls[:n-1]
+	if f.SP != sp {
+		c.warn(fmt.Sprintf("RET at x%04x does not pop the return address of the CALL at x%04x", pc, f.Site))
+	}
+}
+
+// Records a warning and reports it as a status message
+func (c *CPU) warn(s string) {
+	if len(c.Warnings) < maxWarnings {
+		c.Warnings = append(c.Warnings, s)
+	}
+	c.sendStatus("Warning: " + s + ".")
+}
+
+// Stores b in memory, counting the writes that change memory for the loop
+// detection
+func (c *CPU) write(addr uint16, b byte) {
+	c.cover(addr, 1, CoverWritten)
+	if c.Memory[addr] != b {
+		c.Memory[addr] = b
+		c.changes++
+	}
+}
+
+// Sets flag in the coverage of n bytes from addr, when coverage is recorded
+func (c *CPU) cover(addr uint16, n int, flag byte) {
+	for i := int(addr); i < int(addr)+n && i < len(c.Coverage); i++ {
+		c.Coverage[i] |= flag
+	}
+}
+
+// Moves the PC to a GOTO target. With DetectLoops, a backward jump finding
+// the registers, flag, stack pointer and memory as they were on the last
+// jump to the same target stops the CPU, since the loop would repeat the
+// same iteration forever.
+func (c *CPU) jump(target uint16) {
+	from := c.PC
+	c.PC = target
+	if !c.DetectLoops || target > from {
+		return
+	}
+	s := loopState{registers: c.Registers, flag: c.Flag, sp: c.SP, changes: c.changes}
+	if prev, ok := c.loops[target]; ok && prev == s {
+		c.Loop = fmt.Sprintf("x%04x-x%04x", target, from)
+		c.sendStatus(fmt.Sprintf("Endless loop at %s.", c.Loop))
+		c.Fault = fmt.Sprintf("endless loop at %s: an iteration changes nothing", c.Loop)
+		c.RunFlag = false
+		return
+	}
+	if c.loops == nil {
+		c.loops = make(map[uint16]loopState)
+	}
+	c.loops[target] = s
 }
 
 // Pops the two bytes from the stack into the specified register using the Big Endian format
 func (c *CPU) popRegFromStack(reg byte) {
 	// SP currently points to last value at top of stack
 	rval := binary.LittleEndian.Uint16(c.Memory[c.SP:])
+	c.cover(c.SP, 2, CoverRead)
 	//logger.Printf("Popped from stack, R%x = x%04x", reg, rval)
 	c.Registers[reg] = rval
 	c.SP = c.SP + 2
@@ -439,6 +683,71 @@ func (c *CPU) popRegFromStack(reg byte) {
 func (c *CPU) popPCFromStack() {
 	// SP currently points to last value at top of stack
 	c.PC = binary.LittleEndian.Uint16(c.Memory[c.SP:])
+	c.cover(c.SP, 2, CoverRead)
 	//logger.Printf("Popped from stack, PC = x%04x", c.PC)
 	c.SP = c.SP + 2
 }
+
+// Formats memory 16 bytes per line under a header of column offsets
+func formatMemory(memory []byte) string {
+	var line string
+	blocks := len(memory) / 16
+	remainder := len(memory) % 16
+	// Send header line with memory locations
+	line = "       00 01 02 03 04 05 06 07 08 09 0a 0b 0c 0d 0e 0f\n"
+	k := 0
+	for j := 0; j < blocks; j++ {
+		line = line + fmt.Sprintf("%04x:  ", k)
+		for i := k; i < k+16; i++ {
+			line = line + fmt.Sprintf("%02x ", memory[i])
+		}
+		line = line + "\n"
+		k = k + 16
+	}
+	if k >= len(memory) {
+		return line
+	}
+	endBlock := blocks * 16
+	line = line + fmt.Sprintf("%04x:  ", k)
+	for i := endBlock; i < endBlock+remainder; i++ {
+		line = line + fmt.Sprintf("%02x ", memory[i])
+	}
+	line = line + "\n"
+	return line
+}
+
+// Formats up to 16 bytes starting at index, stopping at the end of memory
+func formatMemoryLine(memory []byte, index uint16) string {
+	var line string
+	for i := int(index); i < int(index)+16 && i < len(memory); i++ {
+		line = line + fmt.Sprintf("%02x ", memory[i])
+	}
+	return line
+}
+
+// Formats the stack words from sp up to head, one per line, marking the
+// return addresses pushed by the calls
+func formatStack(memory []byte, sp, head uint16, calls []Frame) string {
+	returns := make(map[uint16]bool, len(calls))
+	for _, f := range calls {
+		returns[f.SP] = true
+	}
+	var s string
+	for i := sp; i <= head && int(i)+1 < len(memory); i = i + 2 {
+		s = s + fmt.Sprintf("%04x: x%04x", i, binary.BigEndian.Uint16(memory[i:]))
+		if returns[i] {
+			s = s + "  return"
+		}
+		s = s + "\n"
+	}
+	return s
+}
+
+// Formats the registers, one per line
+func formatRegisters(registers [17]uint16) string {
+	var s string
+	for i := 0; i < len(registers); i++ {
+		s = s + fmt.Sprintf("R%02d: x%04x\n", i, registers[i])
+	}
+	return s
+}
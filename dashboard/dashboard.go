@@ -3,19 +3,34 @@ package dashboard
 import (
 	"fmt"
 	"image/color"
+	"io"
 	"strconv"
+	"strings"
+	"sync"
 
 	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/disasm"
+	"chrisriddick.net/hexfile"
+	"chrisriddick.net/profile"
+	"chrisriddick.net/symbols"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/widget"
 )
 
+// Number of instructions shown in the code view before and after the PC
+const (
+	codeLinesBefore = 4
+	codeLinesAfter  = 11
+)
+
 var (
-	c                     *cpusimple.CPU
+	mu                    sync.Mutex          // Guards snap, symbolMap and clockShown, which listeners update from other goroutines
+	snap                  *cpusimple.Snapshot // Copy of the CPU state shown by UpdateAll
 	CPUStatus             string
 	sps, pcs, flag        *widget.Label
 	w                     fyne.Window
@@ -24,19 +39,33 @@ var (
 	flagDisplay           string
 	stackLabelWidget      *widget.Label
 	stackHeader           *widget.Label
+	callsHeader           *widget.Label
+	callsWidget           *widget.Label // Backtrace of the shadow call stack
 	registerHeader        *widget.Label
 	registerDisplay       string
 	registerDisplayWidget *widget.Label
-	memoryDisplay         string
-	memoryGridLabel       *widget.Label
+	coverageCheck         *widget.Check // Shows coverage in place of the memory bytes
 	memoryLabel           *widget.Label
+	codeDisplay           string
+	codeHeader            *widget.Label
+	codeDisplayWidget     *widget.Label
+	symbolMap             *symbols.Map
 	inputCPUClock         *widget.Entry
+	clockShown            string // Clock last shown in inputCPUClock, which was edited when it differs
 	loadButton            *widget.Button
 	runButton             *widget.Button
 	stepButton            *widget.Button
 	resetButton           *widget.Button
 	pauseButton           *widget.Button
 	exitButton            *widget.Button
+	symbolsButton         *widget.Button
+	openButton            *widget.Button
+	exportButton          *widget.Button
+	profileButton         *widget.Button
+	stepCountEntry        *widget.Entry
+	runToEntry            *widget.Entry
+	debugContainer        *fyne.Container
+	commandEntry          *widget.Entry
 	mainContainer         *fyne.Container
 	buttonsContainer      *fyne.Container
 	settingsContainer     *fyne.Container
@@ -44,18 +73,50 @@ var (
 	registerContainer     *fyne.Container
 	memoryContainer       *fyne.Container
 	stackContainer        *fyne.Container
+	codeContainer         *fyne.Container
 	cpuInternalsContainer *fyne.Container
 	speedContainer        *fyne.Container
 	centerContainer       *fyne.Container
 	middleContainer       *fyne.Container
 )
 
+// OpenProgram is called with a program file chosen with the Open button. The
+// button is hidden when it is nil.
+var OpenProgram func(name string, r io.Reader) error
+
+// SetClock is called with the clock delay in milliseconds entered with the
+// Save button, which is disabled when it is nil.
+var SetClock func(ms float64)
+
+// Stepping commands of the debugger row, hidden when StepOver is nil. StepN
+// is called with the count entered next to its button and RunTo with the
+// address or symbol entered next to its button.
+var (
+	StepOver func()
+	StepOut  func()
+	StepN    func(n uint64)
+	RunTo    func(addr uint16)
+)
+
+// Profile returns a report of the instructions executed so far, shown in a
+// window by the Profile button, which is hidden when it is nil. WritePprof
+// saves the profile in pprof format from the same window.
+var (
+	Profile    func() *profile.Report
+	WritePprof func(w io.Writer) error
+)
+
+// Command is called with each line entered in the monitor command entry
+// below the console. The entry is hidden when it is nil.
+var Command func(line string)
+
 var Console = container.NewVBox()
+var consoleMu sync.Mutex // Serializes writes to Console from listeners
 var ConsoleScroller = container.NewVScroll(Console)
 
 func New(cpu *cpusimple.CPU, reset func(), load func(), step func(), run func(), pause func(), exit func()) fyne.Window {
 
-	c = cpu // All data comes from the CPU structure object
+	snap = cpu.Snapshot() // All data comes from snapshots of the CPU
 	a := app.NewWithID("simpleCPU")
 	w = a.NewWindow("Simple CPU Simulator")
 
@@ -63,6 +124,7 @@ func New(cpu *cpusimple.CPU, reset func(), load func(), step func(), run func(),
 	registerBackground := canvas.NewRectangle(color.RGBA{R: 173, G: 219, B: 156, A: 200})
 	stackBackground := canvas.NewRectangle(color.RGBA{R: 173, G: 219, B: 156, A: 200})
 	memoryBackground := canvas.NewRectangle(color.RGBA{R: 223, G: 159, B: 173, A: 200})
+	codeBackground := canvas.NewRectangle(color.RGBA{R: 156, G: 196, B: 219, A: 200})
 
 	// Control buttons
 	loadButton = widget.NewButton("Load", load)
@@ -71,34 +133,86 @@ func New(cpu *cpusimple.CPU, reset func(), load func(), step func(), run func(),
 	resetButton = widget.NewButton("Reset", reset)
 	pauseButton = widget.NewButton("Pause", pause)
 	exitButton = widget.NewButton("Exit", exit)
+	symbolsButton = widget.NewButton("Symbols...", openSymbolMap)
+	openButton = widget.NewButton("Open...", openProgram)
+	if OpenProgram == nil {
+		openButton.Hide()
+	}
+	exportButton = widget.NewButton("Export...", exportMemory)
+	profileButton = widget.NewButton("Profile...", showProfile)
+	if Profile == nil {
+		profileButton.Hide()
+	}
+
+	// Debugger stepping line
+	stepCountEntry = widget.NewEntry()
+	stepCountEntry.SetText("10")
+	runToEntry = widget.NewEntry()
+	runToEntry.SetPlaceHolder("address or symbol")
+	debugContainer = container.NewHBox(
+		widget.NewButton("Step Over", StepOver),
+		widget.NewButton("Step Out", StepOut),
+		widget.NewButton("Step N", func() {
+			n, err := strconv.ParseUint(stepCountEntry.Text, 0, 64)
+			if err != nil {
+				SetStatus("ERROR: Step N needs a number of instructions.")
+				return
+			}
+			StepN(n)
+		}),
+		stepCountEntry,
+		widget.NewButton("Run To", func() {
+			addr, err := parseAddress(runToEntry.Text)
+			if err != nil {
+				SetStatus("ERROR: " + err.Error())
+				return
+			}
+			RunTo(addr)
+		}),
+		runToEntry,
+		layout.NewSpacer(),
+	)
+	if StepOver == nil {
+		debugContainer.Hide()
+	}
 
 	// Clock settings line
 	inputCPUClock = widget.NewEntry()
-	inputCPUClock.SetText("1")
+	inputCPUClock.SetText("0")
+	clockShown = inputCPUClock.Text
+	saveClock := func() {
+		ms, err := strconv.ParseFloat(inputCPUClock.Text, 64)
+		if err != nil {
+			SetStatus("ERROR: Save needs a number of milliseconds.")
+			return
+		}
+		mu.Lock()
+		clockShown = inputCPUClock.Text // Saved, so updates may replace it
+		mu.Unlock()
+		SetClock(ms)
+	}
+	saveClockButton := widget.NewButton("Save", saveClock)
+	if SetClock != nil {
+		inputCPUClock.OnSubmitted = func(string) { saveClock() }
+	}
+	if SetClock == nil {
+		saveClockButton.Disable()
+	}
 	speedContainer = container.NewHBox(
 		canvas.NewText("Clock Speed = ", color.Black),
 		inputCPUClock,
 		canvas.NewText("ms  ", color.Black),
-		widget.NewButton("Save", func() {
-			if s, err := strconv.ParseFloat(inputCPUClock.Text, 64); err == nil {
-				if s <= 1.0 {
-					cpu.Clock = 1 // ticker requires positive value >= 1
-				} else {
-					cpu.Clock = s
-				}
-			}
-			SetStatus(fmt.Sprintf("Clock set to %f milliseconds", cpu.Clock))
-		}),
-		canvas.NewText("Set clock speed in milliseconds. 1.0 sets clock to full speed.  ", color.Black),
+		saveClockButton,
+		canvas.NewText("Set the delay between instructions in milliseconds. 0 runs at full speed.  ", color.Black),
 		layout.NewSpacer(),
 	)
 
 	// CPU Internals: PC, SP
-	pcs = widget.NewLabel(fmt.Sprintf("PC: x%04x", cpu.PC))
+	pcs = widget.NewLabel(fmt.Sprintf("PC: x%04x", snap.PC))
 	pcs.TextStyle.Monospace = true
-	sps = widget.NewLabel(fmt.Sprintf("SP: x%04x", cpu.SP))
+	sps = widget.NewLabel(fmt.Sprintf("SP: x%04x", snap.SP))
 	sps.TextStyle.Monospace = true
-	flag = widget.NewLabel("Flag: false")
+	flag = widget.NewLabel(fmt.Sprintf("Flag: %t", snap.Flag))
 	flag.TextStyle.Monospace = true
 	cpuInternalsContainer = container.NewHBox(
 		pcs,
@@ -110,22 +224,29 @@ func New(cpu *cpusimple.CPU, reset func(), load func(), step func(), run func(),
 	stackHeader = widget.NewLabel("Top of Stack\n16-bit words\n(grows hi to lo)\n")
 	stackHeader.TextStyle.Monospace = true
 	stackHeader.TextStyle.Bold = true
-	stackDisplay = cpu.GetStack()
+	stackDisplay = snap.GetStack()
 	stackLabelWidget = widget.NewLabel(stackDisplay)
 	stackLabelWidget.TextStyle.Monospace = true
 	stackLabelWidget.TextStyle.Bold = true
+	callsHeader = widget.NewLabel("Calls\ninnermost first\n")
+	callsHeader.TextStyle.Monospace = true
+	callsHeader.TextStyle.Bold = true
+	callsWidget = widget.NewLabel(disasm.Backtrace(snap.PC, snap.Calls, symbolMap))
+	callsWidget.TextStyle.Monospace = true
 	stackContainer = container.NewStack(
 		stackBackground,
 		container.NewVBox(
 			stackHeader,
 			stackLabelWidget,
+			callsHeader,
+			callsWidget,
 		))
 
 	// Registers
 	registerHeader = widget.NewLabel("Registers\n16-bit words\n")
 	registerHeader.TextStyle.Monospace = true
 	registerHeader.TextStyle.Bold = true
-	registerDisplay = cpu.GetRegisters()
+	registerDisplay = snap.GetRegisters()
 	registerDisplayWidget = widget.NewLabel(registerDisplay)
 	registerDisplayWidget.TextStyle.Monospace = true
 	registerDisplayWidget.TextStyle.Bold = true
@@ -137,17 +258,32 @@ func New(cpu *cpusimple.CPU, reset func(), load func(), step func(), run func(),
 		))
 
 	// Memory
-	memoryDisplay = cpu.GetAllMemory()
-	memoryLabel = widget.NewLabel("Memory\nbytes\n")
+	memoryLabel = widget.NewLabel(memoryTitle())
 	memoryLabel.TextStyle.Monospace = true
 	memoryLabel.TextStyle.Bold = true
-	memoryGridLabel = widget.NewLabel(memoryDisplay)
-	memoryGridLabel.TextStyle.Monospace = true
+	coverageCheck = widget.NewCheck("Coverage", func(bool) { UpdateAll() })
+	if snap.Coverage == nil {
+		coverageCheck.Hide()
+	}
 	memoryContainer = container.NewStack(
 		memoryBackground,
+		container.NewBorder(
+			container.NewHBox(memoryLabel, layout.NewSpacer(), coverageCheck), nil, nil, nil,
+			newMemoryGrid(snap),
+		))
+
+	// Code view, disassembled around the PC
+	codeHeader = widget.NewLabel("Code\ndisassembled at PC\n")
+	codeHeader.TextStyle.Monospace = true
+	codeHeader.TextStyle.Bold = true
+	codeDisplay = codeWindow(snap)
+	codeDisplayWidget = widget.NewLabel(codeDisplay)
+	codeDisplayWidget.TextStyle.Monospace = true
+	codeContainer = container.NewStack(
+		codeBackground,
 		container.NewVBox(
-			memoryLabel,
-			memoryGridLabel,
+			codeHeader,
+			codeDisplayWidget,
 		))
 
 	buttonsContainer = container.NewHBox(
@@ -157,10 +293,15 @@ func New(cpu *cpusimple.CPU, reset func(), load func(), step func(), run func(),
 		stepButton,
 		pauseButton,
 		exitButton,
+		symbolsButton,
+		openButton,
+		exportButton,
+		profileButton,
 	)
 
 	settingsContainer = container.NewVBox(
 		buttonsContainer,
+		debugContainer,
 		speedContainer,
 		cpuInternalsContainer,
 	)
@@ -169,9 +310,21 @@ func New(cpu *cpusimple.CPU, reset func(), load func(), step func(), run func(),
 		registerContainer,
 		memoryContainer,
 		stackContainer,
+		codeContainer,
 	)
 
-	statusContainer = container.NewVBox(ConsoleScroller)
+	commandEntry = widget.NewEntry()
+	commandEntry.SetPlaceHolder("Monitor command, help for a list")
+	commandEntry.TextStyle.Monospace = true
+	commandEntry.OnSubmitted = func(line string) {
+		commandEntry.SetText("")
+		ConsoleWrite("> " + line)
+		Command(line)
+	}
+	if Command == nil {
+		commandEntry.Hide()
+	}
+	statusContainer = container.NewVBox(ConsoleScroller, commandEntry)
 	registerContainer = container.NewHBox(registerContainer)
 	centerContainer = container.NewHBox(memoryContainer, stackContainer)
 
@@ -186,9 +339,21 @@ func New(cpu *cpusimple.CPU, reset func(), load func(), step func(), run func(),
 	return w
 }
 
+// Update replaces the CPU state shown by the dashboard with s and redraws it.
+// It can be called from any goroutine.
+func Update(s *cpusimple.Snapshot) {
+	mu.Lock()
+	snap = s
+	mu.Unlock()
+	UpdateAll()
+}
+
 func UpdateAll() {
+	mu.Lock()
+	defer mu.Unlock()
 
 	// Reload
+	c := snap
 	pcs.SetText(fmt.Sprintf("PC: x%04x", c.PC))
 	sps.SetText(fmt.Sprintf("SP: x%04x", c.SP))
 	if c.Flag {
@@ -197,13 +362,25 @@ func UpdateAll() {
 		flagDisplay = "Flag: false"
 	}
 	flag.SetText(flagDisplay)
-	inputCPUClock.SetText(fmt.Sprintf("%3f", c.Clock))
+	// The clock entry is left alone while a new value is typed into it
+	if inputCPUClock.Text == clockShown && w.Canvas().Focused() != inputCPUClock {
+		clockShown = fmt.Sprintf("%3f", c.Clock)
+		inputCPUClock.SetText(clockShown)
+	}
 	stackDisplay = c.GetStack()
 	stackLabelWidget.Text = stackDisplay
-	memoryDisplay = c.GetAllMemory()
-	memoryGridLabel.SetText(memoryDisplay)
+	callsWidget.Text = disasm.Backtrace(c.PC, c.Calls, symbolMap)
+	overlay := coverageCheck.Checked && c.Coverage != nil
+	if overlay {
+		memoryLabel.SetText("Coverage\nx run, r read, w written\n")
+	} else {
+		memoryLabel.SetText(memoryTitle())
+	}
+	updateGrid(c, overlay)
 	registerDisplay = c.GetRegisters()
 	registerDisplayWidget.Text = registerDisplay
+	codeDisplay = codeWindow(c)
+	codeDisplayWidget.SetText(codeDisplay)
 
 	// Refresh
 	buttonsContainer.Refresh()
@@ -211,22 +388,192 @@ func UpdateAll() {
 	cpuInternalsContainer.Refresh()
 	settingsContainer.Refresh()
 	stackLabelWidget.Refresh()
+	callsWidget.Refresh()
 	stackContainer.Refresh()
-	memoryGridLabel.Refresh()
 	memoryContainer.Refresh()
 	registerContainer.Refresh()
+	codeContainer.Refresh()
 	middleContainer.Refresh()
 	statusContainer.Refresh()
 	centerContainer.Refresh()
 	mainContainer.Refresh()
 }
 
+// LoadSymbols sets the symbol map used to name addresses and labels in the code view
+func LoadSymbols(m *symbols.Map) {
+	mu.Lock()
+	defer mu.Unlock()
+	symbolMap = m
+	codeDisplay = codeWindow(snap)
+	codeDisplayWidget.SetText(codeDisplay)
+}
+
+// Ask for a symbol map file written by the assembler and load it
+func openSymbolMap() {
+	dialog.ShowFileOpen(func(r fyne.URIReadCloser, err error) {
+		if err != nil || r == nil {
+			return
+		}
+		defer r.Close()
+		m, err := symbols.Read(r)
+		if err != nil {
+			SetStatus("ERROR: " + err.Error())
+			return
+		}
+		LoadSymbols(m)
+		SetStatus(fmt.Sprintf("Loaded %d symbols from %s", len(m.Symbols), r.URI().Name()))
+	}, w)
+}
+
+// Ask for a program file and hand it to OpenProgram
+func openProgram() {
+	dialog.ShowFileOpen(func(r fyne.URIReadCloser, err error) {
+		if err != nil || r == nil {
+			return
+		}
+		defer r.Close()
+		if err := OpenProgram(r.URI().Name(), r); err != nil {
+			SetStatus("ERROR: " + err.Error())
+		}
+	}, w)
+}
+
+// Save memory up to the last non-zero byte as S-records when the file name
+// has an S-record extension, or as Intel HEX otherwise
+func exportMemory() {
+	dialog.ShowFileSave(func(wc fyne.URIWriteCloser, err error) {
+		if err != nil || wc == nil {
+			return
+		}
+		defer wc.Close()
+		mu.Lock()
+		c := snap
+		mu.Unlock()
+		end := len(c.Memory)
+		for end > 0 && c.Memory[end-1] == 0 {
+			end--
+		}
+		img := hexfile.FromMemory(c.Memory, 0, end)
+		name := wc.URI().Name()
+		if hexfile.IsSRecordName(name) {
+			err = img.WriteSRecord(wc, name)
+		} else {
+			err = img.WriteIntelHex(wc)
+		}
+		if err != nil {
+			SetStatus("ERROR: " + err.Error())
+			return
+		}
+		SetStatus(fmt.Sprintf("Exported %d bytes of memory to %s", end, name))
+	}, w)
+}
+
+// Show the profile report in a window of three tables
+func showProfile() {
+	r := Profile()
+	if r == nil {
+		return
+	}
+	share := func(n uint64) string {
+		if r.Total == 0 {
+			return "0.00%"
+		}
+		return fmt.Sprintf("%.2f%%", float64(n)*100/float64(r.Total))
+	}
+	hot := profileTable([]string{"Count", "Share", "Address", "Symbol", "Instruction"}, len(r.Hot), func(row int) []string {
+		c := r.Hot[row]
+		return []string{strconv.FormatUint(c.Count, 10), share(c.Count), fmt.Sprintf("x%04x", c.Addr), c.Name, c.Instruction}
+	})
+	subs := profileTable([]string{"Calls", "Self", "Total", "Share", "Address", "Symbol"}, len(r.Subroutines), func(row int) []string {
+		s := r.Subroutines[row]
+		return []string{strconv.FormatUint(s.Calls, 10), strconv.FormatUint(s.Self, 10), strconv.FormatUint(s.Total, 10), share(s.Total), fmt.Sprintf("x%04x", s.Addr), s.Name}
+	})
+	ops := profileTable([]string{"Count", "Share", "Mnemonic"}, len(r.Opcodes), func(row int) []string {
+		c := r.Opcodes[row]
+		return []string{strconv.FormatUint(c.Count, 10), share(c.Count), c.Name}
+	})
+
+	pw := fyne.CurrentApp().NewWindow("Profile")
+	save := widget.NewButton("Save pprof...", func() {
+		dialog.ShowFileSave(func(wc fyne.URIWriteCloser, err error) {
+			if err != nil || wc == nil {
+				return
+			}
+			defer wc.Close()
+			if err := WritePprof(wc); err != nil {
+				SetStatus("ERROR: " + err.Error())
+				return
+			}
+			SetStatus("Saved the profile to " + wc.URI().Name())
+		}, pw)
+	})
+	if WritePprof == nil {
+		save.Hide()
+	}
+	top := container.NewHBox(widget.NewLabel(fmt.Sprintf("Instructions executed: %d", r.Total)), layout.NewSpacer(), save)
+	tabs := container.NewAppTabs(
+		container.NewTabItem("Hot spots", hot),
+		container.NewTabItem("Subroutines", subs),
+		container.NewTabItem("Opcodes", ops),
+	)
+	pw.SetContent(container.NewBorder(top, nil, nil, nil, tabs))
+	pw.Resize(fyne.NewSize(640, 480))
+	pw.Show()
+}
+
+// profileTable returns a table with a header row, filled in by cells
+func profileTable(header []string, rows int, cells func(row int) []string) *widget.Table {
+	t := widget.NewTable(
+		func() (int, int) { return rows + 1, len(header) },
+		func() fyne.CanvasObject {
+			l := widget.NewLabel("")
+			l.TextStyle.Monospace = true
+			return l
+		},
+		func(id widget.TableCellID, o fyne.CanvasObject) {
+			l := o.(*widget.Label)
+			if id.Row == 0 {
+				l.SetText(header[id.Col])
+				return
+			}
+			l.SetText(cells(id.Row - 1)[id.Col])
+		})
+	for col, width := range []float32{90, 90, 90, 140, 200, 200}[:len(header)] {
+		t.SetColumnWidth(col, width)
+	}
+	return t
+}
+
+// codeWindow returns the disassembly of the instructions around the PC, with
+// the current instruction marked
+func codeWindow(c *cpusimple.Snapshot) string {
+	return disasm.Window(c.Memory, c.PC, symbolMap, codeLinesBefore, codeLinesAfter)
+}
+
+// parseAddress reads an address in decimal or 0x hex, or the name of a
+// symbol in the loaded symbol map
+func parseAddress(s string) (uint16, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseUint(s, 0, 16); err == nil {
+		return uint16(n), nil
+	}
+	mu.Lock()
+	m := symbolMap
+	mu.Unlock()
+	if addr, ok := m.Address(s); ok {
+		return addr, nil
+	}
+	return 0, fmt.Errorf("%q is neither an address nor a known symbol", s)
+}
+
 func SetStatus(s string) {
 	status = s
 	ConsoleWrite(status)
 }
 
 func ConsoleWrite(text string) {
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
 	Console.Add(&canvas.Text{
 		Text:      text,
 		Color:     color.Black,
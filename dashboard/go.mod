@@ -3,11 +3,17 @@ module chrisriddick.net/dashboard
 go 1.21.6
 
 require (
+	chrisriddick.net/coverage v0.0.0
 	chrisriddick.net/cpusimple v0.0.0
+	chrisriddick.net/disasm v0.0.0
+	chrisriddick.net/hexfile v0.0.0
+	chrisriddick.net/profile v0.0.0
+	chrisriddick.net/symbols v0.0.0
 	fyne.io/fyne/v2 v2.4.5
 )
 
 require (
+	chrisriddick.net/progfile v0.0.0 // indirect
 	fyne.io/systray v1.10.1-0.20231115130155-104f5ef7839e // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fredbi/uri v1.1.0 // indirect
@@ -37,4 +43,16 @@ require (
 	honnef.co/go/js/dom v0.0.0-20231112215516-51f43a291193 // indirect
 )
 
+replace chrisriddick.net/coverage v0.0.0 => ../coverage
+
 replace chrisriddick.net/cpusimple v0.0.0 => ../cpusimple
+
+replace chrisriddick.net/disasm v0.0.0 => ../disasm
+
+replace chrisriddick.net/hexfile v0.0.0 => ../hexfile
+
+replace chrisriddick.net/profile v0.0.0 => ../profile
+
+replace chrisriddick.net/progfile v0.0.0 => ../progfile
+
+replace chrisriddick.net/symbols v0.0.0 => ../symbols
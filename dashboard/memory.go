@@ -0,0 +1,271 @@
+package dashboard
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"strconv"
+	"strings"
+	"sync"
+
+	"chrisriddick.net/coverage"
+	"chrisriddick.net/cpusimple"
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Columns of the memory grid: 16 bytes and their ASCII text
+const (
+	gridBytes = 16
+	asciiCol  = gridBytes
+)
+
+// Backgrounds of the cells at the PC, at the SP and in the rest of the stack
+var (
+	pcColor    = color.RGBA{R: 255, G: 224, B: 102, A: 255}
+	spColor    = color.RGBA{R: 102, G: 178, B: 255, A: 255}
+	stackColor = color.RGBA{R: 178, G: 224, B: 255, A: 255}
+)
+
+// EditMemory is called with the bytes typed into the memory grid, to write
+// them at addr. The grid is read-only when it is nil.
+var EditMemory func(addr uint16, data []byte) error
+
+var (
+	memoryTable   *widget.Table
+	selectedLabel *widget.Label
+	byteEntry     *widget.Entry
+	gotoEntry     *widget.Entry
+	gridMu        sync.Mutex // Guards grid, read by the cell callbacks of memoryTable
+	grid          gridState
+	selected      = -1 // Address of the selected cell, -1 for none
+)
+
+// gridState is what the memory grid shows
+type gridState struct {
+	memory   []byte
+	coverage []byte // Shown in place of the bytes when not nil
+	pc, sp   uint16
+	head     uint16
+}
+
+// newMemoryGrid returns the memory grid with its edit and go-to entries
+// below it
+func newMemoryGrid(c *cpusimple.Snapshot) fyne.CanvasObject {
+	grid = gridState{memory: c.Memory, pc: c.PC, sp: c.SP, head: c.StackHead}
+	memoryTable = widget.NewTable(
+		func() (int, int) {
+			gridMu.Lock()
+			defer gridMu.Unlock()
+			return (len(grid.memory) + gridBytes - 1) / gridBytes, gridBytes + 1
+		},
+		func() fyne.CanvasObject {
+			l := widget.NewLabel("00")
+			l.TextStyle.Monospace = true
+			return container.NewStack(canvas.NewRectangle(color.Transparent), l)
+		},
+		updateCell)
+	memoryTable.ShowHeaderRow = true
+	memoryTable.ShowHeaderColumn = true
+	memoryTable.CreateHeader = func() fyne.CanvasObject {
+		l := widget.NewLabel("0000")
+		l.TextStyle.Monospace = true
+		l.TextStyle.Bold = true
+		return l
+	}
+	memoryTable.UpdateHeader = func(id widget.TableCellID, o fyne.CanvasObject) {
+		l := o.(*widget.Label)
+		switch {
+		case id.Row < 0 && id.Col == asciiCol:
+			l.SetText("ASCII")
+		case id.Row < 0 && id.Col >= 0:
+			l.SetText(fmt.Sprintf("%02x", id.Col))
+		case id.Col < 0 && id.Row >= 0:
+			l.SetText(fmt.Sprintf("%04x", id.Row*gridBytes))
+		default:
+			l.SetText("")
+		}
+	}
+	ascii := widget.NewLabel(strings.Repeat("W", gridBytes))
+	ascii.TextStyle.Monospace = true
+	memoryTable.SetColumnWidth(asciiCol, ascii.MinSize().Width)
+	memoryTable.OnSelected = selectCell
+
+	selectedLabel = widget.NewLabel("x----")
+	selectedLabel.TextStyle.Monospace = true
+	byteEntry = widget.NewEntry()
+	byteEntry.SetPlaceHolder("hex bytes")
+	byteEntry.OnSubmitted = writeBytes
+	if EditMemory == nil {
+		byteEntry.Disable()
+	}
+	gotoEntry = widget.NewEntry()
+	gotoEntry.SetPlaceHolder("address or symbol")
+	gotoEntry.OnSubmitted = func(string) { goToAddress() }
+	edit := container.NewBorder(nil, nil, selectedLabel, nil, byteEntry)
+	goTo := container.NewBorder(nil, nil, nil, widget.NewButton("Go", goToAddress), gotoEntry)
+
+	// The table only has the size of one cell unless it is given more
+	size := fyne.NewSize(ascii.MinSize().Width*4, ascii.MinSize().Height*14)
+	return container.NewBorder(nil, container.NewGridWithColumns(2, edit, goTo), nil, nil,
+		container.NewGridWrap(size, memoryTable))
+}
+
+// Title of the memory grid, telling whether its bytes can be edited
+func memoryTitle() string {
+	if EditMemory == nil {
+		return "Memory\nbytes\n"
+	}
+	return "Memory\nbytes, click one to edit\n"
+}
+
+// Show the byte, or its coverage, or the ASCII text of a row in a cell
+func updateCell(id widget.TableCellID, o fyne.CanvasObject) {
+	gridMu.Lock()
+	defer gridMu.Unlock()
+	cell := o.(*fyne.Container)
+	background := cell.Objects[0].(*canvas.Rectangle)
+	l := cell.Objects[1].(*widget.Label)
+	addr := id.Row*gridBytes + id.Col
+	if id.Col == asciiCol {
+		start := id.Row * gridBytes
+		end := min(start+gridBytes, len(grid.memory))
+		text := []byte(string(grid.memory[start:end]))
+		for i, b := range text {
+			if b < 0x20 || b > 0x7e {
+				text[i] = '.'
+			}
+		}
+		background.FillColor = color.Transparent
+		background.Refresh()
+		l.SetText(string(text))
+		return
+	}
+	switch {
+	case addr >= len(grid.memory):
+		l.SetText("")
+	case grid.coverage != nil:
+		l.SetText(coverage.Mark(grid.coverage[addr]))
+	default:
+		l.SetText(fmt.Sprintf("%02x", grid.memory[addr]))
+	}
+	switch {
+	case addr == int(grid.pc):
+		background.FillColor = pcColor
+	case addr == int(grid.sp):
+		background.FillColor = spColor
+	case addr > int(grid.sp) && addr <= int(grid.head)+1:
+		background.FillColor = stackColor
+	default:
+		background.FillColor = color.Transparent
+	}
+	background.Refresh()
+}
+
+// updateGrid shows the memory of snapshot c, redrawing the grid only when
+// something it shows changed. With overlay set the coverage of c is shown
+// in place of the bytes.
+func updateGrid(c *cpusimple.Snapshot, overlay bool) {
+	next := gridState{memory: c.Memory, pc: c.PC, sp: c.SP, head: c.StackHead}
+	if overlay {
+		next.coverage = c.Coverage
+	}
+	gridMu.Lock()
+	same := bytes.Equal(next.memory, grid.memory) && (next.coverage == nil) == (grid.coverage == nil) &&
+		bytes.Equal(next.coverage, grid.coverage) && next.pc == grid.pc && next.sp == grid.sp && next.head == grid.head
+	grid = next
+	gridMu.Unlock()
+	if !same {
+		memoryTable.Refresh()
+	}
+}
+
+// Remember the selected cell and show its byte in the entry, ready for a
+// new value to be typed
+func selectCell(id widget.TableCellID) {
+	col := min(id.Col, gridBytes-1)
+	gridMu.Lock()
+	addr := id.Row*gridBytes + col
+	if addr >= len(grid.memory) {
+		gridMu.Unlock()
+		return
+	}
+	value := grid.memory[addr]
+	gridMu.Unlock()
+	selected = addr
+	selectedLabel.SetText(fmt.Sprintf("x%04x", addr))
+	byteEntry.SetText("")
+	byteEntry.SetPlaceHolder(fmt.Sprintf("%02x", value))
+	if EditMemory != nil {
+		w.Canvas().Focus(byteEntry)
+	}
+}
+
+// Write the hex bytes typed in the entry at the selected cell and select the
+// cell after them, so bytes can be typed in one after the other
+func writeBytes(text string) {
+	if selected < 0 {
+		SetStatus("ERROR: select a memory cell first")
+		return
+	}
+	data, err := parseBytes(text)
+	if err != nil {
+		SetStatus("ERROR: " + err.Error())
+		return
+	}
+	if err := EditMemory(uint16(selected), data); err != nil {
+		SetStatus("ERROR: " + err.Error())
+		return
+	}
+	next := selected + len(data)
+	gridMu.Lock()
+	size := len(grid.memory)
+	gridMu.Unlock()
+	if next < size {
+		memoryTable.Select(widget.TableCellID{Row: next / gridBytes, Col: next % gridBytes})
+	}
+}
+
+// Select the cell at the address or symbol typed in the go-to entry
+func goToAddress() {
+	addr, err := parseAddress(gotoEntry.Text)
+	if err != nil {
+		SetStatus("ERROR: " + err.Error())
+		return
+	}
+	gridMu.Lock()
+	size := len(grid.memory)
+	gridMu.Unlock()
+	if int(addr) >= size {
+		SetStatus(fmt.Sprintf("ERROR: x%04x is past the end of memory", addr))
+		return
+	}
+	memoryTable.Select(widget.TableCellID{Row: int(addr) / gridBytes, Col: int(addr) % gridBytes})
+}
+
+// parseBytes reads bytes written as hex digits, two per byte, optionally
+// separated by spaces. A lone digit is a byte of its own.
+func parseBytes(text string) ([]byte, error) {
+	var data []byte
+	for _, field := range strings.Fields(text) {
+		if len(field) == 1 {
+			field = "0" + field
+		}
+		if len(field)%2 != 0 {
+			return nil, fmt.Errorf("invalid bytes %q, want pairs of hex digits", field)
+		}
+		for i := 0; i < len(field); i += 2 {
+			b, err := strconv.ParseUint(field[i:i+2], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid byte %q, want hex digits", field[i:i+2])
+			}
+			data = append(data, byte(b))
+		}
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no bytes to write")
+	}
+	return data, nil
+}
@@ -0,0 +1,373 @@
+package disasm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/symbols"
+)
+
+// Instruction is a single decoded machine instruction
+type Instruction struct {
+	Address   uint16 // Address of the first byte of the instruction
+	Bytes     []byte // Raw bytes making up the instruction, including operands
+	Mnemonic  string
+	Operands  string
+	Label     int    // Label number for GOTO and LABEL, -1 otherwise
+	Target    uint16 // Address referenced by GOTO, CALL, LOAD and STORE
+	HasTarget bool   // Tells whether Target holds a resolved address
+	Name      string // Symbol name of the target or label, set by Annotate
+}
+
+// Length returns the number of bytes an instruction starting with op occupies
+func Length(op byte) int {
+	if op&cpusimple.MaskExtended == 0 {
+		return 1
+	}
+	switch op & 0x1f {
+	case cpusimple.STORE, cpusimple.LOAD, cpusimple.CALL, cpusimple.XSET:
+		return 3
+	case cpusimple.SWAP:
+		return 2
+	}
+	return 1
+}
+
+// Decode translates the instruction at code[pc] into its symbolic form.
+// Labels is the label table used to resolve GOTO targets; it may be nil.
+// An instruction whose operands run past the end of code is returned as raw bytes.
+func Decode(code []byte, pc uint16, labels map[int]uint16) Instruction {
+	op := code[pc]
+	n := Length(op)
+	if int(pc)+n > len(code) {
+		return Instruction{Address: pc, Bytes: code[pc : pc+1], Mnemonic: ".byte", Operands: fmt.Sprintf("0x%02x", op), Label: -1}
+	}
+	ins := Instruction{Address: pc, Bytes: code[pc : int(pc)+n], Label: -1}
+	if op&cpusimple.MaskExtended == cpusimple.MaskExtended {
+		// The CPU treats any byte with this bit set as an extended instruction
+		decodeExtended(&ins, op&0x1f)
+		return ins
+	}
+	reg := (op&0x1e)>>1 + 1
+	switch op & 0xe0 {
+	case cpusimple.MaskSet:
+		ins.Mnemonic = "set"
+		ins.Operands = fmt.Sprintf("%d", op&0x1f)
+	case cpusimple.MaskAdd:
+		ins.Mnemonic = "add"
+		ins.Operands = fmt.Sprintf("r%d", reg)
+	case cpusimple.MaskSub:
+		ins.Mnemonic = "sub"
+		ins.Operands = fmt.Sprintf("r%d", reg)
+	case cpusimple.MaskMul:
+		ins.Mnemonic = "mul"
+		ins.Operands = fmt.Sprintf("r%d", reg)
+	case cpusimple.MaskPush, cpusimple.MaskPop:
+		ins.Mnemonic = "push"
+		if op&0xe0 == cpusimple.MaskPop {
+			ins.Mnemonic = "pop"
+		}
+		if op&0x01 == 1 {
+			reg = 0
+		}
+		ins.Operands = fmt.Sprintf("r%d", reg)
+	case cpusimple.MaskGoto:
+		ins.Mnemonic = "goto"
+		ins.Label = int((op & 0x1e) >> 1)
+		cond := "z"
+		if op&0x01 == 1 {
+			cond = "nz"
+		}
+		ins.Operands = fmt.Sprintf("%d, %s", ins.Label, cond)
+		if addr, ok := labels[ins.Label]; ok {
+			ins.Target = addr
+			ins.HasTarget = true
+		}
+	case cpusimple.MaskLabel:
+		ins.Mnemonic = "label"
+		ins.Label = int((op & 0x1e) >> 1)
+		ins.Operands = fmt.Sprintf("%d", ins.Label)
+	}
+	return ins
+}
+
+// Handle the extended instruction set, whose op codes all carry MaskExtended
+func decodeExtended(ins *Instruction, op byte) {
+	var word uint16
+	if len(ins.Bytes) == 3 {
+		word = binary.BigEndian.Uint16(ins.Bytes[1:])
+	}
+	switch op {
+	case cpusimple.NOOP:
+		ins.Mnemonic = "noop"
+	case cpusimple.HALT:
+		ins.Mnemonic = "halt"
+	case cpusimple.STORE:
+		ins.Mnemonic = "store"
+		ins.Operands = fmt.Sprintf("0x%04x", word)
+		ins.Target, ins.HasTarget = word, true
+	case cpusimple.LOAD:
+		ins.Mnemonic = "load"
+		ins.Operands = fmt.Sprintf("0x%04x", word)
+		ins.Target, ins.HasTarget = word, true
+	case cpusimple.CALL:
+		ins.Mnemonic = "call"
+		ins.Operands = fmt.Sprintf("0x%04x", word)
+		ins.Target, ins.HasTarget = word, true
+	case cpusimple.SWAP:
+		ins.Mnemonic = "swap"
+		ins.Operands = fmt.Sprintf("r%d, r%d", ins.Bytes[1]>>4, ins.Bytes[1]&0x0f)
+	case cpusimple.RET:
+		ins.Mnemonic = "ret"
+	case cpusimple.CMP:
+		ins.Mnemonic = "cmp"
+	case cpusimple.XSET:
+		ins.Mnemonic = "xset"
+		ins.Operands = fmt.Sprintf("0x%04x", word)
+	default:
+		ins.Mnemonic = ".byte"
+		ins.Operands = fmt.Sprintf("0x%02x", ins.Bytes[0])
+	}
+}
+
+// Labels walks code instruction by instruction and returns the address
+// execution continues at for every LABEL found, the same way CPU.Preprocess
+// does, but without mistaking operand bytes for labels.
+func Labels(code []byte) map[int]uint16 {
+	labels := make(map[int]uint16)
+	for pc := 0; pc < len(code); pc += Length(code[pc]) {
+		if code[pc]&0xf0 == cpusimple.MaskLabel {
+			labels[int((code[pc]&0x1e)>>1)] = uint16(pc + 1)
+		}
+	}
+	return labels
+}
+
+// Disassemble decodes every instruction in code[start:end]. Label numbers are
+// resolved against all LABEL instructions found in code.
+func Disassemble(code []byte, start, end uint16) []Instruction {
+	if int(end) > len(code) {
+		end = uint16(len(code))
+	}
+	labels := Labels(code)
+	var list []Instruction
+	for pc := start; pc < end; {
+		ins := Decode(code, pc, labels)
+		list = append(list, ins)
+		pc += uint16(len(ins.Bytes))
+	}
+	return list
+}
+
+// Text returns the instruction in assembler syntax
+func (ins Instruction) Text() string {
+	if ins.Operands == "" {
+		return ins.Mnemonic
+	}
+	return ins.Mnemonic + " " + ins.Operands
+}
+
+// String returns a listing line with address, raw bytes and assembler text
+func (ins Instruction) String() string {
+	var hex string
+	for _, b := range ins.Bytes {
+		hex = hex + fmt.Sprintf("%02x ", b)
+	}
+	line := fmt.Sprintf("%04x:  %-9s  %s", ins.Address, hex, ins.Text())
+	if ins.Mnemonic == "goto" && ins.HasTarget {
+		line = line + fmt.Sprintf("    ; -> x%04x", ins.Target)
+	}
+	return line
+}
+
+// Legacy returns the instruction in the underscore form understood by
+// cpusimple.AsmCodeToBytes. Extended instructions have no such form and
+// return false.
+func (ins Instruction) Legacy() (string, bool) {
+	switch ins.Mnemonic {
+	case "set", "label":
+		return ins.Mnemonic + "_" + ins.Operands, true
+	case "add", "sub", "mul", "push", "pop":
+		return ins.Mnemonic + "_" + strings.TrimPrefix(ins.Operands, "r"), true
+	case "goto":
+		opt := 0
+		if strings.HasSuffix(ins.Operands, "nz") {
+			opt = 1
+		}
+		return fmt.Sprintf("goto_%d_%d", ins.Label, opt), true
+	}
+	return "", false
+}
+
+// Annotate replaces raw addresses and label numbers in the operands with
+// the names found in the symbol map
+func Annotate(list []Instruction, m *symbols.Map) {
+	for i := range list {
+		ins := &list[i]
+		switch ins.Mnemonic {
+		case "call", "load", "store":
+			if name, ok := m.Lookup(ins.Target); ok {
+				ins.Name = name
+				ins.Operands = name
+			}
+		case "label", "goto":
+			name, ok := m.Label(ins.Label)
+			if !ok {
+				continue
+			}
+			ins.Name = name
+			ins.Operands = name
+			if ins.Mnemonic == "goto" {
+				if ins.Bytes[0]&0x01 == 1 {
+					ins.Operands = name + ", nz"
+				} else {
+					ins.Operands = name + ", z"
+				}
+			}
+		}
+	}
+}
+
+// Listing returns the formatted disassembly of code[start:end], one instruction per line
+func Listing(code []byte, start, end uint16) string {
+	return SymbolListing(code, start, end, nil)
+}
+
+// SymbolListing is Listing with operands named from the symbol map and a
+// "name:" line ahead of every instruction at a named address. A nil map
+// gives the plain listing.
+func SymbolListing(code []byte, start, end uint16, m *symbols.Map) string {
+	list := Disassemble(code, start, end)
+	Annotate(list, m)
+	var s string
+	for _, ins := range list {
+		if name, ok := m.Lookup(ins.Address); ok {
+			s = s + name + ":\n"
+		}
+		s = s + ins.String() + "\n"
+	}
+	return s
+}
+
+// Window returns the disassembly of the instructions around pc, from before
+// instructions ahead of it to after instructions past it, with "=> " marking
+// the instruction at pc. Operands and addresses are named from the symbol
+// map, which may be nil.
+//
+// The instruction at pc is always decoded from pc, so data placed ahead of
+// the code cannot shift it. The instructions ahead of it are decoded from
+// the nearest symbol, or address 0, whose instructions lead up to pc, or
+// else by stepping back over bytes that have the length of an instruction.
+func Window(code []byte, pc uint16, m *symbols.Map, before, after int) string {
+	if int(pc) >= len(code) {
+		return ""
+	}
+	labels := Labels(code)
+	list := instructionsBefore(code, pc, m, labels, before)
+	current := len(list)
+	for addr, n := int(pc), 0; addr < len(code) && n <= after; n++ {
+		ins := Decode(code, uint16(addr), labels)
+		list = append(list, ins)
+		addr += len(ins.Bytes)
+	}
+	Annotate(list, m)
+	var s string
+	for i, ins := range list {
+		if name, ok := m.Lookup(ins.Address); ok {
+			s = s + "   " + name + ":\n"
+		}
+		marker := "   "
+		if i == current {
+			marker = "=> "
+		}
+		s = s + marker + ins.String() + "\n"
+	}
+	return s
+}
+
+// Return up to n instructions ending right before pc
+func instructionsBefore(code []byte, pc uint16, m *symbols.Map, labels map[int]uint16, n int) []Instruction {
+	if n <= 0 || pc == 0 {
+		return nil
+	}
+	starts := []uint16{0}
+	if m != nil {
+		for _, sym := range m.Symbols {
+			if sym.Kind != symbols.KindConstant && sym.Value < pc {
+				starts = append(starts, sym.Value)
+			}
+		}
+	}
+	// Of the starts leading up to pc take the nearest one giving n
+	// instructions, or else the one giving the most
+	var best []Instruction
+	for _, start := range starts {
+		var list []Instruction
+		addr := start
+		for addr < pc {
+			ins := Decode(code, addr, labels)
+			list = append(list, ins)
+			addr += uint16(len(ins.Bytes))
+		}
+		if addr != pc {
+			continue
+		}
+		if best == nil || (len(best) < n && len(list) > len(best)) || (len(list) >= n && list[0].Address > best[0].Address) {
+			best = list
+		}
+	}
+	if best == nil {
+		// No start leads up to pc: step back over bytes that begin an
+		// instruction ending right before the next one, taking a byte that
+		// begins none as data
+		for addr := pc; len(best) < n && addr > 0; {
+			ins := Instruction{Address: addr - 1, Bytes: code[addr-1 : addr], Mnemonic: ".byte", Operands: fmt.Sprintf("0x%02x", code[addr-1]), Label: -1}
+			for k := uint16(1); k <= 3 && k <= addr; k++ {
+				if Length(code[addr-k]) == int(k) {
+					ins = Decode(code, addr-k, labels)
+					break
+				}
+			}
+			best = append([]Instruction{ins}, best...)
+			addr = ins.Address
+		}
+	}
+	if len(best) > n {
+		best = best[len(best)-n:]
+	}
+	return best
+}
+
+// Backtrace returns one line for each subroutine level of the shadow call
+// stack calls, innermost first: the pc, then the CALL leading to each level.
+// Addresses are named from the symbol map, which may be nil, or else after
+// the entry of their subroutine, as in "x0010+2".
+func Backtrace(pc uint16, calls []cpusimple.Frame, m *symbols.Map) string {
+	var s string
+	for level := 0; level <= len(calls); level++ {
+		addr := pc
+		if level > 0 {
+			addr = calls[len(calls)-level].Site
+		}
+		// A symbol below the entry of the subroutine belongs to another one
+		entry, hasEntry := uint16(0), level < len(calls)
+		if hasEntry {
+			entry = calls[len(calls)-level-1].Target
+		}
+		place := ""
+		if name, offset, ok := m.Nearest(addr); ok && (!hasEntry || addr-offset >= entry) {
+			place = name
+			if offset > 0 {
+				place = fmt.Sprintf("%s+%d", name, offset)
+			}
+		} else if hasEntry && addr > entry {
+			place = fmt.Sprintf("x%04x+%d", entry, addr-entry)
+		} else if hasEntry && addr == entry {
+			place = fmt.Sprintf("x%04x", entry)
+		}
+		s = s + strings.TrimRight(fmt.Sprintf("#%d  x%04x  %s", level, addr, place), " ") + "\n"
+	}
+	return s
+}
@@ -0,0 +1,147 @@
+package disasm
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/symbols"
+)
+
+func TestDecodeBaseInstructions(t *testing.T) {
+	fmt.Println("TestDecodeBaseInstructions")
+	code := []byte{
+		0x0a, 0x81, 0xa2, 0x22, 0x44, 0x66, // SET 10, PUSH R0, POP R2, ADD R2, SUB R3, MUL R4
+		0xe0, 0xc1, 0xc2, // LABEL 0, GOTO 0 if R0 != 0, GOTO 1 if R0 == 0
+	}
+	want := []string{"set 10", "push r0", "pop r2", "add r2", "sub r3", "mul r4", "label 0", "goto 0, nz", "goto 1, z"}
+	list := Disassemble(code, 0, uint16(len(code)))
+	if len(list) != len(want) {
+		t.Fatalf("Want: %d instructions Got: %d", len(want), len(list))
+	}
+	for i, ins := range list {
+		if ins.Text() != want[i] {
+			t.Fatalf("Want: %q Got: %q", want[i], ins.Text())
+		}
+	}
+	if !list[7].HasTarget || list[7].Target != 7 {
+		t.Fatalf("Want: GOTO 0 resolved to x0007 Got: %t x%04x", list[7].HasTarget, list[7].Target)
+	}
+	if list[8].HasTarget {
+		t.Fatalf("Want: GOTO 1 unresolved Got: x%04x", list[8].Target)
+	}
+}
+
+func TestDecodeExtendedInstructions(t *testing.T) {
+	fmt.Println("TestDecodeExtendedInstructions")
+	code := []byte{
+		0x15, 0x00, 0x10, // CALL x0010
+		0x11,             // HALT
+		0x18, 0x00, 0x63, // XSET R0 <-- 0x63
+		0x12, 0x00, 0x80, // STORE R0 at M[0x80]
+		0x13, 0x00, 0x40, // LOAD R0 <-- word at M[0x40]
+		0x10, 0x17, // NOOP, CMP
+		0x14, 0x15, // SWAP R1 with R5
+		0x16,       // RET
+		0x1f,       // Undefined
+		0x12, 0x00, // STORE with missing operand byte
+	}
+	want := []string{
+		"call 0x0010", "halt", "xset 0x0063", "store 0x0080", "load 0x0040",
+		"noop", "cmp", "swap r1, r5", "ret", ".byte 0x1f", ".byte 0x12", "set 0",
+	}
+	list := Disassemble(code, 0, uint16(len(code)))
+	if len(list) != len(want) {
+		t.Fatalf("Want: %d instructions Got: %d", len(want), len(list))
+	}
+	for i, ins := range list {
+		if ins.Text() != want[i] {
+			t.Fatalf("Want: %q Got: %q", want[i], ins.Text())
+		}
+	}
+	if list[4].Address != 0x000a || !list[4].HasTarget || list[4].Target != 0x0040 {
+		t.Fatalf("Want: LOAD at x000a targeting x0040 Got: x%04x x%04x", list[4].Address, list[4].Target)
+	}
+}
+
+func TestLabelsSkipOperands(t *testing.T) {
+	fmt.Println("TestLabelsSkipOperands")
+	// The XSET operand 0xe2 must not be taken for LABEL 1
+	code := []byte{0x18, 0x00, 0xe2, 0xe0, 0x11}
+	labels := Labels(code)
+	if len(labels) != 1 || labels[0] != 4 {
+		t.Fatalf("Want: map[0:4] Got: %v", labels)
+	}
+}
+
+func TestRoundTripWithAssembler(t *testing.T) {
+	fmt.Println("TestRoundTripWithAssembler")
+	code := []byte{
+		0x00, 0x81, 0xa0, 0x0b, 0x81, 0xa2, 0x01, 0x81, 0xa4, 0xe0,
+		0x80, 0xa1, 0x24, 0x81, 0xa0, 0x01, 0x24, 0x81, 0xa4, 0x42,
+		0xc1, 0x80, 0xa1,
+	}
+	var asmCode []string
+	for _, ins := range Disassemble(code, 0, uint16(len(code))) {
+		s, ok := ins.Legacy()
+		if !ok {
+			t.Fatalf("Want: legacy form for %q Got: none", ins.Text())
+		}
+		asmCode = append(asmCode, s)
+	}
+	generatedCode := cpusimple.AsmCodeToBytes(asmCode)
+	if !bytes.Equal(code, generatedCode) {
+		t.Fatalf("Want: %#v Got %#v", code, generatedCode)
+	}
+}
+
+func TestListing(t *testing.T) {
+	fmt.Println("TestListing")
+	code := []byte{0xe0, 0x15, 0x00, 0x10, 0xc1}
+	want := "0000:  e0         label 0\n" +
+		"0001:  15 00 10   call 0x0010\n" +
+		"0004:  c1         goto 0, nz    ; -> x0001\n"
+	got := Listing(code, 0, uint16(len(code)))
+	if got != want {
+		t.Fatalf("Want:\n%s\nGot:\n%s", want, got)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	fmt.Println("TestWindow")
+	code := []byte{0x01, 0x15, 0x00, 0x06, 0x11, 0x10, 0x16, 0x10}
+	m := symbols.New([]symbols.Symbol{{Name: "sub", Kind: symbols.KindAddress, Value: 6}})
+	want := "   0001:  15 00 06   call sub\n" +
+		"=> 0004:  11         halt\n" +
+		"   0005:  10         noop\n" +
+		"   sub:\n" +
+		"   0006:  16         ret\n"
+	got := Window(code, 4, m, 1, 2)
+	if got != want {
+		t.Fatalf("Want:\n%s\nGot:\n%s", want, got)
+	}
+
+	// A data byte ahead of the code that would decode as LOAD x0102
+	code = []byte{0x13, 0x01, 0x02, 0x11}
+	want = "   0000:  13         .byte 0x13\n" +
+		"=> 0001:  01         set 1\n" +
+		"   0002:  02         set 2\n"
+	if got := Window(code, 1, nil, 2, 1); got != want {
+		t.Fatalf("Want:\n%s\nGot:\n%s", want, got)
+	}
+}
+
+func TestBacktrace(t *testing.T) {
+	fmt.Println("TestBacktrace")
+	calls := []cpusimple.Frame{{Site: 0, Target: 8, SP: 28}, {Site: 9, Target: 0x10, SP: 26}}
+	want := "#0  x0012  x0010+2\n#1  x0009  x0008+1\n#2  x0000\n"
+	if got := Backtrace(0x12, calls, nil); got != want {
+		t.Fatalf("Want:\n%s\nGot:\n%s", want, got)
+	}
+	m := symbols.New([]symbols.Symbol{{Name: "start", Kind: symbols.KindAddress, Value: 0}, {Name: "outer", Kind: symbols.KindAddress, Value: 8}})
+	want = "#0  x0012  x0010+2\n#1  x0009  outer+1\n#2  x0000  start\n"
+	if got := Backtrace(0x12, calls, m); got != want {
+		t.Fatalf("Want:\n%s\nGot:\n%s", want, got)
+	}
+}
@@ -0,0 +1,12 @@
+module chrisriddick.net/disasm
+
+go 1.21.6
+
+require (
+	chrisriddick.net/cpusimple v0.0.0
+	chrisriddick.net/symbols v0.0.0
+)
+
+replace chrisriddick.net/cpusimple v0.0.0 => ../cpusimple
+
+replace chrisriddick.net/symbols v0.0.0 => ../symbols
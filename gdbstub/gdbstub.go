@@ -0,0 +1,541 @@
+// Package gdbstub serves the GDB remote serial protocol over TCP, so gdb and
+// other debuggers speaking it can attach to the simulator. It reads and
+// writes registers and memory, sets breakpoints, steps and continues the
+// CPU run by a controller, and describes the registers to the debugger with
+// a target description.
+package gdbstub
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"chrisriddick.net/controller"
+	"chrisriddick.net/cpusimple"
+)
+
+// Register numbers used by the debugger. R0-R16 come first, each register
+// is 16 bits sent little-endian, and bit 0 of flags is the processor flag.
+const (
+	regPC    = 17
+	regSP    = 18
+	regFlags = 19
+	numRegs  = 20
+)
+
+// interrupt is the byte the debugger sends to stop a running program
+const interrupt = 0x03
+
+// Signals reported in stop replies
+const (
+	sigTrap = 5  // Stopped by a step, a breakpoint or the debugger
+	sigSegv = 11 // Stopped by a fault
+)
+
+// Server is a GDB remote protocol stub for the CPU of a controller
+type Server struct {
+	ctl *controller.Controller
+}
+
+// New returns a stub debugging the CPU run by ctl
+func New(ctl *controller.Controller) *Server {
+	return &Server{ctl: ctl}
+}
+
+// ListenAndServe listens on the TCP address addr and serves debuggers until
+// the listener fails
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return s.Serve(l)
+}
+
+// Serve accepts debugger connections on l, one at a time, until l is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.ServeConn(conn)
+		conn.Close()
+	}
+}
+
+// ServeConn talks to one debugger until it detaches, kills the program or
+// closes the connection. The CPU is left paused.
+func (s *Server) ServeConn(rw io.ReadWriter) error {
+	c := &conn{ctl: s.ctl, w: bufio.NewWriter(rw), in: make(chan packet), done: make(chan struct{})}
+	defer close(c.done)
+	go c.read(bufio.NewReader(rw))
+	for p := range c.in {
+		if p.interrupt {
+			continue // Nothing is running
+		}
+		reply, done := c.handle(p.data)
+		if done && p.data == "k" {
+			return nil // Kill has no reply
+		}
+		if err := c.send(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
+
+// packet is a command from the debugger, or an interrupt
+type packet struct {
+	data      string
+	interrupt bool
+}
+
+// conn is the state of one debugger connection
+type conn struct {
+	ctl   *controller.Controller
+	w     *bufio.Writer
+	in    chan packet   // Closed when the debugger hangs up
+	done  chan struct{} // Closed when the connection is no longer served
+	noAck bool          // Set by QStartNoAckMode
+	mu    sync.Mutex    // Guards w and noAck
+}
+
+// read splits the input into packets, dropping acknowledgements and packets
+// with a bad checksum, which the debugger sends again. Good packets are
+// acknowledged at once, since the reply to a step or continue only comes
+// when the CPU stops and the debugger would send them again meanwhile.
+func (c *conn) read(r *bufio.Reader) {
+	defer close(c.in)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch b {
+		case interrupt:
+			if !c.deliver(packet{interrupt: true}) {
+				return
+			}
+		case '$':
+			body, err := r.ReadString('#')
+			if err != nil {
+				return
+			}
+			body = strings.TrimSuffix(body, "#")
+			sum := make([]byte, 2)
+			if _, err := io.ReadFull(r, sum); err != nil {
+				return
+			}
+			if want, err := strconv.ParseUint(string(sum), 16, 8); err != nil || byte(want) != checksum(body) {
+				c.acknowledge('-')
+				continue
+			}
+			if c.acknowledge('+') != nil {
+				return
+			}
+			if !c.deliver(packet{data: unescape(body)}) {
+				return
+			}
+		}
+	}
+}
+
+// Pass p to the connection, unless it is no longer served
+func (c *conn) deliver(p packet) bool {
+	select {
+	case c.in <- p:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// Send the acknowledgement b, + for a good packet or - for a bad one, unless
+// acknowledgements were turned off
+func (c *conn) acknowledge(b byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.noAck {
+		return nil
+	}
+	c.w.WriteByte(b)
+	return c.w.Flush()
+}
+
+// Send a reply packet
+func (c *conn) send(data string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data = escape(data)
+	fmt.Fprintf(c.w, "$%s#%02x", data, checksum(data))
+	return c.w.Flush()
+}
+
+// handle carries out one command and returns the reply, and whether the
+// connection should end
+func (c *conn) handle(data string) (string, bool) {
+	if data == "" {
+		return "", false
+	}
+	args := data[1:]
+	switch data[0] {
+	case '?':
+		return c.stopReply(controller.Event{State: c.ctl.State(), Snapshot: c.ctl.Snapshot()}), false
+	case 'g':
+		return encodeRegisters(c.ctl.Snapshot()), false
+	case 'G':
+		return c.writeRegisters(args), false
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		if err != nil || n >= numRegs {
+			return "E01", false
+		}
+		return encodeRegisters(c.ctl.Snapshot())[n*4 : n*4+4], false
+	case 'P':
+		return c.writeRegister(args), false
+	case 'm':
+		return c.readMemory(args), false
+	case 'M':
+		return c.writeMemory(args), false
+	case 'Z', 'z':
+		return c.breakpoint(data[0] == 'Z', args), false
+	case 's':
+		if err := c.resume(args); err != nil {
+			return "E01", false
+		}
+		c.ctl.Step()
+		e, _ := c.ctl.Wait(context.Background())
+		return c.stopReply(e), false
+	case 'c':
+		if err := c.resume(args); err != nil {
+			return "E01", false
+		}
+		return c.stopReply(c.cont()), false
+	case 'D':
+		return "OK", true
+	case 'k':
+		c.ctl.Pause()
+		return "", true
+	case 'H':
+		return "OK", false // There is only one thread
+	case 'T':
+		return "OK", false // The thread is alive
+	case 'q', 'Q':
+		return c.query(data), false
+	}
+	return "", false // Not supported
+}
+
+// query answers the general query packets
+func (c *conn) query(data string) string {
+	name, args, _ := strings.Cut(data, ":")
+	switch name {
+	case "qSupported":
+		return "PacketSize=1000;qXfer:features:read+;QStartNoAckMode+"
+	case "QStartNoAckMode":
+		c.mu.Lock()
+		c.noAck = true
+		c.mu.Unlock()
+		return "OK"
+	case "qXfer":
+		return c.features(args)
+	case "qAttached":
+		return "1"
+	case "qC":
+		return "QC1"
+	case "qfThreadInfo":
+		return "m1"
+	case "qsThreadInfo":
+		return "l"
+	case "qSymbol":
+		return "OK"
+	}
+	return ""
+}
+
+// features sends a part of the target description for
+// qXfer:features:read:target.xml:offset,length
+func (c *conn) features(args string) string {
+	parts := strings.Split(args, ":")
+	if len(parts) != 4 || parts[0] != "features" || parts[1] != "read" {
+		return ""
+	}
+	if parts[2] != "target.xml" {
+		return "E00"
+	}
+	offset, length, err := addrLength(parts[3])
+	if err != nil {
+		return "E01"
+	}
+	xml := TargetDescription()
+	if offset >= len(xml) {
+		return "l"
+	}
+	if offset+length >= len(xml) {
+		return "l" + xml[offset:]
+	}
+	return "m" + xml[offset:offset+length]
+}
+
+// Set the PC to the address given with a step or continue
+func (c *conn) resume(args string) error {
+	if args == "" {
+		return nil
+	}
+	pc, err := strconv.ParseUint(args, 16, 16)
+	if err != nil {
+		return err
+	}
+	return c.ctl.Edit(func(cpu *cpusimple.CPU) error {
+		cpu.PC = uint16(pc)
+		return nil
+	})
+}
+
+// Run the program until it stops by itself or the debugger interrupts it
+func (c *conn) cont() controller.Event {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan controller.Event, 1)
+	go func() {
+		e, _ := c.ctl.RunContext(ctx)
+		stopped <- e
+	}()
+	in := c.in
+	for {
+		select {
+		case e := <-stopped:
+			return e
+		case p, ok := <-in:
+			// Only an interrupt may come while the program runs. A closed
+			// connection stops it too.
+			if !ok {
+				in = nil
+				cancel()
+			} else if p.interrupt {
+				cancel()
+			}
+		}
+	}
+}
+
+// stopReply tells the debugger why the CPU stopped
+func (c *conn) stopReply(e controller.Event) string {
+	switch e.State {
+	case controller.Halted:
+		return "W00"
+	case controller.Faulted:
+		return fmt.Sprintf("S%02x", sigSegv)
+	}
+	return fmt.Sprintf("S%02x", sigTrap)
+}
+
+func (c *conn) writeRegisters(args string) string {
+	data, err := hex.DecodeString(args)
+	if err != nil || len(data) != numRegs*2 {
+		return "E01"
+	}
+	err = c.ctl.Edit(func(cpu *cpusimple.CPU) error {
+		for n := 0; n < numRegs; n++ {
+			setRegister(cpu, n, uint16(data[n*2])|uint16(data[n*2+1])<<8)
+		}
+		return nil
+	})
+	if err != nil {
+		return "E01"
+	}
+	return "OK"
+}
+
+func (c *conn) writeRegister(args string) string {
+	num, value, ok := strings.Cut(args, "=")
+	n, err := strconv.ParseUint(num, 16, 8)
+	data, err2 := hex.DecodeString(value)
+	if !ok || err != nil || err2 != nil || n >= numRegs || len(data) != 2 {
+		return "E01"
+	}
+	err = c.ctl.Edit(func(cpu *cpusimple.CPU) error {
+		setRegister(cpu, int(n), uint16(data[0])|uint16(data[1])<<8)
+		return nil
+	})
+	if err != nil {
+		return "E01"
+	}
+	return "OK"
+}
+
+func (c *conn) readMemory(args string) string {
+	addr, length, err := addrLength(args)
+	if err != nil {
+		return "E01"
+	}
+	memory := c.ctl.Snapshot().Memory
+	if addr >= len(memory) {
+		return "E01"
+	}
+	end := addr + length
+	if end > len(memory) {
+		end = len(memory)
+	}
+	return hex.EncodeToString(memory[addr:end])
+}
+
+func (c *conn) writeMemory(args string) string {
+	where, value, ok := strings.Cut(args, ":")
+	addr, length, err := addrLength(where)
+	data, err2 := hex.DecodeString(value)
+	if !ok || err != nil || err2 != nil || len(data) != length {
+		return "E01"
+	}
+	err = c.ctl.Edit(func(cpu *cpusimple.CPU) error {
+		return cpu.LoadSegment(uint16(addr), data)
+	})
+	if err != nil {
+		return "E01"
+	}
+	return "OK"
+}
+
+// breakpoint sets or clears a software or hardware breakpoint, both kept by
+// the controller. Watchpoints are not supported.
+func (c *conn) breakpoint(set bool, args string) string {
+	parts := strings.Split(args, ",")
+	if len(parts) < 2 || (parts[0] != "0" && parts[0] != "1") {
+		return ""
+	}
+	addr, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "E01"
+	}
+	if set {
+		c.ctl.SetBreakpoint(uint16(addr))
+	} else {
+		c.ctl.ClearBreakpoint(uint16(addr))
+	}
+	return "OK"
+}
+
+// TargetDescription returns the target description XML sent to debuggers,
+// naming the registers in the order of the g packet
+func TargetDescription() string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="net.chrisriddick.simplecpu">
+    <flags id="flags_t" size="2">
+      <field name="F" start="0" end="0"/>
+    </flags>
+`)
+	for n := 0; n < 17; n++ {
+		fmt.Fprintf(&b, "    <reg name=\"r%d\" bitsize=\"16\" type=\"uint16\" regnum=\"%d\"/>\n", n, n)
+	}
+	fmt.Fprintf(&b, "    <reg name=\"pc\" bitsize=\"16\" type=\"code_ptr\" regnum=\"%d\"/>\n", regPC)
+	fmt.Fprintf(&b, "    <reg name=\"sp\" bitsize=\"16\" type=\"data_ptr\" regnum=\"%d\"/>\n", regSP)
+	fmt.Fprintf(&b, "    <reg name=\"flags\" bitsize=\"16\" type=\"flags_t\" regnum=\"%d\"/>\n", regFlags)
+	b.WriteString("  </feature>\n</target>\n")
+	return b.String()
+}
+
+// encodeRegisters returns the registers of s as the hex of a g packet
+func encodeRegisters(s *cpusimple.Snapshot) string {
+	values := make([]uint16, 0, numRegs)
+	values = append(values, s.Registers[:]...)
+	flags := uint16(0)
+	if s.Flag {
+		flags = 1
+	}
+	values = append(values, s.PC, s.SP, flags)
+	data := make([]byte, 0, numRegs*2)
+	for _, v := range values {
+		data = append(data, byte(v), byte(v>>8))
+	}
+	return hex.EncodeToString(data)
+}
+
+// setRegister sets register n, numbered as in the target description
+func setRegister(cpu *cpusimple.CPU, n int, v uint16) {
+	switch n {
+	case regPC:
+		cpu.PC = v
+	case regSP:
+		cpu.SP = v
+	case regFlags:
+		cpu.Flag = v&1 != 0
+	default:
+		cpu.Registers[n] = v
+	}
+}
+
+// addrLength parses the "addr,length" argument of memory and qXfer packets
+func addrLength(s string) (int, int, error) {
+	a, l, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, errors.New("want addr,length")
+	}
+	addr, err := strconv.ParseUint(a, 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	length, err := strconv.ParseUint(l, 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(addr), int(length), nil
+}
+
+// checksum is the modulo 256 sum of the packet data
+func checksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// escape protects the characters that delimit packets
+func escape(data string) string {
+	if !strings.ContainsAny(data, "#$}*") {
+		return data
+	}
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '#', '$', '}', '*':
+			b.WriteByte('}')
+			b.WriteByte(data[i] ^ 0x20)
+		default:
+			b.WriteByte(data[i])
+		}
+	}
+	return b.String()
+}
+
+// unescape undoes escape on the data of a received packet
+func unescape(data string) string {
+	if !strings.Contains(data, "}") {
+		return data
+	}
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			i++
+			b.WriteByte(data[i] ^ 0x20)
+		} else {
+			b.WriteByte(data[i])
+		}
+	}
+	return b.String()
+}
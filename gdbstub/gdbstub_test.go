@@ -0,0 +1,180 @@
+package gdbstub
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"chrisriddick.net/controller"
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/progfile"
+)
+
+// Sums the numbers from 1 to 10
+var sum = []byte{
+	0x00, 0x81, 0xa0, 0x0a, 0x81, 0xa2, 0x01, 0x81, 0xa4, 0xe0,
+	0x80, 0xa1, 0x22, 0x81, 0xa0, 0x82, 0xa1, 0x44, 0x81, 0xa2,
+	0xc1, 0x80, 0xa1, 0x11,
+}
+
+// client plays the debugger side of a connection
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// connect serves a controller with program loaded over an in-memory
+// connection
+func connect(t *testing.T, program []byte) (*client, *controller.Controller) {
+	ctl := controller.New(&cpusimple.CPU{})
+	if err := ctl.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: program}})); err != nil {
+		t.Fatal(err)
+	}
+	stub, debugger := net.Pipe()
+	served := make(chan bool)
+	go func() {
+		New(ctl).ServeConn(stub)
+		stub.Close()
+		served <- true
+	}()
+	t.Cleanup(func() {
+		debugger.Close()
+		<-served
+		ctl.Close()
+	})
+	debugger.SetDeadline(time.Now().Add(5 * time.Second))
+	return &client{t: t, conn: debugger, r: bufio.NewReader(debugger)}, ctl
+}
+
+// Send a packet and return the reply
+func (c *client) do(data string) string {
+	c.t.Helper()
+	fmt.Fprintf(c.conn, "$%s#%02x", data, checksum(data))
+	return c.reply()
+}
+
+// Read an acknowledgement and a reply packet
+func (c *client) reply() string {
+	c.t.Helper()
+	c.acked()
+	return c.packet()
+}
+
+// Read an acknowledgement
+func (c *client) acked() {
+	c.t.Helper()
+	if b, err := c.r.ReadByte(); err != nil || b != '+' {
+		c.t.Fatalf("Want: + Got: %q %v", b, err)
+	}
+}
+
+// Read a reply packet
+func (c *client) packet() string {
+	c.t.Helper()
+	if b, err := c.r.ReadByte(); err != nil || b != '$' {
+		c.t.Fatalf("Want: $ Got: %q %v", b, err)
+	}
+	body, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	sum := make([]byte, 2)
+	if _, err := c.r.Read(sum); err != nil {
+		c.t.Fatal(err)
+	}
+	body = strings.TrimSuffix(body, "#")
+	if want := fmt.Sprintf("%02x", checksum(body)); string(sum) != want {
+		c.t.Fatalf("Want: checksum %s Got: %s", want, sum)
+	}
+	return unescape(body)
+}
+
+func TestSession(t *testing.T) {
+	fmt.Println("TestSession")
+	c, _ := connect(t, sum)
+	steps := []struct{ send, want string }{
+		{"qSupported:multiprocess+;swbreak+", "PacketSize=1000;qXfer:features:read+;QStartNoAckMode+"},
+		{"?", "S05"},
+		{"p11", "0000"},
+		{"m0,4", "0081a00a"},
+		{"Z0,a,1", "OK"},
+		{"c", "S05"},
+		{"p11", "0a00"},
+		{"p12", "fe00"},
+		{"s", "S05"},
+		{"p11", "0b00"},
+		{"P2=0100", "OK"},
+		{"M20,3:0102ff", "OK"},
+		{"m1e,6", "00000102ff00"},
+		{"z0,a,1", "OK"},
+		{"c", "W00"},
+		{"p0", "0100"}, // One pass of the loop added 1
+		{"vMustReplyEmpty", ""},
+		{"D", "OK"},
+	}
+	for _, s := range steps {
+		if got := c.do(s.send); got != s.want {
+			t.Fatalf("Want: %s -> %q Got: %q", s.send, s.want, got)
+		}
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	fmt.Println("TestRegisters")
+	c, ctl := connect(t, sum)
+	regs := c.do("g")
+	if len(regs) != numRegs*4 {
+		t.Fatalf("Want: %d hex digits Got: %d", numRegs*4, len(regs))
+	}
+	// Set R16, the PC, the SP and the flag all at once
+	regs = regs[:16*4] + "3412" + "0400" + "f000" + "0100"
+	if got := c.do("G" + regs); got != "OK" {
+		t.Fatalf("Want: OK Got: %q", got)
+	}
+	s := ctl.Snapshot()
+	if s.Registers[16] != 0x1234 || s.PC != 4 || s.SP != 0xf0 || !s.Flag {
+		t.Fatalf("Want: R16 x1234 PC x0004 SP x00f0 flag Got: R16 x%04x PC x%04x SP x%04x %t", s.Registers[16], s.PC, s.SP, s.Flag)
+	}
+	if got := c.do("p14"); got != "E01" {
+		t.Fatalf("Want: E01 Got: %q", got)
+	}
+
+	// The target description is read in pieces
+	var xml strings.Builder
+	for {
+		part := c.do(fmt.Sprintf("qXfer:features:read:target.xml:%x,40", xml.Len()))
+		xml.WriteString(part[1:])
+		if part[0] == 'l' {
+			break
+		}
+	}
+	if xml.String() != TargetDescription() {
+		t.Fatalf("Want: %s Got: %s", TargetDescription(), xml.String())
+	}
+	for _, reg := range []string{`name="r16"`, `name="pc"`, `name="sp"`, `name="flags"`} {
+		if !strings.Contains(xml.String(), reg) {
+			t.Fatalf("Want: %s Got: %s", reg, xml.String())
+		}
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	fmt.Println("TestInterrupt")
+	c, ctl := connect(t, []byte{0xe0, 0xc1}) // An endless loop
+	fmt.Fprintf(c.conn, "$c#%02x", checksum("c"))
+	c.acked() // While the program runs, so the debugger does not send c again
+	for ctl.State() != controller.Running {
+		time.Sleep(time.Millisecond)
+	}
+	c.conn.Write([]byte{interrupt})
+	if got := c.packet(); got != "S05" {
+		t.Fatalf("Want: S05 Got: %q", got)
+	}
+	if ctl.State() != controller.Paused {
+		t.Fatalf("Want: %s Got: %s", controller.Paused, ctl.State())
+	}
+}
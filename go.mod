@@ -3,12 +3,26 @@ module chrisriddick.net/simplesimulator
 go 1.21.6
 
 require (
+	chrisriddick.net/asm v0.0.0
+	chrisriddick.net/batch v0.0.0
+	chrisriddick.net/controller v0.0.0
+	chrisriddick.net/coverage v0.0.0
 	chrisriddick.net/cpusimple v0.0.0
 	chrisriddick.net/dashboard v0.0.0
+	chrisriddick.net/gdbstub v0.0.0
+	chrisriddick.net/hexfile v0.0.0
+	chrisriddick.net/httpapi v0.0.0
+	chrisriddick.net/monitor v0.0.0
+	chrisriddick.net/profile v0.0.0
+	chrisriddick.net/progfile v0.0.0
+	chrisriddick.net/symbols v0.0.0
+	chrisriddick.net/tui v0.0.0
+	chrisriddick.net/webui v0.0.0
 	fyne.io/fyne/v2 v2.4.5
 )
 
 require (
+	chrisriddick.net/disasm v0.0.0 // indirect
 	fyne.io/systray v1.10.1-0.20231115130155-104f5ef7839e // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fredbi/uri v1.1.0 // indirect
@@ -16,6 +30,8 @@ require (
 	github.com/fyne-io/gl-js v0.0.0-20230506162202-1fdaa286a934 // indirect
 	github.com/fyne-io/glfw-js v0.0.0-20240101223322-6e1efdc71b7a // indirect
 	github.com/fyne-io/image v0.0.0-20240417123036-dc0ee9e7c964 // indirect
+	github.com/gdamore/encoding v1.0.0 // indirect
+	github.com/gdamore/tcell/v2 v2.7.4 // indirect
 	github.com/go-gl/gl v0.0.0-20231021071112-07e5d0ea2e71 // indirect
 	github.com/go-gl/glfw/v3.3/glfw v0.0.0-20240307211618-a69d953ea142 // indirect
 	github.com/go-text/render v0.1.0 // indirect
@@ -23,7 +39,10 @@ require (
 	github.com/godbus/dbus/v5 v5.1.0 // indirect
 	github.com/gopherjs/gopherjs v1.17.2 // indirect
 	github.com/jsummers/gobmp v0.0.0-20230614200233-a9de23ed2e25 // indirect
+	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
+	github.com/mattn/go-runewidth v0.0.15 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/rivo/uniseg v0.4.3 // indirect
 	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c // indirect
 	github.com/srwiley/rasterx v0.0.0-20220730225603-2ab79fcdd4ef // indirect
 	github.com/stretchr/testify v1.9.0 // indirect
@@ -33,11 +52,40 @@ require (
 	golang.org/x/mobile v0.0.0-20240404231514-09dbf07665ed // indirect
 	golang.org/x/net v0.24.0 // indirect
 	golang.org/x/sys v0.19.0 // indirect
+	golang.org/x/term v0.19.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	honnef.co/go/js/dom v0.0.0-20231112215516-51f43a291193 // indirect
 )
 
+replace chrisriddick.net/asm v0.0.0 => ./asm
+
+replace chrisriddick.net/batch v0.0.0 => ./batch
+
+replace chrisriddick.net/controller v0.0.0 => ./controller
+
+replace chrisriddick.net/coverage v0.0.0 => ./coverage
+
 replace chrisriddick.net/cpusimple v0.0.0 => ./cpusimple
 
 replace chrisriddick.net/dashboard v0.0.0 => ./dashboard
+
+replace chrisriddick.net/disasm v0.0.0 => ./disasm
+
+replace chrisriddick.net/gdbstub v0.0.0 => ./gdbstub
+
+replace chrisriddick.net/hexfile v0.0.0 => ./hexfile
+
+replace chrisriddick.net/httpapi v0.0.0 => ./httpapi
+
+replace chrisriddick.net/monitor v0.0.0 => ./monitor
+
+replace chrisriddick.net/profile v0.0.0 => ./profile
+
+replace chrisriddick.net/progfile v0.0.0 => ./progfile
+
+replace chrisriddick.net/symbols v0.0.0 => ./symbols
+
+replace chrisriddick.net/tui v0.0.0 => ./tui
+
+replace chrisriddick.net/webui v0.0.0 => ./webui
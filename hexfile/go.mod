@@ -0,0 +1,3 @@
+module chrisriddick.net/hexfile
+
+go 1.21.6
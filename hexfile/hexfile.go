@@ -0,0 +1,144 @@
+// Package hexfile reads and writes programs in the Intel HEX and Motorola
+// S-record formats used by EPROM programmers and other simulators.
+package hexfile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Number of data bytes written on each record
+const recordBytes = 16
+
+// Segment is a contiguous run of bytes starting at Addr
+type Segment struct {
+	Addr uint16
+	Data []byte
+}
+
+// Image is a program made of segments at arbitrary addresses, with an
+// optional entry point
+type Image struct {
+	Segments []Segment
+	Entry    uint16
+	HasEntry bool
+}
+
+// FromMemory returns an image holding mem[start:end], for exporting memory
+func FromMemory(mem []byte, start, end int) *Image {
+	data := append([]byte{}, mem[start:end]...)
+	return &Image{Segments: []Segment{{Addr: uint16(start), Data: data}}}
+}
+
+// Add appends data at addr, merging it with a segment it continues
+func (img *Image) Add(addr uint32, data []byte) error {
+	if addr+uint32(len(data)) > 0x10000 {
+		return fmt.Errorf("data at x%x is outside the 64K address space", addr)
+	}
+	for i := range img.Segments {
+		seg := &img.Segments[i]
+		if uint32(seg.Addr)+uint32(len(seg.Data)) == addr {
+			seg.Data = append(seg.Data, data...)
+			return nil
+		}
+	}
+	img.Segments = append(img.Segments, Segment{Addr: uint16(addr), Data: append([]byte{}, data...)})
+	sort.Slice(img.Segments, func(i, j int) bool { return img.Segments[i].Addr < img.Segments[j].Addr })
+	return nil
+}
+
+// End returns the address just past the highest byte of the image
+func (img *Image) End() int {
+	end := 0
+	for _, seg := range img.Segments {
+		if e := int(seg.Addr) + len(seg.Data); e > end {
+			end = e
+		}
+	}
+	return end
+}
+
+// Bytes returns the image as a single byte slice starting at address 0,
+// with gaps between segments filled with zeros
+func (img *Image) Bytes() []byte {
+	b := make([]byte, img.End())
+	for _, seg := range img.Segments {
+		copy(b[seg.Addr:], seg.Data)
+	}
+	return b
+}
+
+// Read parses an Intel HEX or S-record file, telling them apart by the first
+// character of the first record
+func Read(r io.Reader) (*Image, error) {
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, fmt.Errorf("no Intel HEX or S-record data found")
+		}
+		switch b[0] {
+		case ':':
+			return ReadIntelHex(br)
+		case 'S', 's':
+			return ReadSRecord(br)
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+		default:
+			return nil, fmt.Errorf("not an Intel HEX or S-record file")
+		}
+	}
+}
+
+// Load reads the Intel HEX or S-record file at path
+func Load(path string) (*Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// IsSRecordName tells whether a file name has one of the usual S-record
+// extensions, so that writers can pick a format from it
+func IsSRecordName(name string) bool {
+	switch strings.ToLower(name[strings.LastIndex(name, ".")+1:]) {
+	case "srec", "s19", "s28", "s37", "mot", "sx":
+		return true
+	}
+	return false
+}
+
+// decodeRecord turns the hex digits of a record into bytes
+func decodeRecord(s string) ([]byte, error) {
+	if len(s)%2 != 0 {
+		return nil, fmt.Errorf("odd number of hex digits")
+	}
+	b := make([]byte, len(s)/2)
+	for i := range b {
+		var v byte
+		for _, c := range s[2*i : 2*i+2] {
+			v <<= 4
+			switch {
+			case c >= '0' && c <= '9':
+				v |= byte(c - '0')
+			case c >= 'a' && c <= 'f':
+				v |= byte(c - 'a' + 10)
+			case c >= 'A' && c <= 'F':
+				v |= byte(c - 'A' + 10)
+			default:
+				return nil, fmt.Errorf("invalid hex digit %q", c)
+			}
+		}
+		b[i] = v
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("record too short")
+	}
+	return b, nil
+}
@@ -0,0 +1,99 @@
+package hexfile
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReadIntelHex(t *testing.T) {
+	fmt.Println("TestReadIntelHex")
+	src := ":0300300002337A1E\n:020000040000FA\n:0400000500000010E7\n:00000001FF\n"
+	img, err := Read(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Segments) != 1 || img.Segments[0].Addr != 0x30 || !bytes.Equal(img.Segments[0].Data, []byte{0x02, 0x33, 0x7a}) {
+		t.Fatalf("Want: 02 33 7a at x0030 Got: %v", img.Segments)
+	}
+	if !img.HasEntry || img.Entry != 0x10 {
+		t.Fatalf("Want: entry x0010 Got: x%04x %t", img.Entry, img.HasEntry)
+	}
+}
+
+func TestReadSRecord(t *testing.T) {
+	fmt.Println("TestReadSRecord")
+	src := "S00F000068656C6C6F202020202000003C\nS1130000285F245F2212226A000424290008237C2A\nS5030001FB\nS9030000FC\n"
+	img, err := Read(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x28, 0x5f, 0x24, 0x5f, 0x22, 0x12, 0x22, 0x6a, 0x00, 0x04, 0x24, 0x29, 0x00, 0x08, 0x23, 0x7c}
+	if len(img.Segments) != 1 || !bytes.Equal(img.Bytes(), want) {
+		t.Fatalf("Want: %x Got: %x", want, img.Bytes())
+	}
+	if !img.HasEntry || img.Entry != 0 {
+		t.Fatalf("Want: entry x0000 Got: x%04x %t", img.Entry, img.HasEntry)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	fmt.Println("TestRoundTrip")
+	img := &Image{Entry: 0x0100, HasEntry: true}
+	code := make([]byte, 40)
+	for i := range code {
+		code[i] = byte(i * 7)
+	}
+	img.Add(0x0100, code[:20])
+	img.Add(0x0114, code[20:]) // Continues the first segment
+	img.Add(0x0010, []byte{0x15, 0x01, 0x00, 0x11})
+	if len(img.Segments) != 2 || img.Segments[0].Addr != 0x10 {
+		t.Fatalf("Want: 2 segments starting at x0010 Got: %v", img.Segments)
+	}
+
+	var ihex, srec bytes.Buffer
+	img.WriteIntelHex(&ihex)
+	img.WriteSRecord(&srec, "test")
+	if !strings.HasPrefix(ihex.String(), ":0400100015010011C5\n") || !strings.HasSuffix(ihex.String(), ":0400000500000100F6\n:00000001FF\n") {
+		t.Fatalf("Unexpected Intel HEX:\n%s", ihex.String())
+	}
+	for _, out := range []*bytes.Buffer{&ihex, &srec} {
+		read, err := Read(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(read) != fmt.Sprint(img) {
+			t.Fatalf("Want: %v Got: %v", img, read)
+		}
+	}
+
+	// A name longer than a record holds is cut to 252 bytes
+	srec.Reset()
+	img.WriteSRecord(&srec, strings.Repeat("n", 300))
+	header, _, _ := strings.Cut(srec.String(), "\n")
+	if !strings.HasPrefix(header, "S0FF0000") || len(header) != 4+2*0xff {
+		t.Fatalf("Want: S0 record of 255 bytes Got: %s", header)
+	}
+	if read, err := Read(&srec); err != nil || fmt.Sprint(read) != fmt.Sprint(img) {
+		t.Fatalf("Want: %v Got: %v %v", img, read, err)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	fmt.Println("TestReadErrors")
+	for src, want := range map[string]string{
+		":0300300002337A1F\n:00000001FF\n":             "hex line 1: checksum mismatch",
+		":0300300002337A1E\n":                          "hex file has no end of file record",
+		":0400300002337A1E\n":                          "hex line 1: record length does not match its count",
+		":020000040001F9\n:0100000000FF\n":             "hex line 2: data at x10000 is outside the 64K address space",
+		"S1130000285F245F2212226A000424290008237C2B\n": "S-record line 1: checksum mismatch",
+		"S4030000FC\n":                                 "S-record line 1: unknown record type S4",
+		"hello\n":                                      "not an Intel HEX or S-record file",
+	} {
+		_, err := Read(strings.NewReader(src))
+		if err == nil || err.Error() != want {
+			t.Fatalf("Want: %s Got: %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package hexfile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Intel HEX record types
+const (
+	ihexData           = 0x00
+	ihexEOF            = 0x01
+	ihexSegmentAddress = 0x02 // Base address is the value times 16
+	ihexSegmentStart   = 0x03 // Entry point as CS:IP
+	ihexLinearAddress  = 0x04 // Upper 16 bits of the address
+	ihexLinearStart    = 0x05 // 32-bit entry point
+)
+
+// ReadIntelHex parses an Intel HEX file
+func ReadIntelHex(r io.Reader) (*Image, error) {
+	img := &Image{}
+	var base uint32
+	scanner := bufio.NewScanner(r)
+	num := 0
+	for scanner.Scan() {
+		num++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fail := func(format string, args ...interface{}) (*Image, error) {
+			return nil, fmt.Errorf("hex line %d: %s", num, fmt.Sprintf(format, args...))
+		}
+		if line[0] != ':' {
+			return fail("record does not start with ':'")
+		}
+		b, err := decodeRecord(line[1:])
+		if err != nil {
+			return fail("%v", err)
+		}
+		if len(b) < 5 || len(b) != int(b[0])+5 {
+			return fail("record length does not match its count")
+		}
+		var sum byte
+		for _, v := range b {
+			sum += v
+		}
+		if sum != 0 {
+			return fail("checksum mismatch")
+		}
+		addr := uint32(b[1])<<8 | uint32(b[2])
+		data := b[4 : len(b)-1]
+		switch b[3] {
+		case ihexData:
+			if err := img.Add(base+addr, data); err != nil {
+				return fail("%v", err)
+			}
+		case ihexEOF:
+			return img, nil
+		case ihexSegmentAddress, ihexLinearAddress:
+			if len(data) != 2 {
+				return fail("address record needs 2 bytes")
+			}
+			base = uint32(data[0])<<8 | uint32(data[1])
+			if b[3] == ihexSegmentAddress {
+				base <<= 4
+			} else {
+				base <<= 16
+			}
+		case ihexSegmentStart, ihexLinearStart:
+			if len(data) != 4 {
+				return fail("start address record needs 4 bytes")
+			}
+			hi := uint32(data[0])<<8 | uint32(data[1])
+			lo := uint32(data[2])<<8 | uint32(data[3])
+			entry := hi<<16 | lo
+			if b[3] == ihexSegmentStart {
+				entry = hi<<4 + lo
+			}
+			if entry > 0xffff {
+				return fail("entry point x%x is outside the 64K address space", entry)
+			}
+			img.Entry, img.HasEntry = uint16(entry), true
+		default:
+			return fail("unknown record type %02x", b[3])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("hex file has no end of file record")
+}
+
+// WriteIntelHex saves the image in Intel HEX format, with a start linear
+// address record when the image has an entry point
+func (img *Image) WriteIntelHex(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, seg := range img.Segments {
+		for i := 0; i < len(seg.Data); i += recordBytes {
+			end := i + recordBytes
+			if end > len(seg.Data) {
+				end = len(seg.Data)
+			}
+			addr := int(seg.Addr) + i
+			writeIntelRecord(bw, ihexData, uint16(addr), seg.Data[i:end])
+		}
+	}
+	if img.HasEntry {
+		writeIntelRecord(bw, ihexLinearStart, 0, []byte{0, 0, byte(img.Entry >> 8), byte(img.Entry)})
+	}
+	writeIntelRecord(bw, ihexEOF, 0, nil)
+	return bw.Flush()
+}
+
+func writeIntelRecord(w io.Writer, kind byte, addr uint16, data []byte) {
+	b := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr), kind}, data...)
+	var sum byte
+	for _, v := range b {
+		sum += v
+	}
+	fmt.Fprintf(w, ":%X%02X\n", b, -sum)
+}
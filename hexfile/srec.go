@@ -0,0 +1,119 @@
+package hexfile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReadSRecord parses a Motorola S-record file. S1, S2 and S3 records hold
+// data and S7, S8 and S9 records the entry point.
+func ReadSRecord(r io.Reader) (*Image, error) {
+	img := &Image{}
+	scanner := bufio.NewScanner(r)
+	num := 0
+	for scanner.Scan() {
+		num++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fail := func(format string, args ...interface{}) (*Image, error) {
+			return nil, fmt.Errorf("S-record line %d: %s", num, fmt.Sprintf(format, args...))
+		}
+		if len(line) < 2 || (line[0] != 'S' && line[0] != 's') {
+			return fail("record does not start with 'S'")
+		}
+		kind := line[1]
+		b, err := decodeRecord(line[2:])
+		if err != nil {
+			return fail("%v", err)
+		}
+		if len(b) != int(b[0])+1 {
+			return fail("record length does not match its count")
+		}
+		var sum byte
+		for _, v := range b {
+			sum += v
+		}
+		if sum != 0xff {
+			return fail("checksum mismatch")
+		}
+		var addrLen int
+		switch kind {
+		case '0', '1', '5', '9':
+			addrLen = 2
+		case '2', '6', '8':
+			addrLen = 3
+		case '3', '7':
+			addrLen = 4
+		default:
+			return fail("unknown record type S%c", kind)
+		}
+		if len(b) < addrLen+2 {
+			return fail("record too short")
+		}
+		var addr uint32
+		for _, v := range b[1 : 1+addrLen] {
+			addr = addr<<8 | uint32(v)
+		}
+		data := b[1+addrLen : len(b)-1]
+		switch kind {
+		case '1', '2', '3':
+			if err := img.Add(addr, data); err != nil {
+				return fail("%v", err)
+			}
+		case '7', '8', '9':
+			if addr > 0xffff {
+				return fail("entry point x%x is outside the 64K address space", addr)
+			}
+			img.Entry, img.HasEntry = uint16(addr), true
+			return img, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Bytes of data that fit in one S-record after its address and checksum
+const maxSRecordData = 0xff - 3
+
+// WriteSRecord saves the image as S-records: an S0 header holding name, S1
+// data records, an S5 record count and an S9 record with the entry point,
+// or 0 when the image has none. A name too long for one record is cut short.
+func (img *Image) WriteSRecord(w io.Writer, name string) error {
+	bw := bufio.NewWriter(w)
+	header := []byte(name)
+	if len(header) > maxSRecordData {
+		header = header[:maxSRecordData]
+	}
+	writeSRecord(bw, '0', 0, header)
+	count := 0
+	for _, seg := range img.Segments {
+		for i := 0; i < len(seg.Data); i += recordBytes {
+			end := i + recordBytes
+			if end > len(seg.Data) {
+				end = len(seg.Data)
+			}
+			writeSRecord(bw, '1', uint16(int(seg.Addr)+i), seg.Data[i:end])
+			count++
+		}
+	}
+	if count <= 0xffff {
+		writeSRecord(bw, '5', uint16(count), nil)
+	}
+	writeSRecord(bw, '9', img.Entry, nil)
+	return bw.Flush()
+}
+
+func writeSRecord(w io.Writer, kind byte, addr uint16, data []byte) {
+	b := append([]byte{byte(len(data) + 3), byte(addr >> 8), byte(addr)}, data...)
+	var sum byte
+	for _, v := range b {
+		sum += v
+	}
+	fmt.Fprintf(w, "S%c%X%02X\n", kind, b, ^sum)
+}
@@ -0,0 +1,483 @@
+// Package httpapi serves a local HTTP/JSON API for a simulator, so lab
+// tools and visualizations can load programs, drive the CPU and watch it
+// without going through a frontend. Commands are POST requests, state is
+// read with GET requests, and changes are streamed as server-sent events.
+//
+// Since any web page open in a browser can send requests to a local server,
+// requests are only answered for loopback host names and pages of the same
+// origin, and commands must carry the CommandHeader or a JSON content type,
+// which a page of another site cannot send without the server allowing it.
+package httpapi
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"chrisriddick.net/controller"
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/disasm"
+	"chrisriddick.net/symbols"
+)
+
+// Instructions shown before and after the PC by the code view, as in the
+// dashboard
+const (
+	codeLinesBefore = 4
+	codeLinesAfter  = 11
+)
+
+// CommandHeader must be set, to any value, on POST requests without a JSON
+// content type
+const CommandHeader = "X-Simulator"
+
+// eventBuffer is the number of events kept for a slow event stream. Events
+// past it are dropped, but the next one still carries the whole state.
+const eventBuffer = 64
+
+// Registers is the content of the registers
+type Registers struct {
+	PC        uint16     `json:"pc"`
+	SP        uint16     `json:"sp"`
+	Flag      bool       `json:"flag"`
+	Registers [17]uint16 `json:"registers"`
+}
+
+// Status is the state of the CPU returned by most requests and sent as
+// events. Message is the last status message of the controller.
+type Status struct {
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+	Fault   string `json:"fault,omitempty"`
+	Registers
+	StackHead uint16   `json:"stackhead"`
+	Clock     float64  `json:"clock"`            // Delay between instructions in milliseconds, 0 for full speed
+	Speed     float64  `json:"speed"`            // Measured instructions per second
+	Memory    *Memory  `json:"memory,omitempty"` // All of memory, for events asked for with memory=1
+	Breaks    []uint16 `json:"breakpoints,omitempty"`
+}
+
+// Code is the disassembly around the PC. Current is the index of the line
+// of the instruction at the PC, -1 when it is not shown.
+type Code struct {
+	Lines   []string `json:"lines"`
+	Current int      `json:"current"`
+}
+
+// Memory is the content of a range of memory, from Start to End inclusive
+type Memory struct {
+	Start uint16 `json:"start"`
+	End   uint16 `json:"end"`
+	Bytes string `json:"bytes"` // Hex digits, two per byte
+}
+
+// Stack is the content of the stack, from SP up to the value at the stack
+// head. Bytes is empty when nothing was pushed.
+type Stack struct {
+	SP    uint16 `json:"sp"`
+	Head  uint16 `json:"head"`
+	Bytes string `json:"bytes"` // Hex digits, two per byte
+}
+
+// Server is an http.Handler controlling the CPU of a controller
+type Server struct {
+	// Load reads a program file posted to /api/load and loads it in place of
+	// the current program. Loading is refused when it is nil.
+	Load func(name string, r io.Reader) error
+	// Hosts are the host names accepted in requests besides localhost and
+	// loopback addresses, for a server reached through another interface
+	Hosts []string
+
+	ctl         *controller.Controller
+	mux         *http.ServeMux
+	mu          sync.Mutex
+	message     string
+	symbolMap   *symbols.Map
+	subscribers map[chan controller.Event]bool
+}
+
+// New returns a server for the CPU run by ctl. It listens to the controller
+// from then on to stream its events.
+func New(ctl *controller.Controller) *Server {
+	s := &Server{ctl: ctl, mux: http.NewServeMux(), subscribers: make(map[chan controller.Event]bool)}
+	s.mux.HandleFunc("/api/status", s.get(s.status))
+	s.mux.HandleFunc("/api/registers", s.get(s.registers))
+	s.mux.HandleFunc("/api/memory", s.get(s.memory))
+	s.mux.HandleFunc("/api/stack", s.get(s.stack))
+	s.mux.HandleFunc("/api/code", s.get(s.code))
+	s.mux.HandleFunc("/api/events", s.events)
+	s.mux.HandleFunc("/api/load", s.post(s.load))
+	s.mux.HandleFunc("/api/run", s.post(s.command(ctl.Start)))
+	s.mux.HandleFunc("/api/pause", s.post(s.command(ctl.Pause)))
+	s.mux.HandleFunc("/api/reset", s.post(s.command(ctl.Reset)))
+	s.mux.HandleFunc("/api/step", s.post(s.step))
+	s.mux.HandleFunc("/api/clock", s.post(s.clock))
+	ctl.Listen(s.publish)
+	return s
+}
+
+// ListenAndServe serves the API on the TCP address addr until it fails
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(l, s)
+}
+
+// ServeHTTP answers one API request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.checkOrigin(r); err != nil {
+		fail(w, http.StatusForbidden, err)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// checkOrigin refuses requests for a host name other than a loopback one or
+// one of Hosts, as sent after DNS rebinding, and requests from a page of
+// another origin
+func (s *Server) checkOrigin(r *http.Request) error {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !s.allowedHost(strings.Trim(host, "[]")) {
+		return fmt.Errorf("host %q not allowed", r.Host)
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			return fmt.Errorf("origin %q not allowed", origin)
+		}
+	}
+	return nil
+}
+
+// Tell whether requests may name host
+func (s *Server) allowedHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, h := range s.Hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSymbols sets the symbol map used to name addresses and labels in the
+// code view
+func (s *Server) SetSymbols(m *symbols.Map) {
+	s.mu.Lock()
+	s.symbolMap = m
+	s.mu.Unlock()
+}
+
+// Pass an event on to the event streams, without waiting for slow ones
+func (s *Server) publish(e controller.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.Status != "" {
+		s.message = e.Status
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe to the events until unsubscribe is called
+func (s *Server) subscribe() (ch chan controller.Event, unsubscribe func()) {
+	ch = make(chan controller.Event, eventBuffer)
+	s.mu.Lock()
+	s.subscribers[ch] = true
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}
+}
+
+// Return the status for an event
+func (s *Server) toStatus(e controller.Event) Status {
+	s.mu.Lock()
+	message := s.message
+	s.mu.Unlock()
+	if e.Status != "" {
+		message = e.Status
+	}
+	c := e.Snapshot
+	return Status{
+		State:     e.State.String(),
+		Message:   message,
+		Fault:     c.Fault,
+		Registers: registers(c),
+		StackHead: c.StackHead,
+		Clock:     c.Clock,
+		Speed:     e.Speed,
+		Breaks:    s.ctl.Breakpoints(),
+	}
+}
+
+// Return the registers of snapshot c
+func registers(c *cpusimple.Snapshot) Registers {
+	return Registers{PC: c.PC, SP: c.SP, Flag: c.Flag, Registers: c.Registers}
+}
+
+// Return the current status
+func (s *Server) current() Status {
+	return s.toStatus(controller.Event{State: s.ctl.State(), Snapshot: s.ctl.Snapshot(), Speed: s.ctl.Speed()})
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	reply(w, http.StatusOK, s.current())
+}
+
+func (s *Server) registers(w http.ResponseWriter, r *http.Request) {
+	reply(w, http.StatusOK, registers(s.ctl.Snapshot()))
+}
+
+func (s *Server) memory(w http.ResponseWriter, r *http.Request) {
+	memory := s.ctl.Snapshot().Memory
+	if len(memory) == 0 {
+		fail(w, http.StatusConflict, fmt.Errorf("no memory, load a program first"))
+		return
+	}
+	start, err := query(r, "start", 0)
+	if err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	end, err := query(r, "end", len(memory)-1)
+	if err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	if end >= len(memory) {
+		end = len(memory) - 1
+	}
+	if start > end {
+		fail(w, http.StatusBadRequest, fmt.Errorf("start x%04x is past end x%04x", start, end))
+		return
+	}
+	reply(w, http.StatusOK, Memory{Start: uint16(start), End: uint16(end), Bytes: hex.EncodeToString(memory[start : end+1])})
+}
+
+func (s *Server) stack(w http.ResponseWriter, r *http.Request) {
+	c := s.ctl.Snapshot()
+	st := Stack{SP: c.SP, Head: c.StackHead}
+	// The value at the stack head is the first one pushed
+	if int(c.SP) <= int(c.StackHead) && int(c.StackHead)+2 <= len(c.Memory) {
+		st.Bytes = hex.EncodeToString(c.Memory[c.SP : c.StackHead+2])
+	}
+	reply(w, http.StatusOK, st)
+}
+
+func (s *Server) code(w http.ResponseWriter, r *http.Request) {
+	c := s.ctl.Snapshot()
+	s.mu.Lock()
+	m := s.symbolMap
+	s.mu.Unlock()
+	code := Code{Lines: []string{}, Current: -1}
+	if text := disasm.Window(c.Memory, c.PC, m, codeLinesBefore, codeLinesAfter); text != "" {
+		code.Lines = strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	}
+	for i, line := range code.Lines {
+		if strings.HasPrefix(line, "=>") {
+			code.Current = i
+		}
+	}
+	reply(w, http.StatusOK, code)
+}
+
+// events streams a status for every event of the controller as server-sent
+// events, starting with the current status. With memory=1 every status
+// carries all of memory. Status messages are also sent on their own as
+// "console" events holding a JSON string.
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		fail(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		fail(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+	withMemory := r.URL.Query().Get("memory") == "1"
+	ch, unsubscribe := s.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	send := func(e controller.Event) error {
+		st := s.toStatus(e)
+		if withMemory {
+			st.Memory = &Memory{End: uint16(len(e.Snapshot.Memory) - 1), Bytes: hex.EncodeToString(e.Snapshot.Memory)}
+		}
+		data, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		if e.Status != "" {
+			message, _ := json.Marshal(e.Status)
+			if _, err := fmt.Fprintf(w, "event: console\ndata: %s\n\n", message); err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+		return nil
+	}
+	if send(controller.Event{State: s.ctl.State(), Snapshot: s.ctl.Snapshot(), Speed: s.ctl.Speed()}) != nil {
+		return
+	}
+	for {
+		select {
+		case e := <-ch:
+			if send(e) != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// load reads the program in the request body. The name query parameter is
+// the file name, which tells its format by the extension.
+func (s *Server) load(w http.ResponseWriter, r *http.Request) {
+	if s.Load == nil {
+		fail(w, http.StatusNotImplemented, fmt.Errorf("loading programs is not enabled"))
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if err := s.Load(name, r.Body); err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	reply(w, http.StatusOK, s.current())
+}
+
+// step executes count instructions, 1 by default
+func (s *Server) step(w http.ResponseWriter, r *http.Request) {
+	count, err := query(r, "count", 1)
+	if err != nil {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+	if count == 1 {
+		s.ctl.Step()
+	} else {
+		s.ctl.StepN(uint64(count))
+	}
+	s.ctl.Wait(r.Context())
+	reply(w, http.StatusOK, s.current())
+}
+
+// clock sets the speed from ms, the delay between instructions in
+// milliseconds, or hz, the instructions per second. 0 is full speed.
+func (s *Server) clock(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var err error
+	var v float64
+	switch {
+	case q.Has("ms"):
+		if v, err = strconv.ParseFloat(q.Get("ms"), 64); err == nil && v >= 0 {
+			s.ctl.SetClock(v)
+		}
+	case q.Has("hz"):
+		if v, err = strconv.ParseFloat(q.Get("hz"), 64); err == nil && v >= 0 {
+			s.ctl.SetSpeed(v)
+		}
+	default:
+		fail(w, http.StatusBadRequest, fmt.Errorf("want ms or hz"))
+		return
+	}
+	if err != nil || v < 0 {
+		fail(w, http.StatusBadRequest, fmt.Errorf("want a number of at least 0"))
+		return
+	}
+	reply(w, http.StatusOK, s.current())
+}
+
+// command returns a handler calling f and replying with the new status
+func (s *Server) command(f func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f()
+		reply(w, http.StatusOK, s.current())
+	}
+}
+
+// get restricts h to GET requests
+func (s *Server) get(h http.HandlerFunc) http.HandlerFunc {
+	return method(http.MethodGet, h)
+}
+
+// post restricts h to POST requests, which change the state of the CPU,
+// carrying the CommandHeader or JSON
+func (s *Server) post(h http.HandlerFunc) http.HandlerFunc {
+	return method(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if r.Header.Get(CommandHeader) == "" && t != "application/json" {
+			fail(w, http.StatusForbidden, fmt.Errorf("POST requests need the %s header or a JSON content type", CommandHeader))
+			return
+		}
+		h(w, r)
+	})
+}
+
+func method(m string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			w.Header().Set("Allow", m)
+			fail(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed, use %s", r.Method, m))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// query reads a 16-bit number in decimal or 0x hex from the query
+// parameter name, or returns def when it is missing
+func query(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("%s: want a number from 0 to 0xffff", name)
+	}
+	return int(n), nil
+}
+
+// Write v as the JSON body of the reply
+func reply(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Reply with the JSON error {"error": message}
+func fail(w http.ResponseWriter, code int, err error) {
+	reply(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,286 @@
+package httpapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chrisriddick.net/controller"
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/progfile"
+)
+
+// Sums the numbers from 1 to 10
+var sum = []byte{
+	0x00, 0x81, 0xa0, 0x0a, 0x81, 0xa2, 0x01, 0x81, 0xa4, 0xe0,
+	0x80, 0xa1, 0x22, 0x81, 0xa0, 0x82, 0xa1, 0x44, 0x81, 0xa2,
+	0xc1, 0x80, 0xa1, 0x11,
+}
+
+// newServer serves the API for a controller whose Load takes raw binaries
+func newServer(t *testing.T) *httptest.Server {
+	ctl := controller.New(&cpusimple.CPU{})
+	s := New(ctl)
+	s.Load = func(name string, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("%s is empty", name)
+		}
+		return ctl.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: data}}))
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(func() {
+		ts.Close()
+		ctl.Close()
+	})
+	return ts
+}
+
+// Make a request and decode its JSON reply into v, checking the status code
+func call(t *testing.T, ts *httptest.Server, method, path, body string, code int, v any) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(CommandHeader, "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != code {
+		data, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Want: %s %s -> %d Got: %d %s", method, path, code, resp.StatusCode, data)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	fmt.Println("TestCommands")
+	ts := newServer(t)
+	var st Status
+	call(t, ts, "POST", "/api/load?name=sum.bin", string(sum), http.StatusOK, &st)
+	if st.State != "paused" || st.Message != "Program loaded." {
+		t.Fatalf("Want: paused, Program loaded. Got: %s, %s", st.State, st.Message)
+	}
+	call(t, ts, "POST", "/api/step?count=10", "", http.StatusOK, &st)
+	if st.PC != 0x0a || st.Registers.Registers[2] != 10 {
+		t.Fatalf("Want: PC x000a R2 10 Got: PC x%04x R2 %d", st.PC, st.Registers.Registers[2])
+	}
+	var stack Stack
+	call(t, ts, "GET", "/api/stack", "", http.StatusOK, &stack)
+	if stack.SP != 0xfe || stack.Head != 0xfc || stack.Bytes != "" {
+		t.Fatalf("Want: empty stack Got: %+v", stack)
+	}
+	var mem Memory
+	call(t, ts, "POST", "/api/step", "", http.StatusOK, &st) // Pushes R1
+	call(t, ts, "GET", "/api/stack", "", http.StatusOK, &stack)
+	if stack.SP != 0xfc || stack.Bytes != "0000" {
+		t.Fatalf("Want: x0000 at x00fc Got: %+v", stack)
+	}
+	call(t, ts, "GET", "/api/memory?start=0x14&end=0x17", "", http.StatusOK, &mem)
+	if mem.Start != 0x14 || mem.End != 0x17 || mem.Bytes != "c180a111" {
+		t.Fatalf("Want: x0014-x0017 c180a111 Got: %+v", mem)
+	}
+
+	var code Code
+	call(t, ts, "GET", "/api/code", "", http.StatusOK, &code)
+	if code.Current < 0 || !strings.HasPrefix(code.Lines[code.Current], "=> 000b:") {
+		t.Fatalf("Want: => 000b: current Got: %v", code)
+	}
+	call(t, ts, "POST", "/api/clock?hz=1000", "", http.StatusOK, &st)
+	if st.Clock != 1 {
+		t.Fatalf("Want: clock 1 ms Got: %v", st.Clock)
+	}
+	call(t, ts, "POST", "/api/clock?ms=0", "", http.StatusOK, &st)
+	call(t, ts, "POST", "/api/run", "", http.StatusOK, &st)
+	for st.State == "running" {
+		time.Sleep(time.Millisecond)
+		call(t, ts, "GET", "/api/status", "", http.StatusOK, &st)
+	}
+	var regs Registers
+	call(t, ts, "GET", "/api/registers", "", http.StatusOK, &regs)
+	if st.State != "halted" || regs.Registers[0] != 55 {
+		t.Fatalf("Want: halted R0 55 Got: %s R0 %d", st.State, regs.Registers[0])
+	}
+	call(t, ts, "POST", "/api/reset", "", http.StatusOK, &st)
+	if st.State != "paused" || st.PC != 0 {
+		t.Fatalf("Want: paused at x0000 Got: %s at x%04x", st.State, st.PC)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	fmt.Println("TestErrors")
+	ts := newServer(t)
+	var e map[string]string
+	call(t, ts, "GET", "/api/memory", "", http.StatusConflict, &e)
+	call(t, ts, "POST", "/api/load?name=empty.bin", "", http.StatusBadRequest, &e)
+	if e["error"] != "empty.bin is empty" {
+		t.Fatalf("Want: empty.bin is empty Got: %q", e["error"])
+	}
+	call(t, ts, "GET", "/api/run", "", http.StatusMethodNotAllowed, &e)
+	var st Status
+	call(t, ts, "POST", "/api/load?name=sum.bin", string(sum), http.StatusOK, &st)
+	call(t, ts, "GET", "/api/memory?start=0x10&end=4", "", http.StatusBadRequest, &e)
+	call(t, ts, "POST", "/api/clock", "", http.StatusBadRequest, &e)
+	call(t, ts, "POST", "/api/clock?ms=-1", "", http.StatusBadRequest, &e)
+	call(t, ts, "POST", "/api/step?count=zero", "", http.StatusBadRequest, &e)
+	if e["error"] != "count: want a number from 0 to 0xffff" {
+		t.Fatalf("Want: count error Got: %q", e["error"])
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	fmt.Println("TestOrigin")
+	ts := newServer(t)
+	for _, c := range []struct {
+		method, host, origin string
+		headers              map[string]string
+		code                 int
+	}{
+		{"POST", "", "", nil, http.StatusForbidden}, // No command header
+		{"POST", "", "", map[string]string{"Content-Type": "text/plain"}, http.StatusForbidden},
+		{"POST", "", "", map[string]string{"Content-Type": "application/json"}, http.StatusOK},
+		{"POST", "", "", map[string]string{CommandHeader: "1"}, http.StatusOK},
+		{"POST", "", "http://evil.example", map[string]string{CommandHeader: "1"}, http.StatusForbidden},
+		{"POST", "", ts.URL, map[string]string{CommandHeader: "1"}, http.StatusOK},
+		{"GET", "evil.example", "", nil, http.StatusForbidden}, // DNS rebinding
+		{"GET", "localhost:8080", "", nil, http.StatusOK},
+		{"GET", "[::1]:8080", "", nil, http.StatusOK},
+	} {
+		path := "/api/reset"
+		if c.method == "GET" {
+			path = "/api/status"
+		}
+		req, err := http.NewRequest(c.method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.host != "" {
+			req.Host = c.host
+		}
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Fatalf("Want: %s %s host %q origin %q -> %d Got: %d", c.method, path, c.host, c.origin, c.code, resp.StatusCode)
+		}
+	}
+}
+
+func TestConcurrentLoads(t *testing.T) {
+	fmt.Println("TestConcurrentLoads")
+	ts := newServer(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// call stops the test, which only the test goroutine may do
+			load, _ := http.NewRequest("POST", ts.URL+"/api/load?name=sum.bin", strings.NewReader(string(sum)))
+			load.Header.Set(CommandHeader, "1")
+			code, _ := http.NewRequest("GET", ts.URL+"/api/code", nil)
+			for _, r := range []*http.Request{load, code} {
+				resp, err := http.DefaultClient.Do(r)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("Want: %s %s -> 200 Got: %d", r.Method, r.URL.Path, resp.StatusCode)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	var mem Memory
+	call(t, ts, "GET", "/api/memory?end=3", "", http.StatusOK, &mem)
+	if mem.Bytes != "0081a00a" {
+		t.Fatalf("Want: sum loaded Got: %+v", mem)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	fmt.Println("TestEvents")
+	ts := newServer(t)
+	resp, err := http.Get(ts.URL + "/api/events?memory=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Want: text/event-stream Got: %s", ct)
+	}
+	events := make(chan Status, 100)
+	messages := make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			if scanner.Text() == "event: console" && scanner.Scan() {
+				var m string
+				json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &m)
+				messages <- m
+				continue
+			}
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var st Status
+			if json.Unmarshal([]byte(data), &st) == nil {
+				events <- st
+			}
+		}
+		close(events)
+	}()
+	next := func() Status {
+		select {
+		case st := <-events:
+			return st
+		case <-time.After(5 * time.Second):
+			t.Fatal("Want: event Got: timeout")
+		}
+		return Status{}
+	}
+	if st := next(); st.State != "idle" {
+		t.Fatalf("Want: idle first Got: %s", st.State)
+	}
+	var st Status
+	call(t, ts, "POST", "/api/load?name=sum.bin", string(sum), http.StatusOK, &st)
+	call(t, ts, "POST", "/api/run", "", http.StatusOK, &st)
+	for {
+		st = next()
+		if st.State == "halted" {
+			break
+		}
+	}
+	if m := <-messages; m != "Program loaded." {
+		t.Fatalf("Want: Program loaded. Got: %q", m)
+	}
+	if st.Registers.Registers[0] != 55 || st.Memory == nil || !strings.HasPrefix(st.Memory.Bytes, "0081a00a") {
+		t.Fatalf("Want: R0 55 with memory Got: %+v", st)
+	}
+}
@@ -0,0 +1,21 @@
+module chrisriddick.net/monitor
+
+go 1.21.6
+
+require (
+	chrisriddick.net/controller v0.0.0
+	chrisriddick.net/cpusimple v0.0.0
+	chrisriddick.net/disasm v0.0.0
+	chrisriddick.net/progfile v0.0.0
+	chrisriddick.net/symbols v0.0.0
+)
+
+replace chrisriddick.net/controller v0.0.0 => ../controller
+
+replace chrisriddick.net/cpusimple v0.0.0 => ../cpusimple
+
+replace chrisriddick.net/disasm v0.0.0 => ../disasm
+
+replace chrisriddick.net/progfile v0.0.0 => ../progfile
+
+replace chrisriddick.net/symbols v0.0.0 => ../symbols
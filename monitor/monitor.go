@@ -0,0 +1,405 @@
+// Package monitor is a text debugger for the simulator, usable from a
+// terminal or from the command entry of the dashboard. Every command is one
+// line. Output lines are "name: value" pairs, memory lines start with the
+// address, and errors are returned rather than printed, so scripts can drive
+// the monitor as easily as people.
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"chrisriddick.net/controller"
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/disasm"
+	"chrisriddick.net/symbols"
+)
+
+// Monitor carries out debugger commands on the CPU of a controller
+type Monitor struct {
+	ctl       *controller.Controller
+	out       io.Writer
+	mu        sync.Mutex
+	symbolMap *symbols.Map
+}
+
+// command is one monitor command and its help
+type command struct {
+	names []string // Name followed by its aliases
+	args  string
+	help  string
+	run   func(m *Monitor, ctx context.Context, args []string) error
+}
+
+// commands lists the commands in the order shown by help. It is filled in
+// by init, since help refers to it.
+var commands []command
+
+func init() {
+	commands = []command{
+		{[]string{"help", "h", "?"}, "", "list the commands", (*Monitor).help},
+		{[]string{"regs", "r"}, "[name value]", "show the registers, or set r0-r16, pc, sp or flag", (*Monitor).regs},
+		{[]string{"examine", "x"}, "addr [count]", "show count bytes of memory, 16 by default", (*Monitor).examine},
+		{[]string{"deposit", "w"}, "addr byte...", "write bytes to memory", (*Monitor).deposit},
+		{[]string{"stack", "k"}, "", "show the stack from SP up to the stack head", (*Monitor).stack},
+		{[]string{"bt", "where"}, "", "show the calls leading to the PC, innermost first", (*Monitor).backtrace},
+		{[]string{"dis", "u"}, "[start [end]]", "disassemble from start up to end, from the PC by default", (*Monitor).dis},
+		{[]string{"break", "b"}, "[addr]", "set a breakpoint, or list them", (*Monitor).setBreak},
+		{[]string{"clear", "bc"}, "addr|all", "remove a breakpoint, or all of them", (*Monitor).clearBreak},
+		{[]string{"step", "s"}, "[n]", "execute n instructions, 1 by default", (*Monitor).step},
+		{[]string{"next", "n"}, "", "step over a CALL", (*Monitor).stepOver},
+		{[]string{"out", "o"}, "", "run until the current subroutine returns", (*Monitor).stepOut},
+		{[]string{"until", "g"}, "addr", "run until the PC reaches addr", (*Monitor).until},
+		{[]string{"cont", "c"}, "", "run until a breakpoint, a halt or a fault", (*Monitor).cont},
+		{[]string{"reset"}, "", "reload the program", (*Monitor).reset},
+	}
+}
+
+// New returns a monitor for the CPU run by ctl, writing its output to out
+func New(ctl *controller.Controller, out io.Writer) *Monitor {
+	return &Monitor{ctl: ctl, out: out}
+}
+
+// SetSymbols sets the symbol map used for addresses given by name and in
+// disassembly
+func (m *Monitor) SetSymbols(sm *symbols.Map) {
+	m.mu.Lock()
+	m.symbolMap = sm
+	m.mu.Unlock()
+}
+
+func (m *Monitor) symbols() *symbols.Map {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.symbolMap
+}
+
+// Exec carries out one command line. Commands that run the program stop
+// when ctx is done. Empty lines and lines starting with # do nothing.
+func (m *Monitor) Exec(ctx context.Context, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return nil
+	}
+	name := strings.ToLower(fields[0])
+	for _, cmd := range commands {
+		for _, n := range cmd.names {
+			if n == name {
+				return cmd.run(m, ctx, fields[1:])
+			}
+		}
+	}
+	return fmt.Errorf("unknown command %q, try help", fields[0])
+}
+
+// Run reads commands from r until "quit", "q" or the end of the input,
+// printing errors as "error: " lines. Prompt is printed before each command
+// when not empty.
+func (m *Monitor) Run(ctx context.Context, r io.Reader, prompt string) error {
+	scanner := bufio.NewScanner(r)
+	for {
+		if prompt != "" {
+			fmt.Fprint(m.out, prompt)
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "quit" || line == "q" {
+			return nil
+		}
+		if err := m.Exec(ctx, line); err != nil {
+			fmt.Fprintf(m.out, "error: %v\n", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *Monitor) help(ctx context.Context, args []string) error {
+	for _, cmd := range commands {
+		usage := strings.TrimSpace(strings.Join(cmd.names, ", ") + " " + cmd.args)
+		fmt.Fprintf(m.out, "%-28s %s\n", usage, cmd.help)
+	}
+	fmt.Fprintf(m.out, "%-28s %s\n", "quit, q", "leave the monitor")
+	return nil
+}
+
+func (m *Monitor) regs(ctx context.Context, args []string) error {
+	switch len(args) {
+	case 0:
+		s := m.ctl.Snapshot()
+		fmt.Fprintf(m.out, "PC: x%04x\nSP: x%04x\nFlag: %t\n%s", s.PC, s.SP, s.Flag, s.GetRegisters())
+		return nil
+	case 2:
+		return m.setRegister(strings.ToLower(args[0]), args[1])
+	}
+	return fmt.Errorf("usage: regs [name value]")
+}
+
+// Set register name to the value in text
+func (m *Monitor) setRegister(name, text string) error {
+	if name == "flag" {
+		flag, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("flag must be true or false, 1 or 0")
+		}
+		return m.ctl.Edit(func(cpu *cpusimple.CPU) error {
+			cpu.Flag = flag
+			return nil
+		})
+	}
+	v, err := m.value(text)
+	if err != nil {
+		return err
+	}
+	switch {
+	case name == "pc":
+		return m.ctl.Edit(func(cpu *cpusimple.CPU) error {
+			cpu.PC = v
+			return nil
+		})
+	case name == "sp":
+		return m.ctl.Edit(func(cpu *cpusimple.CPU) error {
+			cpu.SP = v
+			return nil
+		})
+	case strings.HasPrefix(name, "r"):
+		n, err := strconv.Atoi(name[1:])
+		if err != nil || n < 0 || n > 16 {
+			break
+		}
+		return m.ctl.Edit(func(cpu *cpusimple.CPU) error {
+			cpu.Registers[n] = v
+			return nil
+		})
+	}
+	return fmt.Errorf("unknown register %q", name)
+}
+
+func (m *Monitor) examine(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: examine addr [count]")
+	}
+	addr, err := m.value(args[0])
+	if err != nil {
+		return err
+	}
+	count := 16
+	if len(args) == 2 {
+		n, err := m.value(args[1])
+		if err != nil {
+			return err
+		}
+		count = int(n)
+	}
+	s := m.ctl.Snapshot()
+	for a := int(addr); a < int(addr)+count && a < len(s.Memory); a += 16 {
+		bytes := strings.Fields(s.GetMemory(uint16(a)))
+		if n := int(addr) + count - a; n < len(bytes) {
+			bytes = bytes[:n]
+		}
+		fmt.Fprintf(m.out, "%04x: %s\n", a, strings.Join(bytes, " "))
+	}
+	return nil
+}
+
+func (m *Monitor) deposit(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: deposit addr byte...")
+	}
+	addr, err := m.value(args[0])
+	if err != nil {
+		return err
+	}
+	var data []byte
+	for _, arg := range args[1:] {
+		v, err := m.value(arg)
+		if err != nil {
+			return err
+		}
+		if v > 0xff {
+			return fmt.Errorf("%s does not fit in a byte", arg)
+		}
+		data = append(data, byte(v))
+	}
+	return m.ctl.Edit(func(cpu *cpusimple.CPU) error {
+		return cpu.LoadSegment(addr, data)
+	})
+}
+
+func (m *Monitor) stack(ctx context.Context, args []string) error {
+	fmt.Fprint(m.out, m.ctl.Snapshot().GetStack())
+	return nil
+}
+
+func (m *Monitor) backtrace(ctx context.Context, args []string) error {
+	s := m.ctl.Snapshot()
+	fmt.Fprint(m.out, disasm.Backtrace(s.PC, s.Calls, m.symbols()))
+	return nil
+}
+
+func (m *Monitor) dis(ctx context.Context, args []string) error {
+	s := m.ctl.Snapshot()
+	start, end := int(s.PC), int(s.PC)+16
+	if len(args) > 2 {
+		return fmt.Errorf("usage: dis [start [end]]")
+	}
+	if len(args) >= 1 {
+		v, err := m.value(args[0])
+		if err != nil {
+			return err
+		}
+		start, end = int(v), int(v)+16
+	}
+	if len(args) == 2 {
+		v, err := m.value(args[1])
+		if err != nil {
+			return err
+		}
+		end = int(v)
+	}
+	if end > len(s.Memory) {
+		end = len(s.Memory)
+	}
+	if start >= end {
+		return nil
+	}
+	fmt.Fprint(m.out, disasm.SymbolListing(s.Memory, uint16(start), uint16(end), m.symbols()))
+	return nil
+}
+
+func (m *Monitor) setBreak(ctx context.Context, args []string) error {
+	switch len(args) {
+	case 0:
+		for _, addr := range m.ctl.Breakpoints() {
+			fmt.Fprintf(m.out, "break: x%04x\n", addr)
+		}
+		return nil
+	case 1:
+		addr, err := m.value(args[0])
+		if err != nil {
+			return err
+		}
+		m.ctl.SetBreakpoint(addr)
+		return nil
+	}
+	return fmt.Errorf("usage: break [addr]")
+}
+
+func (m *Monitor) clearBreak(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: clear addr|all")
+	}
+	if args[0] == "all" {
+		for _, addr := range m.ctl.Breakpoints() {
+			m.ctl.ClearBreakpoint(addr)
+		}
+		return nil
+	}
+	addr, err := m.value(args[0])
+	if err != nil {
+		return err
+	}
+	m.ctl.ClearBreakpoint(addr)
+	return nil
+}
+
+func (m *Monitor) step(ctx context.Context, args []string) error {
+	n := uint16(1)
+	if len(args) == 1 {
+		v, err := m.value(args[0])
+		if err != nil {
+			return err
+		}
+		n = v
+	} else if len(args) > 1 {
+		return fmt.Errorf("usage: step [n]")
+	}
+	if n == 1 {
+		m.ctl.Step()
+	} else {
+		m.ctl.StepN(uint64(n))
+	}
+	return m.wait(ctx)
+}
+
+func (m *Monitor) stepOver(ctx context.Context, args []string) error {
+	m.ctl.StepOver()
+	return m.wait(ctx)
+}
+
+func (m *Monitor) stepOut(ctx context.Context, args []string) error {
+	m.ctl.StepOut()
+	return m.wait(ctx)
+}
+
+func (m *Monitor) until(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: until addr")
+	}
+	addr, err := m.value(args[0])
+	if err != nil {
+		return err
+	}
+	m.ctl.RunTo(addr)
+	return m.wait(ctx)
+}
+
+func (m *Monitor) cont(ctx context.Context, args []string) error {
+	e, err := m.ctl.RunContext(ctx)
+	if err != nil && ctx.Err() == nil {
+		return err // The program could not start
+	}
+	m.show(e)
+	return err
+}
+
+func (m *Monitor) reset(ctx context.Context, args []string) error {
+	m.ctl.Reset()
+	m.show(m.event())
+	return nil
+}
+
+// Wait for a stepping command to finish and show where the CPU stopped
+func (m *Monitor) wait(ctx context.Context) error {
+	e, err := m.ctl.Wait(ctx)
+	m.show(e)
+	return err
+}
+
+// Return the current state as an event
+func (m *Monitor) event() controller.Event {
+	return controller.Event{State: m.ctl.State(), Snapshot: m.ctl.Snapshot()}
+}
+
+// Print the state line of e, and the fault that stopped the CPU if any
+func (m *Monitor) show(e controller.Event) {
+	s := e.Snapshot
+	fmt.Fprintf(m.out, "State: %s  PC: x%04x  SP: x%04x  Flag: %t\n", e.State, s.PC, s.SP, s.Flag)
+	if s.Fault != "" {
+		fmt.Fprintf(m.out, "Fault: %s\n", s.Fault)
+	}
+}
+
+// value reads a 16-bit number in decimal, 0x hex or the x hex printed by the
+// simulator, or the value of a symbol
+func (m *Monitor) value(s string) (uint16, error) {
+	text := s
+	if strings.HasPrefix(text, "x") || strings.HasPrefix(text, "X") {
+		text = "0x" + text[1:]
+	}
+	if n, err := strconv.ParseUint(text, 0, 16); err == nil {
+		return uint16(n), nil
+	}
+	if v, ok := m.symbols().Address(s); ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("%q is neither a number nor a known symbol", s)
+}
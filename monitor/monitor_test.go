@@ -0,0 +1,145 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"chrisriddick.net/controller"
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/progfile"
+	"chrisriddick.net/symbols"
+)
+
+// Sums the numbers from 1 to 10
+var sum = []byte{
+	0x00, 0x81, 0xa0, 0x0a, 0x81, 0xa2, 0x01, 0x81, 0xa4, 0xe0,
+	0x80, 0xa1, 0x22, 0x81, 0xa0, 0x82, 0xa1, 0x44, 0x81, 0xa2,
+	0xc1, 0x80, 0xa1, 0x11,
+}
+
+// newMonitor returns a monitor for a controller with the sum program loaded
+func newMonitor(t *testing.T) (*Monitor, *bytes.Buffer) {
+	ctl := controller.New(&cpusimple.CPU{})
+	t.Cleanup(ctl.Close)
+	if err := ctl.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: sum}})); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	m := New(ctl, &out)
+	m.SetSymbols(symbols.New([]symbols.Symbol{{Name: "loop", Kind: symbols.KindLabel, Value: 10, Number: 0}}))
+	return m, &out
+}
+
+func TestScript(t *testing.T) {
+	fmt.Println("TestScript")
+	m, out := newMonitor(t)
+	script := `# Stop in the loop, look around, then finish with a shorter sum
+break loop
+b
+cont
+regs
+s 3
+r r2 1
+x 0 0x18
+w x20 1 2 0xff
+x 0x1e 6
+dis 0x14 0x18
+bc all
+c
+k
+q
+regs
+`
+	if err := m.Run(context.Background(), strings.NewReader(script), ""); err != nil {
+		t.Fatal(err)
+	}
+	want := `break: x000a
+State: paused  PC: x000a  SP: x00fe  Flag: false
+PC: x000a
+SP: x00fe
+Flag: false
+R00: x0001
+R01: x0000
+R02: x000a
+R03: x0001
+R04: x0000
+R05: x0000
+R06: x0000
+R07: x0000
+R08: x0000
+R09: x0000
+R10: x0000
+R11: x0000
+R12: x0000
+R13: x0000
+R14: x0000
+R15: x0000
+R16: x0000
+State: paused  PC: x000d  SP: x00fe  Flag: false
+0000: 00 81 a0 0a 81 a2 01 81 a4 e0 80 a1 22 81 a0 82
+0010: a1 44 81 a2 c1 80 a1 11
+001e: 00 00 01 02 ff 00
+0014:  c1         goto loop, nz    ; -> x000a
+0015:  80         push r1
+0016:  a1         pop r0
+0017:  11         halt
+State: halted  PC: x0018  SP: x00fe  Flag: false
+`
+	if got := out.String(); got != want {
+		t.Fatalf("Want:\n%s\nGot:\n%s", want, got)
+	}
+	if r0 := m.ctl.Snapshot().Registers[0]; r0 != 10 {
+		t.Fatalf("Want: R0 10 Got: %d", r0)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	fmt.Println("TestErrors")
+	m, out := newMonitor(t)
+	for line, want := range map[string]string{
+		"frobnicate":   `unknown command "frobnicate", try help`,
+		"x nowhere":    `"nowhere" is neither a number nor a known symbol`,
+		"w 0x100 1":    "segment x0100-x0100 does not fit in 256 bytes of memory",
+		"w 0 256":      "256 does not fit in a byte",
+		"r r17 1":      `unknown register "r17"`,
+		"r flag maybe": "flag must be true or false, 1 or 0",
+		"until":        "usage: until addr",
+	} {
+		if err := m.Exec(context.Background(), line); err == nil || err.Error() != want {
+			t.Fatalf("Want: %s Got: %v", want, err)
+		}
+	}
+	if out.Len() != 0 {
+		t.Fatalf("Want: no output for errors Got: %q", out.String())
+	}
+}
+
+func TestBacktrace(t *testing.T) {
+	fmt.Println("TestBacktrace")
+	ctl := controller.New(&cpusimple.CPU{})
+	t.Cleanup(ctl.Close)
+	// CALL x0008, HALT; at x0008 CALL x0010, RET; at x0010 RET
+	calls := []byte{cpusimple.CALL, 0x00, 0x08, cpusimple.HALT, 0, 0, 0, 0, cpusimple.CALL, 0x00, 0x10, cpusimple.RET, 0, 0, 0, 0, cpusimple.RET}
+	if err := ctl.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: calls}})); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	m := New(ctl, &out)
+	m.SetSymbols(symbols.New([]symbols.Symbol{{Name: "outer", Kind: symbols.KindAddress, Value: 8}}))
+	if err := m.Run(context.Background(), strings.NewReader("g x0010\nbt\nk\n"), ""); err != nil {
+		t.Fatal(err)
+	}
+	want := `State: paused  PC: x0010  SP: x00fa  Flag: false
+#0  x0010  x0010
+#1  x0008  outer
+#2  x0000
+00fa: x0b00  return
+00fc: x0300  return
+`
+	if got := out.String(); got != want {
+		t.Fatalf("Want:\n%s\nGot:\n%s", want, got)
+	}
+}
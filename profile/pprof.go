@@ -0,0 +1,211 @@
+package profile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+
+	"chrisriddick.net/symbols"
+)
+
+// Field numbers of the pprof profile.proto messages used below
+const (
+	profileSampleType  = 1
+	profileSample      = 2
+	profileLocation    = 4
+	profileFunction    = 5
+	profileStringTable = 6
+	profilePeriodType  = 11
+	profilePeriod      = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID      = 1
+	locationAddress = 3
+	locationLine    = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID   = 1
+	functionName = 2
+)
+
+// WritePprof writes the profile in the gzipped protocol buffer format of
+// pprof, with one sample per address and call path. Each subroutine is a
+// function named from the symbol map, or after its address, and the top
+// level of the program is "main". Line numbers are addresses.
+func (p *Profile) WritePprof(w io.Writer, m *symbols.Map) error {
+	b := &pprofBuilder{strings: map[string]int64{"": 0}, stringList: []string{""}, functions: map[string]uint64{}, locations: map[location]uint64{}}
+	var out protoBuffer
+	for _, field := range []int{profileSampleType, profilePeriodType} {
+		var vt protoBuffer
+		vt.intField(valueTypeType, b.str("instructions"))
+		vt.intField(valueTypeUnit, b.str("count"))
+		out.bytesField(field, vt)
+	}
+	out.intField(profilePeriod, 1)
+
+	var walk func(n *node, stack []uint64)
+	walk = func(n *node, stack []uint64) {
+		fn := functionFor(n, m)
+		addrs := make([]uint16, 0, len(n.counts))
+		for addr := range n.counts {
+			addrs = append(addrs, addr)
+		}
+		sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+		for _, addr := range addrs {
+			var sample protoBuffer
+			sample.packed(sampleLocationID, append([]uint64{b.location(addr, fn)}, stack...))
+			sample.packed(sampleValue, []uint64{n.counts[addr]})
+			out.bytesField(profileSample, sample)
+		}
+		keys := make([]uint32, 0, len(n.children))
+		for key := range n.children {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		for _, key := range keys {
+			child := n.children[key]
+			// The call site belongs to the caller
+			site := b.location(child.site, fn)
+			walk(child, append([]uint64{site}, stack...))
+		}
+	}
+	walk(p.root, nil)
+
+	for _, l := range b.locationList {
+		var line protoBuffer
+		line.uintField(lineFunctionID, b.function(l.function))
+		line.intField(lineLine, int64(l.addr))
+		var loc protoBuffer
+		loc.uintField(locationID, b.locations[l])
+		loc.uintField(locationAddress, uint64(l.addr))
+		loc.bytesField(locationLine, line)
+		out.bytesField(profileLocation, loc)
+	}
+	for i, name := range b.functionList {
+		var fn protoBuffer
+		fn.uintField(functionID, uint64(i+1))
+		fn.intField(functionName, b.str(name))
+		out.bytesField(profileFunction, fn)
+	}
+	for _, s := range b.stringList {
+		out.stringField(profileStringTable, s)
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(out); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Name the function of the subroutine of call path n
+func functionFor(n *node, m *symbols.Map) string {
+	if n.parent == nil {
+		return "main"
+	}
+	if name, ok := m.Lookup(n.target); ok {
+		return name
+	}
+	return fmt.Sprintf("x%04x", n.target)
+}
+
+// location is an address in a function
+type location struct {
+	addr     uint16
+	function string
+}
+
+// pprofBuilder numbers the strings, functions and locations of a profile
+type pprofBuilder struct {
+	strings      map[string]int64
+	stringList   []string
+	functions    map[string]uint64
+	functionList []string
+	locations    map[location]uint64
+	locationList []location
+}
+
+// Return the index of s in the string table
+func (b *pprofBuilder) str(s string) int64 {
+	if i, ok := b.strings[s]; ok {
+		return i
+	}
+	b.strings[s] = int64(len(b.stringList))
+	b.stringList = append(b.stringList, s)
+	return b.strings[s]
+}
+
+// Return the ID of the function named name
+func (b *pprofBuilder) function(name string) uint64 {
+	if id, ok := b.functions[name]; ok {
+		return id
+	}
+	b.functionList = append(b.functionList, name)
+	b.functions[name] = uint64(len(b.functionList))
+	b.str(name)
+	return b.functions[name]
+}
+
+// Return the ID of the location of addr in function fn
+func (b *pprofBuilder) location(addr uint16, fn string) uint64 {
+	l := location{addr, fn}
+	if id, ok := b.locations[l]; ok {
+		return id
+	}
+	b.locationList = append(b.locationList, l)
+	b.locations[l] = uint64(len(b.locationList))
+	b.function(fn)
+	return b.locations[l]
+}
+
+// protoBuffer encodes protocol buffer fields
+type protoBuffer []byte
+
+func (pb *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		*pb = append(*pb, byte(v)|0x80)
+		v >>= 7
+	}
+	*pb = append(*pb, byte(v))
+}
+
+// Field key of a varint or length-delimited field
+func (pb *protoBuffer) key(field int, wireType uint64) {
+	pb.varint(uint64(field)<<3 | wireType)
+}
+
+func (pb *protoBuffer) uintField(field int, v uint64) {
+	pb.key(field, 0)
+	pb.varint(v)
+}
+
+func (pb *protoBuffer) intField(field int, v int64) {
+	pb.uintField(field, uint64(v))
+}
+
+func (pb *protoBuffer) bytesField(field int, data []byte) {
+	pb.key(field, 2)
+	pb.varint(uint64(len(data)))
+	*pb = append(*pb, data...)
+}
+
+func (pb *protoBuffer) stringField(field int, s string) {
+	pb.bytesField(field, []byte(s))
+}
+
+// A repeated varint field, packed
+func (pb *protoBuffer) packed(field int, values []uint64) {
+	var data protoBuffer
+	for _, v := range values {
+		data.varint(v)
+	}
+	pb.bytesField(field, data)
+}
@@ -0,0 +1,271 @@
+// Package profile counts the instructions a program executes, per address,
+// per opcode and per subroutine, to show where it spends its time. A
+// Profile is attached to a CPU through its Trace hook. Every instruction
+// counts as one cycle.
+package profile
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/disasm"
+	"chrisriddick.net/symbols"
+)
+
+// Instruction executed before the current one, when it changes the call path
+const (
+	pendingNone = iota
+	pendingCall
+	pendingRet
+)
+
+// node is one call path: the subroutine called from the call site of its
+// parent. The root is the top level of the program.
+type node struct {
+	parent   *node
+	site     uint16 // Address of the CALL instruction
+	target   uint16 // Address of the subroutine
+	calls    uint64
+	counts   map[uint16]uint64 // Instructions executed by address
+	children map[uint32]*node  // Called subroutines by site and target
+}
+
+func newNode(parent *node, site, target uint16) *node {
+	return &node{parent: parent, site: site, target: target, counts: make(map[uint16]uint64), children: make(map[uint32]*node)}
+}
+
+// Profile counts executed instructions. Record must be called before each
+// instruction, from the goroutine running the CPU, which is also the only
+// one that may read the counts.
+type Profile struct {
+	root     *node
+	current  *node
+	opcodes  [256]uint64
+	total    uint64
+	pending  int
+	callSite uint16
+}
+
+// New returns an empty profile
+func New() *Profile {
+	p := &Profile{}
+	p.Reset()
+	return p
+}
+
+// Attach makes cpu record every instruction it executes in p
+func (p *Profile) Attach(cpu *cpusimple.CPU) {
+	cpu.Trace = p.Record
+}
+
+// Reset clears the counts, for a new run of the program
+func (p *Profile) Reset() {
+	p.root = newNode(nil, 0, 0)
+	p.current = p.root
+	p.opcodes = [256]uint64{}
+	p.total = 0
+	p.pending = pendingNone
+}
+
+// Total returns the number of instructions recorded
+func (p *Profile) Total() uint64 {
+	return p.total
+}
+
+// Record counts the instruction op about to execute at pc. A CALL or RET
+// moves to another call path once its effect is seen at the next PC.
+func (p *Profile) Record(pc uint16, op byte) {
+	switch p.pending {
+	case pendingCall:
+		key := uint32(p.callSite)<<16 | uint32(pc)
+		child := p.current.children[key]
+		if child == nil {
+			child = newNode(p.current, p.callSite, pc)
+			p.current.children[key] = child
+		}
+		child.calls++
+		p.current = child
+	case pendingRet:
+		if p.current.parent != nil {
+			p.current = p.current.parent
+		}
+	}
+	p.pending = pendingNone
+	if op&cpusimple.MaskExtended != 0 {
+		switch op & 0x1f {
+		case cpusimple.CALL:
+			p.pending = pendingCall
+			p.callSite = pc
+		case cpusimple.RET:
+			p.pending = pendingRet
+		}
+	}
+	p.current.counts[pc]++
+	p.opcodes[op]++
+	p.total++
+}
+
+// Count is the number of instructions executed at an address or with an
+// opcode. Name is the symbol of the address, as in "sub+3", or the mnemonic
+// of the opcode. Instruction is the disassembled instruction at the address.
+type Count struct {
+	Addr        uint16
+	Name        string
+	Instruction string
+	Count       uint64
+}
+
+// Subroutine is the time spent in a CALL target. Self counts the
+// instructions of the subroutine itself, Total adds those of the
+// subroutines it calls. A recursive subroutine is only counted once.
+type Subroutine struct {
+	Addr  uint16
+	Name  string
+	Calls uint64
+	Self  uint64
+	Total uint64
+}
+
+// Report is a summary of a profile, each list sorted by count, highest
+// first
+type Report struct {
+	Total       uint64
+	Hot         []Count
+	Opcodes     []Count
+	Subroutines []Subroutine
+}
+
+// Report summarizes the profile, decoding instructions from memory and
+// naming addresses from the symbol map, which may be nil
+func (p *Profile) Report(memory []byte, m *symbols.Map) *Report {
+	r := &Report{Total: p.total}
+
+	byAddr := make(map[uint16]uint64)
+	subs := make(map[uint16]*Subroutine)
+	var walk func(n *node, open map[uint16]bool) uint64
+	walk = func(n *node, open map[uint16]bool) uint64 {
+		var self uint64
+		for addr, c := range n.counts {
+			byAddr[addr] += c
+			self += c
+		}
+		var sub *Subroutine
+		outer := false
+		if n != p.root {
+			if sub = subs[n.target]; sub == nil {
+				sub = &Subroutine{Addr: n.target, Name: addressName(n.target, m)}
+				subs[n.target] = sub
+			}
+			sub.Calls += n.calls
+			sub.Self += self
+			// Only the outermost of recursive calls counts toward Total
+			outer = !open[n.target]
+			open[n.target] = true
+		}
+		total := self
+		for _, child := range n.children {
+			total += walk(child, open)
+		}
+		if outer {
+			sub.Total += total
+			delete(open, n.target)
+		}
+		return total
+	}
+	walk(p.root, make(map[uint16]bool))
+
+	labels := disasm.Labels(memory)
+	for addr, c := range byAddr {
+		ins := ""
+		if int(addr) < len(memory) {
+			list := []disasm.Instruction{disasm.Decode(memory, addr, labels)}
+			disasm.Annotate(list, m)
+			ins = list[0].Text()
+		}
+		r.Hot = append(r.Hot, Count{Addr: addr, Name: addressName(addr, m), Instruction: ins, Count: c})
+	}
+	sort.Slice(r.Hot, func(i, j int) bool {
+		if r.Hot[i].Count != r.Hot[j].Count {
+			return r.Hot[i].Count > r.Hot[j].Count
+		}
+		return r.Hot[i].Addr < r.Hot[j].Addr
+	})
+
+	byName := make(map[string]uint64)
+	for op, c := range p.opcodes {
+		if c > 0 {
+			byName[mnemonic(byte(op))] += c
+		}
+	}
+	for name, c := range byName {
+		r.Opcodes = append(r.Opcodes, Count{Name: name, Count: c})
+	}
+	sort.Slice(r.Opcodes, func(i, j int) bool {
+		if r.Opcodes[i].Count != r.Opcodes[j].Count {
+			return r.Opcodes[i].Count > r.Opcodes[j].Count
+		}
+		return r.Opcodes[i].Name < r.Opcodes[j].Name
+	})
+
+	for _, sub := range subs {
+		r.Subroutines = append(r.Subroutines, *sub)
+	}
+	sort.Slice(r.Subroutines, func(i, j int) bool {
+		if r.Subroutines[i].Total != r.Subroutines[j].Total {
+			return r.Subroutines[i].Total > r.Subroutines[j].Total
+		}
+		return r.Subroutines[i].Addr < r.Subroutines[j].Addr
+	})
+	return r
+}
+
+// WriteText prints the report as three tables, showing at most top hot
+// spots, or all of them when top is 0
+func (r *Report) WriteText(w io.Writer, top int) error {
+	hot := r.Hot
+	if top > 0 && len(hot) > top {
+		hot = hot[:top]
+	}
+	fmt.Fprintf(w, "Instructions executed: %d\n\nHot spots\n", r.Total)
+	fmt.Fprintf(w, "%12s %7s  %-6s %-16s %s\n", "count", "share", "addr", "symbol", "instruction")
+	for _, c := range hot {
+		fmt.Fprintf(w, "%12d %6.2f%%  x%04x  %-16s %s\n", c.Count, r.share(c.Count), c.Addr, c.Name, c.Instruction)
+	}
+	fmt.Fprintf(w, "\nOpcodes\n%12s %7s  %s\n", "count", "share", "mnemonic")
+	for _, c := range r.Opcodes {
+		fmt.Fprintf(w, "%12d %6.2f%%  %s\n", c.Count, r.share(c.Count), c.Name)
+	}
+	fmt.Fprintf(w, "\nSubroutines\n%12s %12s %12s %7s  %-6s %s\n", "calls", "self", "total", "share", "addr", "symbol")
+	for _, s := range r.Subroutines {
+		fmt.Fprintf(w, "%12d %12d %12d %6.2f%%  x%04x  %s\n", s.Calls, s.Self, s.Total, r.share(s.Total), s.Addr, s.Name)
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// Percentage of all instructions that n makes up
+func (r *Report) share(n uint64) float64 {
+	if r.Total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(r.Total)
+}
+
+// Name addr from the symbol map, as "sub" or "sub+3"
+func addressName(addr uint16, m *symbols.Map) string {
+	name, offset, ok := m.Nearest(addr)
+	switch {
+	case !ok:
+		return ""
+	case offset == 0:
+		return name
+	}
+	return fmt.Sprintf("%s+%d", name, offset)
+}
+
+// Return the mnemonic of opcode op
+func mnemonic(op byte) string {
+	return disasm.Decode([]byte{op, 0, 0}, 0, nil).Mnemonic
+}
@@ -0,0 +1,120 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/progfile"
+	"chrisriddick.net/symbols"
+)
+
+// Calls a subroutine at x0008, which calls another at x0010
+var calls = []byte{
+	cpusimple.CALL, 0x00, 0x08, 0x01, cpusimple.HALT, 0x10, 0x10, 0x10,
+	0x81, 0x02, cpusimple.CALL, 0x00, 0x10, 0xa1, cpusimple.RET, 0x10,
+	0x03, cpusimple.RET,
+}
+
+// Counts R0 down from 2 in a subroutine at x000a that calls itself
+var recursive = []byte{
+	0x01, 0x81, 0xa0, 0x02, cpusimple.CALL, 0x00, 0x0a, cpusimple.HALT,
+	0x10, 0x10, 0x40, 0xc0, cpusimple.CALL, 0x00, 0x0a, 0xe0,
+	cpusimple.RET,
+}
+
+// Run program to the end with a profile attached
+func run(t *testing.T, program []byte) (*Profile, *cpusimple.CPU) {
+	cpu := &cpusimple.CPU{}
+	if err := progfile.New([]progfile.Segment{{Addr: 0, Data: program}}).Configure(cpu); err != nil {
+		t.Fatal(err)
+	}
+	p := New()
+	p.Attach(cpu)
+	cpu.RunContext(context.Background())
+	if !cpu.Halted {
+		t.Fatalf("Want: halted Got: %q", cpu.Fault)
+	}
+	return p, cpu
+}
+
+func TestReport(t *testing.T) {
+	fmt.Println("TestReport")
+	p, cpu := run(t, calls)
+	m := symbols.New([]symbols.Symbol{{Name: "outer", Kind: symbols.KindAddress, Value: 8}})
+	r := p.Report(cpu.Memory, m)
+	if r.Total != 10 || len(r.Hot) != 10 {
+		t.Fatalf("Want: 10 instructions at 10 addresses Got: %d at %d", r.Total, len(r.Hot))
+	}
+	if h := r.Hot[3]; h.Addr != 8 || h.Name != "outer" || h.Instruction != "push r0" {
+		t.Fatalf("Want: x0008 outer push r0 Got: %+v", h)
+	}
+	if got := fmt.Sprint(r.Subroutines); got != "[{8 outer 1 5 7} {16 outer+8 1 2 2}]" {
+		t.Fatalf("Want: outer 1 call, 5 self, 7 total Got: %s", got)
+	}
+	if got := fmt.Sprint(r.Opcodes); !strings.HasPrefix(got, "[{0 set  3} {0 call  2} {0 ret  2}") {
+		t.Fatalf("Want: set 3, call 2, ret 2 first Got: %s", got)
+	}
+
+	var text strings.Builder
+	r.WriteText(&text, 2)
+	want := `Instructions executed: 10
+
+Hot spots
+       count   share  addr   symbol           instruction
+           1  10.00%  x0000                   call outer
+           1  10.00%  x0003                   set 1
+`
+	if !strings.HasPrefix(text.String(), want) {
+		t.Fatalf("Want: %s Got: %s", want, text.String())
+	}
+	if !strings.Contains(text.String(), "           1            5            7  70.00%  x0008  outer\n") {
+		t.Fatalf("Want: outer subroutine line Got: %s", text.String())
+	}
+
+	p.Reset()
+	if r := p.Report(cpu.Memory, m); r.Total != 0 || len(r.Hot) != 0 || len(r.Subroutines) != 0 {
+		t.Fatalf("Want: empty report Got: %+v", r)
+	}
+}
+
+func TestRecursion(t *testing.T) {
+	fmt.Println("TestRecursion")
+	p, cpu := run(t, recursive)
+	r := p.Report(cpu.Memory, nil)
+	// The inner call is part of the outer one, so it is not counted twice
+	if r.Total != 14 || fmt.Sprint(r.Subroutines) != "[{10  2 8 8}]" {
+		t.Fatalf("Want: 14 instructions, x000a called twice for 8 Got: %d %v", r.Total, r.Subroutines)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	fmt.Println("TestPprof")
+	p, _ := run(t, calls)
+	var buf bytes.Buffer
+	if err := p.WritePprof(&buf, symbols.New([]symbols.Symbol{{Name: "outer", Kind: symbols.KindAddress, Value: 8}})); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Profiles start with the sample type, whose strings are 1 and 2
+	if !bytes.HasPrefix(data, []byte{0x0a, 0x04, 0x08, 0x01, 0x10, 0x02}) {
+		t.Fatalf("Want: sample type first Got: % x", data[:6])
+	}
+	for _, s := range []string{"instructions", "count", "main", "outer", "x0010"} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Fatalf("Want: string %q Got: none", s)
+		}
+	}
+}
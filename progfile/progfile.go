@@ -0,0 +1,272 @@
+// Package progfile implements a self-describing program image: the code
+// segments together with the machine they need, so that loading a program
+// also sets up memory, the stack and the entry point.
+//
+// All numbers are big endian, like the CPU words. A file is laid out as:
+//
+//	magic       4 bytes "SCPU"
+//	version     1 byte
+//	entry       2 bytes, initial PC
+//	memory size 2 bytes, bytes of memory the program needs
+//	stack head  2 bytes, initial SP
+//	segments    2 byte count, then per segment a 2 byte address,
+//	            2 byte length and the data
+//	symbols     2 byte count, then per symbol a 1 byte kind, 2 byte value,
+//	            1 byte LABEL number and the name as a 1 byte length and text
+package progfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/disasm"
+	"chrisriddick.net/symbols"
+)
+
+// Magic starts every program image
+const Magic = "SCPU"
+
+// Version is the format version written by Write
+const Version = 1
+
+// DefaultMemorySize is the memory given to programs that do not ask for more
+const DefaultMemorySize = 256
+
+// Symbol kinds as stored in the file
+var kindCodes = []string{symbols.KindAddress, symbols.KindConstant, symbols.KindLabel}
+
+// Segment is a contiguous run of bytes loaded at Addr
+type Segment struct {
+	Addr uint16
+	Data []byte
+}
+
+// File is a program image
+type File struct {
+	Entry      uint16
+	MemorySize uint16
+	StackHead  uint16
+	Segments   []Segment
+	Symbols    *symbols.Map
+}
+
+// New returns an image of the segments with the default machine: entry
+// point 0 and the smallest multiple of DefaultMemorySize holding the code,
+// with the stack at the top of memory
+func New(segs []Segment) *File {
+	f := &File{Segments: segs}
+	size := DefaultMemorySize
+	for size < f.End() && size < 0x10000 {
+		size *= 2
+	}
+	if size > 0xffff {
+		size = 0xffff
+	}
+	f.MemorySize = uint16(size)
+	f.StackHead = f.MemorySize - 3
+	return f
+}
+
+// End returns the address just past the highest byte of the program
+func (f *File) End() int {
+	end := 0
+	for _, seg := range f.Segments {
+		if e := int(seg.Addr) + len(seg.Data); e > end {
+			end = e
+		}
+	}
+	return end
+}
+
+// IsImage tells whether data starts with the program image magic
+func IsImage(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
+
+// Write saves the image in binary form
+func (f *File) Write(w io.Writer) error {
+	b := []byte(Magic)
+	b = append(b, Version)
+	b = binary.BigEndian.AppendUint16(b, f.Entry)
+	b = binary.BigEndian.AppendUint16(b, f.MemorySize)
+	b = binary.BigEndian.AppendUint16(b, f.StackHead)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(f.Segments)))
+	for _, seg := range f.Segments {
+		if len(seg.Data) > 0xffff {
+			return fmt.Errorf("segment at x%04x is longer than 64K", seg.Addr)
+		}
+		b = binary.BigEndian.AppendUint16(b, seg.Addr)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(seg.Data)))
+		b = append(b, seg.Data...)
+	}
+	var syms []symbols.Symbol
+	if f.Symbols != nil {
+		syms = f.Symbols.Symbols
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(syms)))
+	for _, sym := range syms {
+		kind := -1
+		for i, k := range kindCodes {
+			if k == sym.Kind {
+				kind = i
+			}
+		}
+		if kind < 0 || len(sym.Name) > 0xff {
+			return fmt.Errorf("cannot store symbol %q of kind %s", sym.Name, sym.Kind)
+		}
+		b = append(b, byte(kind))
+		b = binary.BigEndian.AppendUint16(b, sym.Value)
+		b = append(b, byte(sym.Number), byte(len(sym.Name)))
+		b = append(b, sym.Name...)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// Read parses a program image written by Write
+func Read(r io.Reader) (*File, error) {
+	br := bufio.NewReader(r)
+	var header struct {
+		Magic      [4]byte
+		Version    byte
+		Entry      uint16
+		MemorySize uint16
+		StackHead  uint16
+	}
+	if err := binary.Read(br, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("program image header: %w", unexpected(err))
+	}
+	if string(header.Magic[:]) != Magic {
+		return nil, errors.New("not a program image")
+	}
+	if header.Version != Version {
+		return nil, fmt.Errorf("unsupported program image version %d", header.Version)
+	}
+	f := &File{Entry: header.Entry, MemorySize: header.MemorySize, StackHead: header.StackHead}
+
+	var count uint16
+	if err := binary.Read(br, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("program image segments: %w", unexpected(err))
+	}
+	for i := 0; i < int(count); i++ {
+		var seg struct{ Addr, Length uint16 }
+		if err := binary.Read(br, binary.BigEndian, &seg); err != nil {
+			return nil, fmt.Errorf("program image segment %d: %w", i, unexpected(err))
+		}
+		data := make([]byte, seg.Length)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("program image segment %d: %w", i, unexpected(err))
+		}
+		f.Segments = append(f.Segments, Segment{Addr: seg.Addr, Data: data})
+	}
+
+	if err := binary.Read(br, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("program image symbols: %w", unexpected(err))
+	}
+	var syms []symbols.Symbol
+	for i := 0; i < int(count); i++ {
+		var sym struct {
+			Kind   byte
+			Value  uint16
+			Number byte
+			Length byte
+		}
+		if err := binary.Read(br, binary.BigEndian, &sym); err != nil {
+			return nil, fmt.Errorf("program image symbol %d: %w", i, unexpected(err))
+		}
+		name := make([]byte, sym.Length)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return nil, fmt.Errorf("program image symbol %d: %w", i, unexpected(err))
+		}
+		if int(sym.Kind) >= len(kindCodes) {
+			return nil, fmt.Errorf("program image symbol %s: unknown kind %d", name, sym.Kind)
+		}
+		syms = append(syms, symbols.Symbol{Name: string(name), Kind: kindCodes[sym.Kind], Value: sym.Value, Number: int(sym.Number)})
+	}
+	if len(syms) > 0 {
+		f.Symbols = symbols.New(syms)
+	}
+	return f, nil
+}
+
+// unexpected reports a file cut short as such rather than as a plain EOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Load reads the program image file at path
+func Load(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Check reports a program that does not fit the machine it asks for
+func (f *File) Check() error {
+	if f.MemorySize < 2 {
+		return fmt.Errorf("memory size %d is too small", f.MemorySize)
+	}
+	if f.End() > int(f.MemorySize) {
+		return fmt.Errorf("program ends at x%04x, past the end of %d bytes of memory", f.End(), f.MemorySize)
+	}
+	if f.StackHead >= f.MemorySize {
+		return fmt.Errorf("stack head x%04x is outside %d bytes of memory", f.StackHead, f.MemorySize)
+	}
+	if f.Entry >= f.MemorySize {
+		return fmt.Errorf("entry point x%04x is outside %d bytes of memory", f.Entry, f.MemorySize)
+	}
+	return nil
+}
+
+// Configure sets up the CPU for the program: memory of the requested size
+// holding the segments, the stack, the LABEL table and the entry point
+func (f *File) Configure(c *cpusimple.CPU) error {
+	if err := f.Check(); err != nil {
+		return err
+	}
+	c.Memory = nil
+	c.InitMemory(f.MemorySize)
+	c.InitStack(f.StackHead)
+	c.Reset()
+	for _, seg := range f.Segments {
+		if err := c.LoadSegment(seg.Addr, seg.Data); err != nil {
+			return err
+		}
+	}
+	f.setLabels(c)
+	c.PC = f.Entry
+	return nil
+}
+
+// Fill the LABEL table of the CPU from the LABEL instructions of the
+// segments, then lay the LABEL symbols of the image over it. The segments
+// are decoded one instruction at a time so that operand and data bytes that
+// look like a LABEL are not taken for one. Numbered labels have no symbol,
+// so the instructions are needed even when there are symbols.
+func (f *File) setLabels(c *cpusimple.CPU) {
+	for _, seg := range f.Segments {
+		for number, addr := range disasm.Labels(seg.Data) {
+			c.Labels[number] = seg.Addr + addr
+		}
+	}
+	if f.Symbols == nil {
+		return
+	}
+	for _, sym := range f.Symbols.Symbols {
+		if sym.Kind == symbols.KindLabel && sym.Number >= 0 && sym.Number < len(c.Labels) {
+			c.Labels[sym.Number] = sym.Value
+		}
+	}
+}
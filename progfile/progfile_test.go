@@ -0,0 +1,115 @@
+package progfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/symbols"
+)
+
+// Sums the numbers from 1 to 10, loaded away from address 0
+var sum = []byte{
+	0x00, 0x81, 0xa0, 0x0a, 0x81, 0xa2, 0x01, 0x81, 0xa4, 0xe0,
+	0x80, 0xa1, 0x22, 0x81, 0xa0, 0x82, 0xa1, 0x44, 0x81, 0xa2,
+	0xc1, 0x80, 0xa1, 0x11,
+}
+
+func TestWriteRead(t *testing.T) {
+	fmt.Println("TestWriteRead")
+	f := New([]Segment{{Addr: 0x40, Data: sum}, {Addr: 0x200, Data: []byte{0, 5}}})
+	f.Entry = 0x40
+	f.Symbols = symbols.New([]symbols.Symbol{
+		{Name: "start", Kind: symbols.KindAddress, Value: 0x40},
+		{Name: "loop", Kind: symbols.KindLabel, Value: 0x4a, Number: 0},
+	})
+	if f.MemorySize != 1024 || f.StackHead != 1021 {
+		t.Fatalf("Want: 1024 bytes with the stack at x03fd Got: %d x%04x", f.MemorySize, f.StackHead)
+	}
+	var buf bytes.Buffer
+	if err := f.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !IsImage(buf.Bytes()) {
+		t.Fatalf("Want: image to start with %s", Magic)
+	}
+	read, err := Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, f) {
+		t.Fatalf("Want: %v Got: %v", f, read)
+	}
+
+	// Every truncation is reported
+	for n := 0; n < buf.Len(); n++ {
+		if _, err := Read(bytes.NewReader(buf.Bytes()[:n])); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("Want: unexpected EOF for %d bytes Got: %v", n, err)
+		}
+	}
+	bad := append([]byte("SCPU"), 9, 0, 0, 0, 0, 0, 0)
+	if _, err := Read(bytes.NewReader(bad)); err == nil || err.Error() != "unsupported program image version 9" {
+		t.Fatalf("Want: unsupported version Got: %v", err)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	fmt.Println("TestConfigure")
+	f := New([]Segment{{Addr: 0x40, Data: sum}})
+	f.Entry = 0x40
+	cpu := cpusimple.CPU{}
+	cpu.InitMemory(16) // Replaced by the memory the program asks for
+	if err := f.Configure(&cpu); err != nil {
+		t.Fatal(err)
+	}
+	if len(cpu.Memory) != 256 || cpu.PC != 0x40 || cpu.StackHead != 252 {
+		t.Fatalf("Want: 256 bytes, PC x0040, stack x00fc Got: %d x%04x x%04x", len(cpu.Memory), cpu.PC, cpu.StackHead)
+	}
+	cpu.RunFlag = true
+	for cpu.RunFlag {
+		cpu.FetchInstruction(cpu.Memory)
+	}
+	if cpu.Registers[0] != 55 {
+		t.Fatalf("Want: %d Got: %d", 55, cpu.Registers[0])
+	}
+
+	f.StackHead = 0x100
+	if err := f.Configure(&cpu); err == nil || err.Error() != "stack head x0100 is outside 256 bytes of memory" {
+		t.Fatalf("Want: stack error Got: %v", err)
+	}
+}
+
+func TestConfigureLabels(t *testing.T) {
+	fmt.Println("TestConfigureLabels")
+	// Counts x00e0 down from 3; the operands x00e0 look like LABEL 0
+	code := []byte{
+		0x03, cpusimple.STORE, 0x00, 0xe0, 0x01, 0x81, 0xa0, 0xe0,
+		cpusimple.LOAD, 0x00, 0xe0, 0x40, cpusimple.STORE, 0x00, 0xe0, 0xc1,
+		cpusimple.HALT,
+	}
+	for _, syms := range []*symbols.Map{nil, symbols.New([]symbols.Symbol{{Name: "loop", Kind: symbols.KindLabel, Value: 8, Number: 0}})} {
+		f := New([]Segment{{Addr: 0, Data: code}})
+		f.Symbols = syms
+		cpu := cpusimple.CPU{}
+		if err := f.Configure(&cpu); err != nil {
+			t.Fatal(err)
+		}
+		if cpu.Labels[0] != 8 {
+			t.Fatalf("Want: LABEL 0 at x0008 Got: x%04x", cpu.Labels[0])
+		}
+		loops := 0
+		for steps := 0; !cpu.Halted && steps < 100; steps++ {
+			if cpu.PC == 8 {
+				loops++
+			}
+			cpu.FetchInstruction(cpu.Memory)
+		}
+		if !cpu.Halted || loops != 3 {
+			t.Fatalf("Want: halted after 3 loops Got: %v %d", cpu.Halted, loops)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+; Common idioms shared by the exercise programs.
+; Include with: .include "lib/macros.asm"
+
+; move copies register src into register dst through the stack
+.macro move dst, src
+        push \src
+        pop \dst
+.endm
+
+; seti sets a register to a value from 0 to 15
+.macro seti reg, value
+        set \value
+        push r0
+        pop \reg
+.endm
+
+; clear sets a register to zero
+.macro clear reg
+        seti \reg, 0
+.endm
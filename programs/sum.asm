@@ -0,0 +1,16 @@
+; Sum the numbers from 1 to 10 into R0
+        .include "lib/macros.asm"
+
+        clear r1                ; R1 = running total
+        seti r2, 10             ; R2 = counter
+        seti r3, 1              ; R3 = decrement
+        label loop
+        move r0, r1
+        add r2
+        move r1, r0
+        move r0, r2
+        sub r3
+        move r2, r0
+        goto loop, nz
+        move r0, r1
+        halt
@@ -1,30 +1,43 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io"
 
 	"log"
 	"os"
-	"time"
+	"strings"
+	"sync"
+	"sync/atomic"
 
+	"chrisriddick.net/asm"
+	"chrisriddick.net/controller"
+	"chrisriddick.net/coverage"
 	"chrisriddick.net/cpusimple"
 	"chrisriddick.net/dashboard"
+	"chrisriddick.net/httpapi"
+	"chrisriddick.net/monitor"
+	"chrisriddick.net/profile"
+	"chrisriddick.net/progfile"
+	"chrisriddick.net/symbols"
+	"chrisriddick.net/tui"
 	"fyne.io/fyne/v2"
 )
 
+// Machine used for the built-in program, unless overridden by flags
 const (
 	MEMSIZE   = uint16(256)
 	STACKHEAD = MEMSIZE - 3
 )
 
 var (
-	cpu         = *cpusimple.NewCPU()
-	logger      *log.Logger
-	stepChan    = make(chan bool)
-	runChan     = make(chan bool)
-	pauseChan   = make(chan bool)
-	ClockChange = make(chan bool) // Used by dashboard to notify CPU the clock speed has changed
-	cpuclock    *time.Ticker
+	cpu    = *cpusimple.NewCPU()
+	logger *log.Logger
+	ctl    *controller.Controller // Runs the CPU for whichever frontend is in use
+	mon    *monitor.Monitor       // Carries out the commands of the monitor entry
+	prof   *profile.Profile       // Counts executed instructions with -profile, nil otherwise
 
 	/* program = []byte{
 		0x05, 0x81, 0x06, 0xa0, 0x20, // SET R0=5, PUSH, SET R0=6, POP R1, R0=R0+R1
@@ -92,145 +105,318 @@ var (
 */
 )
 
+// frontend is the user interface showing the CPU: the Fyne dashboard or the
+// terminal UI. Both are driven by the same functions below.
+type frontend interface {
+	SetStatus(s string)
+	Update(s *cpusimple.Snapshot)
+	LoadSymbols(m *symbols.Map)
+}
+
+// gui adapts the dashboard package to the frontend interface
+type gui struct{}
+
+func (gui) SetStatus(s string)           { dashboard.SetStatus(s) }
+func (gui) Update(s *cpusimple.Snapshot) { dashboard.Update(s) }
+func (gui) LoadSymbols(m *symbols.Map)   { dashboard.LoadSymbols(m) }
+
+// web is the frontend of -web. The browser reads the state from the API
+// itself, so only status messages are shown here, on standard error.
+type web struct{ api *httpapi.Server }
+
+func (web) SetStatus(s string)           { fmt.Fprintln(os.Stderr, s) }
+func (web) Update(s *cpusimple.Snapshot) {}
+func (w web) LoadSymbols(m *symbols.Map) { w.api.SetSymbols(m) }
+
+var ui frontend = gui{}
+
+// Program loaded by the Load button, the built-in program until a file is
+// opened, and the assembled program it came from, nil unless it was
+// assembled. Programs are opened in the dashboard and posted to the HTTP API
+// from other goroutines, so they are read with currentProgram.
+var (
+	programMu   sync.Mutex // Guards programFile and source
+	programFile = &progfile.File{
+		MemorySize: MEMSIZE,
+		StackHead:  STACKHEAD,
+		Segments:   []progfile.Segment{{Addr: 0, Data: program}},
+	}
+	source *asm.Program
+)
+
+// loadMu serializes loading programs, so the controller ends up with the
+// program last set
+var loadMu sync.Mutex
+
+// Return the current program and the assembled program it came from
+func currentProgram() (*progfile.File, *asm.Program) {
+	programMu.Lock()
+	defer programMu.Unlock()
+	return programFile, source
+}
+
+// Make f, assembled from src when it is not nil, the current program
+func setProgram(f *progfile.File, src *asm.Program) {
+	programMu.Lock()
+	programFile, source = f, src
+	programMu.Unlock()
+}
+
 func main() {
 
 	logger = log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
 
-	os.Setenv("FYNE_THEME", "light")
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if flag.NArg() == 1 {
+		f, src, err := readProgram(flag.Arg(0), *format)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		setProgram(f, src)
+	}
+	f, _ := currentProgram()
+	if err := applyFlags(f); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cpu.StackSize = uint16(*stackSize)
+	cpu.DetectLoops = *loops
+	if *profiling || *pprofFile != "" {
+		prof = profile.New()
+		prof.Attach(&cpu)
+	}
 
-	cpu.CPUStatus = make(chan string, 10)
-	cpu.InitMemory(MEMSIZE)
-	cpu.InitStack(STACKHEAD)
-	cpu.SetClock(1)         // Default to no delay
-	go g_monitorCPUStatus() // Set up background CPU monitor
+	if *headless {
+		runHeadless()
+		return
+	}
+	if *monitorMode {
+		runMonitor()
+		return
+	}
+	if *gdbAddr != "" {
+		runGDB()
+		return
+	}
+
+	cpu.InitMemory(f.MemorySize)
+	cpu.InitStack(f.StackHead)
+	coverage.Enable(&cpu) // Cheap enough to always record for the dashboard
+	cpu.SetClock(*clockRate)
+	if *speed > 0 {
+		cpu.SetClock(1000 / *speed)
+	}
 
-	cpuclock = time.NewTicker(time.Duration(cpu.Clock) * time.Millisecond)
+	if *webAddr != "" {
+		runWeb()
+		return
+	}
+
+	if *terminal {
+		t, err := tui.New(&cpu, reset, load, step, run, pause, exit)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		t.Bind('n', "Over", stepOver)
+		t.Bind('o', "Out", stepOut)
+		ui = t
+		ctl = controller.New(&cpu, show)
+		serveHTTP()
+		if flag.NArg() == 1 {
+			load()
+		}
+		t.Run()
+		return
+	}
+
+	os.Setenv("FYNE_THEME", "light")
+	dashboard.OpenProgram = openProgram
+	dashboard.SetClock = setClock
+	dashboard.StepOver = stepOver
+	dashboard.StepOut = stepOut
+	dashboard.StepN = stepN
+	dashboard.RunTo = runTo
+	dashboard.Command = command
+	dashboard.EditMemory = editMemory
+	if prof != nil {
+		dashboard.Profile = profileReport
+		dashboard.WritePprof = func(w io.Writer) error {
+			f, _ := currentProgram()
+			return ctl.Edit(func(*cpusimple.CPU) error { return prof.WritePprof(w, f.Symbols) })
+		}
+	}
 	// Set up Fyne window before trying to write to Status line!!!
 	var w fyne.Window = dashboard.New(&cpu, reset, load, step, run, pause, exit)
+	ctl = controller.New(&cpu, show)
+	mon = monitor.New(ctl, statusWriter{})
+	serveHTTP()
 
-	go clock()
+	if flag.NArg() == 1 {
+		load()
+	}
 
 	// Activate dashboard process
 	w.ShowAndRun()
 
 }
 
+// State of the last event shown, to report the speed when a run ends
+var lastState controller.State
+
+// Set by the Run button so the speed is only reported for free runs, not
+// for stepping commands
+var reportSpeed atomic.Bool
+
+// show passes the changes reported by the controller on to the frontend
+func show(e controller.Event) {
+	if e.Status != "" {
+		ui.SetStatus(e.Status)
+	}
+	if lastState == controller.Running && e.State != controller.Running && reportSpeed.Swap(false) && e.Speed > 0 {
+		ui.SetStatus("Measured speed: " + controller.FormatSpeed(e.Speed))
+	}
+	lastState = e.State
+	ui.Update(e.Snapshot)
+}
+
 func load() {
-	// Loads code in []program into CPU memory at index 0
-	cpu.Reset()
-	cpu.Load(program, len(program))
-	cpu.Preprocess(program, uint16(len(program)))
-	dashboard.SetStatus("Program loaded.")
-	dashboard.UpdateAll()
-	cpu.RunFlag = false
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	loadCurrent()
 }
 
-func run() {
-	result := cpu.VerifyProgramInMemory()
-	if !result {
-		dashboard.SetStatus("ERROR: No program loaded.")
-		return
+// Sets up memory and stack for the current program and loads its segments.
+// Errors are reported to the frontend by the controller. Called with loadMu
+// held.
+func loadCurrent() {
+	f, _ := currentProgram()
+	ui.LoadSymbols(f.Symbols)
+	if mon != nil {
+		mon.SetSymbols(f.Symbols)
 	}
-	cpu.RunFlag = true
-	go g_monitorCPUStatus() // Set up background CPU monitor
-	go g_Run(runChan)
-	go clock()
+	ctl.Load(f)
+	resetProfile()
 }
 
-func step() {
-	result := cpu.VerifyProgramInMemory()
-	if !result {
-		dashboard.SetStatus("ERROR: No program loaded.")
-		return
+// Reads a program file chosen in the dashboard and loads it in place of the
+// current program
+func openProgram(name string, r io.Reader) error {
+	return loadProgram(name, r, asm.Options{})
+}
+
+// Reads a program file, assembling source with opts, and loads it in place
+// of the current program
+func loadProgram(name string, r io.Reader, opts asm.Options) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f, src, err := parseProgram(name, data, "auto", opts)
+	if err != nil {
+		return err
 	}
-	go g_monitorCPUStatus() // Set up background CPU monitor
-	go g_Step(stepChan)     // Must do as goroutine because dashboard blocks
-	go clock()
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	setProgram(f, src)
+	loadCurrent()
+	return nil
 }
 
-func reset() {
-	cpu.Reset()
-	dashboard.SetStatus("CPU and memory reset.")
-	dashboard.UpdateAll()
-	cpuclock.Stop()
-	cpu.RunFlag = false
+func run() {
+	reportSpeed.Store(true)
+	ctl.Start()
 }
 
-func pause() {
-	dashboard.SetStatus("CPU paused. Press Run or Step to continue current program.")
-	dashboard.UpdateAll()
-	cpu.RunFlag = true
-	cpuclock.Stop()
-	go g_Pause(pauseChan)
+func step() {
+	ctl.Step()
 }
 
-func exit() {
-	os.Exit(0)
+func stepOver() {
+	ctl.StepOver()
 }
 
-// This function is the CPU clock
-// Instructions are fetched and executed so long as the ticker is running
-// Control is by channel messages from buttons in GUI
-func clock() {
-	for {
-		select {
-		case <-pauseChan:
-			cpu.RunFlag = false
-			dashboard.SetStatus("Clock paused.")
-			dashboard.UpdateAll()
-			cpuclock.Stop()
-		case <-runChan:
-			cpu.RunFlag = true
-			dashboard.SetStatus("Clock started.")
-			dashboard.UpdateAll()
-			cpuclock = time.NewTicker(time.Duration(cpu.Clock) * time.Millisecond)
-		case <-stepChan:
-			// Fetch and execute next instruction only
-			cpu.RunFlag = false
-			cpu.FetchInstruction(cpu.Memory)
-			dashboard.SetStatus(fmt.Sprintf("Single step. PC = x%04x, SP = x%04x, Flag = %t", cpu.PC, cpu.SP, cpu.Flag))
-			dashboard.UpdateAll()
-			cpuclock.Stop()
-		case <-cpuclock.C: // Execute next instruction of running and not paused
-			if cpu.RunFlag {
-				// Fetch and execute next instruction loop
-				cpu.FetchInstruction(cpu.Memory)
-				dashboard.UpdateAll()
-			} else {
-				cpuclock.Stop()
-			}
-		}
+func stepOut() {
+	ctl.StepOut()
+}
+
+func stepN(n uint64) {
+	ctl.StepN(n)
+}
+
+func runTo(addr uint16) {
+	ctl.RunTo(addr)
+}
+
+func reset() {
+	ctl.Reset()
+	resetProfile()
+}
+
+// Start counting again for a new run of the program. The profile belongs to
+// the goroutine running the CPU, so it is only touched through the controller.
+func resetProfile() {
+	if prof != nil {
+		ctl.Edit(func(*cpusimple.CPU) error { prof.Reset(); return nil })
 	}
 }
 
-func g_monitorCPUStatus() {
-	// Respond when channel message is received from CPU
-	s := <-cpu.CPUStatus
-	dashboard.SetStatus("From CPU channel monitor: " + s)
+// Summarize the profile of the program in memory
+func profileReport() *profile.Report {
+	var r *profile.Report
+	f, _ := currentProgram()
+	ctl.Edit(func(c *cpusimple.CPU) error {
+		r = prof.Report(c.Memory, f.Symbols)
+		return nil
+	})
+	return r
+}
+
+func pause() {
+	ctl.Pause()
 }
 
-// Monitor dashboard Step button status
-func g_Step(c chan bool) {
-	c <- true
+// Writes bytes typed into the dashboard memory grid
+func editMemory(addr uint16, data []byte) error {
+	return ctl.Edit(func(c *cpusimple.CPU) error { return c.LoadSegment(addr, data) })
 }
 
-// Monitor dashboard Run button status
-func g_Run(c chan bool) {
-	// Return dashboard status message
-	dashboard.SetStatus("From Run channel monitor: Running loaded program ...")
-	c <- true
+func setClock(ms float64) {
+	ctl.SetClock(ms)
 }
 
-// Monitor dashboard Pause button status
-func g_Pause(c chan bool) {
-	// Return dashboard status message
-	dashboard.SetStatus("From Pause channel monitor: Program paused.")
-	c <- true
+// Carries out a line typed in the monitor entry. Commands that run the
+// program wait for it to stop, so they get their own goroutine.
+func command(line string) {
+	go func() {
+		if err := mon.Exec(context.Background(), line); err != nil {
+			ui.SetStatus("error: " + err.Error())
+		}
+	}()
+}
+
+// statusWriter shows each line written to it as a status line of the frontend
+type statusWriter struct{}
+
+func (statusWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		ui.SetStatus(line)
+	}
+	return len(p), nil
 }
 
-// Monitor dashboard Clock speed change channel
-func g_Clock(c chan bool) {
-	// Return dashboard status message
-	dashboard.SetStatus("From Clock channel monitor: Clock speed changed.")
-	c <- true
+func exit() {
+	if prof != nil && *pprofFile != "" {
+		err := ctl.Edit(func(*cpusimple.CPU) error { return writePprof(prof) })
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(0)
 }
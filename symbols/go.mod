@@ -0,0 +1,3 @@
+module chrisriddick.net/symbols
+
+go 1.21.6
@@ -0,0 +1,170 @@
+package symbols
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of symbols found in a symbol map, matching the assembler's symbol kinds
+const (
+	KindAddress  = "address"  // Code or data address defined by "name:"
+	KindConstant = "constant" // Value defined by .equ, not an address
+	KindLabel    = "label"    // LABEL instruction, Value is the address execution continues at
+)
+
+// Symbol is one entry of a symbol map
+type Symbol struct {
+	Name   string
+	Kind   string
+	Value  uint16
+	Number int // LABEL number for KindLabel
+}
+
+// Map is a symbol map loaded from the assembler output
+type Map struct {
+	Symbols []Symbol
+}
+
+// New returns a map holding syms sorted by value
+func New(syms []Symbol) *Map {
+	m := &Map{Symbols: append([]Symbol{}, syms...)}
+	sort.SliceStable(m.Symbols, func(i, j int) bool {
+		if m.Symbols[i].Value != m.Symbols[j].Value {
+			return m.Symbols[i].Value < m.Symbols[j].Value
+		}
+		return m.Symbols[i].Name < m.Symbols[j].Name
+	})
+	return m
+}
+
+// Write saves the map in text form, one symbol per line:
+//
+//	0010 address sub
+//	000a label loop 0
+func (m *Map) Write(w io.Writer) error {
+	for _, sym := range m.Symbols {
+		line := fmt.Sprintf("%04x %s %s", sym.Value, sym.Kind, sym.Name)
+		if sym.Kind == KindLabel {
+			line = line + fmt.Sprintf(" %d", sym.Number)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read parses a symbol map written by Write. Blank lines and lines starting
+// with ';' are ignored.
+func Read(r io.Reader) (*Map, error) {
+	var syms []Symbol
+	scanner := bufio.NewScanner(r)
+	num := 0
+	for scanner.Scan() {
+		num++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("symbol map line %d: expected address, kind and name", num)
+		}
+		value, err := strconv.ParseUint(fields[0], 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("symbol map line %d: invalid address %q", num, fields[0])
+		}
+		sym := Symbol{Name: fields[2], Kind: fields[1], Value: uint16(value)}
+		switch sym.Kind {
+		case KindAddress, KindConstant:
+		case KindLabel:
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("symbol map line %d: label %s has no number", num, sym.Name)
+			}
+			if sym.Number, err = strconv.Atoi(fields[3]); err != nil {
+				return nil, fmt.Errorf("symbol map line %d: invalid label number %q", num, fields[3])
+			}
+		default:
+			return nil, fmt.Errorf("symbol map line %d: unknown symbol kind %q", num, sym.Kind)
+		}
+		syms = append(syms, sym)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return New(syms), nil
+}
+
+// Load reads the symbol map file at path
+func Load(path string) (*Map, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Lookup returns the name of the address symbol at addr. Constants and
+// LABEL symbols are never returned since they do not name an address.
+func (m *Map) Lookup(addr uint16) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	for _, sym := range m.Symbols {
+		if sym.Value == addr && sym.Kind == KindAddress {
+			return sym.Name, true
+		}
+	}
+	return "", false
+}
+
+// Nearest returns the closest address symbol at or below addr together with
+// the offset of addr from it, as used for "sub+3" style names
+func (m *Map) Nearest(addr uint16) (string, uint16, bool) {
+	if m == nil {
+		return "", 0, false
+	}
+	var best *Symbol
+	for i := range m.Symbols {
+		sym := &m.Symbols[i]
+		if sym.Kind == KindAddress && sym.Value <= addr {
+			best = sym
+		}
+	}
+	if best == nil {
+		return "", 0, false
+	}
+	return best.Name, addr - best.Value, true
+}
+
+// Label returns the name of the LABEL symbol with the given number
+func (m *Map) Label(number int) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	for _, sym := range m.Symbols {
+		if sym.Kind == KindLabel && sym.Number == number {
+			return sym.Name, true
+		}
+	}
+	return "", false
+}
+
+// Address returns the value of the named symbol
+func (m *Map) Address(name string) (uint16, bool) {
+	if m == nil {
+		return 0, false
+	}
+	for _, sym := range m.Symbols {
+		if sym.Name == name {
+			return sym.Value, true
+		}
+	}
+	return 0, false
+}
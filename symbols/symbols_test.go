@@ -0,0 +1,67 @@
+package symbols
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestWriteRead(t *testing.T) {
+	fmt.Println("TestWriteRead")
+	m := New([]Symbol{
+		{Name: "sub", Kind: KindAddress, Value: 0x10},
+		{Name: "RESULT", Kind: KindConstant, Value: 0x80},
+		{Name: "loop", Kind: KindLabel, Value: 0x0a, Number: 0},
+		{Name: "start", Kind: KindAddress, Value: 0},
+	})
+	var buf bytes.Buffer
+	if err := m.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "0000 address start\n000a label loop 0\n0010 address sub\n0080 constant RESULT\n"
+	if buf.String() != want {
+		t.Fatalf("Want:\n%s\nGot:\n%s", want, buf.String())
+	}
+	read, err := Read(strings.NewReader("; comment\n\n" + buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Symbols) != 4 || read.Symbols[1] != m.Symbols[1] {
+		t.Fatalf("Want: %v Got: %v", m.Symbols, read.Symbols)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	fmt.Println("TestReadErrors")
+	for _, src := range []string{"0010 address", "zz address a", "0010 register a", "0010 label a"} {
+		if _, err := Read(strings.NewReader(src)); err == nil {
+			t.Fatalf("Want: error for %q Got: none", src)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	fmt.Println("TestLookup")
+	m := New([]Symbol{
+		{Name: "sub", Kind: KindAddress, Value: 0x10},
+		{Name: "SIXTEEN", Kind: KindConstant, Value: 0x10},
+		{Name: "loop", Kind: KindLabel, Value: 0x14, Number: 2},
+	})
+	if name, ok := m.Lookup(0x10); !ok || name != "sub" {
+		t.Fatalf("Want: sub Got: %s", name)
+	}
+	if name, off, ok := m.Nearest(0x13); !ok || name != "sub" || off != 3 {
+		t.Fatalf("Want: sub+3 Got: %s+%d", name, off)
+	}
+	if _, _, ok := m.Nearest(0x0f); ok {
+		t.Fatalf("Want: no symbol below x0010")
+	}
+	if name, ok := m.Label(2); !ok || name != "loop" {
+		t.Fatalf("Want: loop Got: %s", name)
+	}
+	var none *Map
+	if _, ok := none.Lookup(0); ok {
+		t.Fatalf("Want: nil map to find nothing")
+	}
+}
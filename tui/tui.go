@@ -0,0 +1,236 @@
+// Package tui is a full-screen terminal frontend for the simulator, showing
+// the same panels as the Fyne dashboard so it can be used over SSH.
+package tui
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/disasm"
+	"chrisriddick.net/symbols"
+	"github.com/gdamore/tcell/v2"
+)
+
+// Layout of the screen
+const (
+	consoleLines    = 6 // Status lines kept at the bottom of the screen
+	consoleHistory  = 100
+	codeLinesBefore = 4
+	codeLinesAfter  = 11
+	registersX      = 0
+	memoryX         = 14
+	stackX          = 71
+	codeX           = 86
+	panelsY         = 3
+)
+
+const help = " r Reset  l Load  g Run  s Step  p Pause  q Exit  PgUp/PgDn Memory"
+
+var (
+	titleStyle  = tcell.StyleDefault.Reverse(true)
+	headerStyle = tcell.StyleDefault.Bold(true)
+	pcStyle     = tcell.StyleDefault.Foreground(tcell.ColorYellow).Bold(true)
+)
+
+// UI is the terminal frontend. Its methods may be called from any goroutine.
+type UI struct {
+	snap      *cpusimple.Snapshot // CPU state on display
+	screen    tcell.Screen
+	mu        sync.Mutex
+	console   []string
+	symbolMap *symbols.Map
+	memoryTop int // First memory line shown
+	keys      map[rune]func()
+	help      string // Key help shown in the title line
+	exit      func()
+}
+
+// New takes over the terminal and returns the UI for cpu, showing its state
+// until the first call to Update. The functions are called for the keys
+// bound to the buttons of the dashboard.
+func New(cpu *cpusimple.CPU, reset func(), load func(), step func(), run func(), pause func(), exit func()) (*UI, error) {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return nil, err
+	}
+	return newUI(screen, cpu, reset, load, step, run, pause, exit)
+}
+
+// newUI is New drawing on the given screen
+func newUI(screen tcell.Screen, cpu *cpusimple.CPU, reset func(), load func(), step func(), run func(), pause func(), exit func()) (*UI, error) {
+	if err := screen.Init(); err != nil {
+		return nil, err
+	}
+	u := &UI{
+		snap:   cpu.Snapshot(),
+		screen: screen,
+		keys:   map[rune]func(){'r': reset, 'l': load, 's': step, 'g': run, 'p': pause},
+		help:   help,
+		exit:   exit,
+	}
+	u.console = []string{"CPU status is displayed here."}
+	return u, nil
+}
+
+// Run handles keys until the exit key is pressed, then restores the
+// terminal and calls the exit function
+func (u *UI) Run() {
+	u.UpdateAll()
+	for {
+		switch ev := u.screen.PollEvent().(type) {
+		case *tcell.EventResize:
+			u.screen.Sync()
+			u.UpdateAll()
+		case *tcell.EventKey:
+			switch {
+			case ev.Key() == tcell.KeyEscape || ev.Key() == tcell.KeyCtrlC || ev.Rune() == 'q':
+				u.screen.Fini()
+				u.exit()
+				return
+			case ev.Key() == tcell.KeyPgDn:
+				u.scrollMemory(1)
+			case ev.Key() == tcell.KeyPgUp:
+				u.scrollMemory(-1)
+			case ev.Key() == tcell.KeyRune:
+				// Run the action in its own goroutine like a button press,
+				// since it may wait on the clock
+				if action, ok := u.keys[ev.Rune()]; ok && action != nil {
+					go action()
+				}
+			}
+		}
+	}
+}
+
+// SetStatus adds a line to the status console
+func (u *UI) SetStatus(s string) {
+	u.mu.Lock()
+	u.console = append(u.console, s)
+	if len(u.console) > consoleHistory {
+		u.console = u.console[1:]
+	}
+	u.mu.Unlock()
+	u.UpdateAll()
+}
+
+// Update shows a new snapshot of the CPU state
+func (u *UI) Update(s *cpusimple.Snapshot) {
+	u.mu.Lock()
+	u.snap = s
+	u.mu.Unlock()
+	u.UpdateAll()
+}
+
+// LoadSymbols sets the symbol map used to name addresses and labels in the code view
+func (u *UI) LoadSymbols(m *symbols.Map) {
+	u.mu.Lock()
+	u.symbolMap = m
+	u.mu.Unlock()
+	u.UpdateAll()
+}
+
+// Bind makes key call action, like the keys of the dashboard buttons, and
+// lists it in the title line as name. It must be called before Run.
+func (u *UI) Bind(key rune, name string, action func()) {
+	u.keys[key] = action
+	u.help = fmt.Sprintf("%s  %c %s", u.help, key, name)
+}
+
+// Move the memory panel by a page
+func (u *UI) scrollMemory(pages int) {
+	u.mu.Lock()
+	_, h := u.screen.Size()
+	u.memoryTop += pages * u.panelHeight(h)
+	lines := (len(u.snap.Memory) + 15) / 16
+	if u.memoryTop > lines-1 {
+		u.memoryTop = lines - 1
+	}
+	if u.memoryTop < 0 {
+		u.memoryTop = 0
+	}
+	u.mu.Unlock()
+	u.UpdateAll()
+}
+
+// Number of data lines available to each panel
+func (u *UI) panelHeight(screenHeight int) int {
+	h := screenHeight - panelsY - consoleLines - 3
+	if h < 1 {
+		h = 1
+	}
+	return h
+}
+
+// UpdateAll redraws the screen from the latest snapshot
+func (u *UI) UpdateAll() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c := u.snap
+	s := u.screen
+	w, h := s.Size()
+	s.Clear()
+
+	u.text(0, 0, w, fmt.Sprintf("%-*s", w, " Simple CPU Simulator   "+u.help+" "), titleStyle)
+	u.text(0, 1, w, fmt.Sprintf("PC: x%04x  SP: x%04x  Flag: %t  Clock: %.3f ms", c.PC, c.SP, c.Flag, c.Clock), headerStyle)
+
+	rows := u.panelHeight(h)
+	u.panel(registersX, memoryX-registersX-1, "Registers", lines(c.GetRegisters()), rows, -1)
+
+	memory := lines(c.GetAllMemory())
+	header, memory := memory[0], memory[1:]
+	if u.memoryTop < len(memory) {
+		memory = memory[u.memoryTop:]
+	}
+	u.panel(memoryX, stackX-memoryX-1, "Memory", append([]string{header}, memory...), rows, -1)
+
+	u.panel(stackX, codeX-stackX-1, "Stack", lines(c.GetStack()), rows, -1)
+
+	code := lines(disasm.Window(c.Memory, c.PC, u.symbolMap, codeLinesBefore, codeLinesAfter))
+	current := -1
+	for i, line := range code {
+		if strings.HasPrefix(line, "=>") {
+			current = i
+		}
+	}
+	u.panel(codeX, w-codeX, "Code", code, rows, current)
+
+	y := h - consoleLines - 1
+	u.text(0, y, w, "Status", headerStyle)
+	first := len(u.console) - consoleLines
+	if first < 0 {
+		first = 0
+	}
+	for i, line := range u.console[first:] {
+		u.text(0, y+1+i, w, line, tcell.StyleDefault)
+	}
+	s.Show()
+}
+
+// Draw a titled panel of lines at column x, highlighting line mark
+func (u *UI) panel(x, width int, title string, body []string, rows, mark int) {
+	u.text(x, panelsY, width, title, headerStyle)
+	for i := 0; i < len(body) && i < rows; i++ {
+		style := tcell.StyleDefault
+		if i == mark {
+			style = pcStyle
+		}
+		u.text(x, panelsY+1+i, width, body[i], style)
+	}
+}
+
+// Draw s at x, y cut to width
+func (u *UI) text(x, y, width int, s string, style tcell.Style) {
+	for i, r := range []rune(s) {
+		if i >= width {
+			break
+		}
+		u.screen.SetContent(x+i, y, r, nil, style)
+	}
+}
+
+// Split text into lines, dropping the empty line after the last newline
+func lines(s string) []string {
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,167 @@
+package tui
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"chrisriddick.net/controller"
+	"chrisriddick.net/cpusimple"
+	"chrisriddick.net/progfile"
+	"github.com/gdamore/tcell/v2"
+)
+
+// Return the text of row y of the simulated screen
+func row(s tcell.SimulationScreen, y int) string {
+	cells, w, _ := s.GetContents()
+	var b strings.Builder
+	for x := 0; x < w; x++ {
+		r := cells[y*w+x].Runes
+		if len(r) == 0 {
+			b.WriteRune(' ')
+		} else {
+			b.WriteRune(r[0])
+		}
+	}
+	return b.String()
+}
+
+func TestPanels(t *testing.T) {
+	fmt.Println("TestPanels")
+	cpu := &cpusimple.CPU{}
+	cpu.InitMemory(64)
+	cpu.InitStack(64 - 3)
+	cpu.Reset()
+	cpu.Load([]byte{0x15, 0x00, 0x04, 0x11, 0x16}, 5)
+	cpu.PC = 3
+	screen := tcell.NewSimulationScreen("")
+	u, err := newUI(screen, cpu, nil, nil, nil, nil, nil, func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(140, 30)
+	u.SetStatus("Program loaded.")
+
+	if got := row(screen, 1); !strings.HasPrefix(got, "PC: x0003  SP: x003e  Flag: false") {
+		t.Fatalf("Want: PC x0003 Got: %q", got)
+	}
+	if got := row(screen, 4); !strings.HasPrefix(got, "R00: x0000") || !strings.Contains(got, "00 01 02 03") {
+		t.Fatalf("Want: registers and memory header Got: %q", got)
+	}
+	if got := row(screen, 5); !strings.Contains(got, "0000:  15 00 04 11 16") || !strings.Contains(got, "=> 0003:  11") {
+		t.Fatalf("Want: memory and current instruction Got: %q", got)
+	}
+	if got := row(screen, 25); !strings.HasPrefix(got, "Program loaded.") {
+		t.Fatalf("Want: status below the first console line Got: %q", got)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	fmt.Println("TestKeys")
+	cpu := &cpusimple.CPU{}
+	cpu.InitMemory(16)
+	screen := tcell.NewSimulationScreen("")
+	pressed := make(chan string, 10)
+	key := func(name string) func() { return func() { pressed <- name } }
+	u, err := newUI(screen, cpu, key("reset"), key("load"), key("step"), key("run"), key("pause"), key("exit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Bind('n', "Over", key("over"))
+	done := make(chan bool)
+	go func() {
+		u.Run()
+		done <- true
+	}()
+	for _, r := range "lsgpnrq" {
+		screen.InjectKey(tcell.KeyRune, r, tcell.ModNone)
+	}
+	var got []string
+	for len(got) < 7 {
+		select {
+		case name := <-pressed:
+			got = append(got, name)
+		case <-time.After(time.Second):
+			t.Fatalf("Want: 7 actions Got: %v", got)
+		}
+	}
+	<-done
+	// Actions run in their own goroutines, so they arrive in any order
+	sort.Strings(got)
+	want := "[exit load over pause reset run step]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("Want: %s Got: %v", want, got)
+	}
+}
+
+// Drives the controller from the keyboard while it runs, for go test -race
+func TestDriveController(t *testing.T) {
+	fmt.Println("TestDriveController")
+	sum := []byte{
+		0x00, 0x81, 0xa0, 0x0a, 0x81, 0xa2, 0x01, 0x81, 0xa4, 0xe0,
+		0x80, 0xa1, 0x22, 0x81, 0xa0, 0x82, 0xa1, 0x44, 0x81, 0xa2,
+		0xc1, 0x80, 0xa1, 0x11,
+	}
+	cpu := &cpusimple.CPU{}
+	cpu.InitMemory(256)
+	screen := tcell.NewSimulationScreen("")
+	screen.SetSize(140, 40)
+	var ctl *controller.Controller
+	states := make(chan controller.State, 1000)
+	u, err := newUI(screen, cpu,
+		func() { ctl.Reset() },
+		func() { ctl.Load(progfile.New([]progfile.Segment{{Addr: 0, Data: sum}})) },
+		func() { ctl.Step() },
+		func() { ctl.Start() },
+		func() { ctl.Pause() },
+		func() {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl = controller.New(cpu, func(e controller.Event) {
+		if e.Status != "" {
+			u.SetStatus(e.Status)
+		}
+		u.Update(e.Snapshot)
+		states <- e.State
+	})
+	defer ctl.Close()
+	done := make(chan bool)
+	go func() {
+		u.Run()
+		done <- true
+	}()
+	wait := func(want controller.State) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case s := <-states:
+				if s == want {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Want: %s Got: timeout", want)
+			}
+		}
+	}
+
+	screen.InjectKey(tcell.KeyRune, 'l', tcell.ModNone)
+	wait(controller.Paused)
+	screen.InjectKey(tcell.KeyRune, 'g', tcell.ModNone)
+	for i := 0; i < 20; i++ {
+		// Redraw from the UI goroutine while the program runs
+		screen.InjectKey(tcell.KeyPgDn, 0, tcell.ModNone)
+		screen.InjectKey(tcell.KeyPgUp, 0, tcell.ModNone)
+	}
+	wait(controller.Halted)
+	u.mu.Lock() // The keys may still be redrawing
+	got := row(screen, 4)
+	u.mu.Unlock()
+	screen.InjectKey(tcell.KeyRune, 'q', tcell.ModNone)
+	<-done
+	if !strings.HasPrefix(got, "R00: x0037") {
+		t.Fatalf("Want: R00: x0037 Got: %q", got)
+	}
+}
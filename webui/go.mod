@@ -0,0 +1,3 @@
+module chrisriddick.net/webui
+
+go 1.21.6
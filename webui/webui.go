@@ -0,0 +1,29 @@
+// Package webui is a browser frontend for the simulator, for machines where
+// the Fyne dashboard cannot open a window. It serves a single page showing
+// the same panels as the dashboard, driven and updated live through the
+// HTTP/JSON API of the httpapi package.
+package webui
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed index.html
+var index []byte
+
+// Handler returns the web dashboard, with api answering the requests under
+// /api/
+func Handler(api http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/", api)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(index)
+	})
+	return mux
+}
@@ -0,0 +1,44 @@
+package webui
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	fmt.Println("TestHandler")
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "api %s", r.URL.Path)
+	})
+	ts := httptest.NewServer(Handler(api))
+	defer ts.Close()
+	get := func(path string) (int, string, string) {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+	}
+
+	code, ct, body := get("/")
+	if code != http.StatusOK || !strings.HasPrefix(ct, "text/html") || !strings.Contains(body, `new EventSource("/api/events?memory=1")`) {
+		t.Fatalf("Want: the dashboard page Got: %d %s %.80q", code, ct, body)
+	}
+	for _, panel := range []string{`id="registers"`, `id="memory"`, `id="stack"`, `id="code"`, `id="messages"`, `id="clock"`} {
+		if !strings.Contains(body, panel) {
+			t.Fatalf("Want: %s Got: none", panel)
+		}
+	}
+	if code, _, body := get("/api/status"); code != http.StatusOK || body != "api /api/status" {
+		t.Fatalf("Want: api /api/status Got: %d %q", code, body)
+	}
+	if code, _, _ := get("/favicon.ico"); code != http.StatusNotFound {
+		t.Fatalf("Want: 404 Got: %d", code)
+	}
+}